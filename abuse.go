@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+const (
+	// abuseTableName is the stick table tracking the sources of all of the frontends for abuse blocking
+	abuseTableName = "abuse"
+	// bannedListFile is the ACL list of the banned sources, kept by the manager rather than the keys
+	bannedListFile = "banned.acl"
+	// defaultBanTime is how long a source is banned for, and how long the bans found at startup last
+	defaultBanTime = 10 * time.Minute
+	// defaultAbuseInterval is how often the counters of the sources are checked
+	defaultAbuseInterval = 10 * time.Second
+)
+
+// abuseCounters are the counters of the abuse table a limit can be set on
+var abuseCounters = []string{"http_err_rate", "http_req_rate", "conn_rate"}
+
+// abusePolicy bans the sources whose counters go over a limit
+type abusePolicy struct {
+	Limits   []abuseLimit
+	BanTime  time.Duration
+	Interval time.Duration
+}
+
+// abuseLimit is the most a counter of a source may count over a period, such as http_err_rate 50 over 10s
+type abuseLimit struct {
+	Counter string
+	Limit   int64
+	Period  string
+}
+
+// loadAbusePolicy reads the abuse keys of a service, it returns nil without limits:
+//
+//	abuse/http_err_rate  the most requests ending in a 4xx error of a source over a period, e.g. 50/10s
+//	abuse/http_req_rate  the most requests of a source over a period
+//	abuse/conn_rate      the most connections of a source over a period
+//	abuse/ban_time       how long a source is banned for, 10m by default
+//	abuse/interval       how often the counters are checked, 10s by default
+func loadAbusePolicy(kv map[string]string, prefix string) (*abusePolicy, error) {
+	keys := subKeys(kv, prefix+"abuse/")
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	policy := &abusePolicy{BanTime: defaultBanTime, Interval: defaultAbuseInterval}
+	for _, setting := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"ban_time", &policy.BanTime},
+		{"interval", &policy.Interval},
+	} {
+		value, ok := keys[setting.key]
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < time.Second {
+			return nil, &invalidKeyError{prefix + "abuse/" + setting.key, fmt.Sprintf("%q isn't a duration of at least 1s", value)}
+		}
+		*setting.value = duration
+	}
+	for key := range keys {
+		if key != "ban_time" && key != "interval" && !containsString(abuseCounters, key) {
+			return nil, &invalidKeyError{prefix + "abuse/" + key, "not an abuse setting"}
+		}
+	}
+	for _, counter := range abuseCounters {
+		value, ok := keys[counter]
+		if !ok {
+			continue
+		}
+		match := requestRatePattern.FindStringSubmatch(value)
+		if match == nil || match[1] == "0" {
+			return nil, &invalidKeyError{prefix + "abuse/" + counter, fmt.Sprintf("%q isn't a rate such as 50/10s", value)}
+		}
+		limit, _ := strconv.ParseInt(match[1], 10, 64)
+		policy.Limits = append(policy.Limits, abuseLimit{Counter: counter, Limit: limit, Period: match[2]})
+	}
+	if len(policy.Limits) == 0 {
+		return nil, &invalidKeyError{prefix + "abuse/", "abuse blocking needs a limit on http_err_rate, http_req_rate or conn_rate"}
+	}
+	return policy, nil
+}
+
+// Table is the name of the stick table tracking the sources
+func (p *abusePolicy) Table() string {
+	return abuseTableName
+}
+
+// Store is the data the stick table keeps, such as http_err_rate(10s),conn_rate(10s)
+func (p *abusePolicy) Store() string {
+	store := []string{}
+	for _, limit := range p.Limits {
+		store = append(store, limit.Counter+"("+limit.Period+")")
+	}
+	return strings.Join(store, ",")
+}
+
+// exceeded returns why a source is over a limit, or nothing. HAProxy shows the periods of the rates in milliseconds,
+// e.g. http_err_rate(10000), which doesn't matter as the table has one rate of each counter.
+func (p *abusePolicy) exceeded(entry trackedCounter) string {
+	for _, limit := range p.Limits {
+		for name, value := range entry.Counters {
+			if strings.HasPrefix(name, limit.Counter+"(") && value > limit.Limit {
+				return fmt.Sprintf("%s %d over %d/%s", limit.Counter, value, limit.Limit, limit.Period)
+			}
+		}
+	}
+	return ""
+}
+
+// abuseBan is a source rejected by all of the frontends until it expires
+type abuseBan struct {
+	Address string
+	Reason  string
+	Since   time.Time
+	Until   time.Time
+}
+
+// setAbusePolicy takes the policy of the rendered config, nil when abuse blocking is off
+func (svc *service) setAbusePolicy(policy *abusePolicy) {
+	svc.abuseMu.Lock()
+	defer svc.abuseMu.Unlock()
+	svc.abusePolicy = policy
+}
+
+// loadBans reads the bans left by a previous run of the manager from the banned list, which doesn't keep when they
+// expire, so they last the default ban time from now
+func (svc *service) loadBans(now time.Time) {
+	content, err := ioutil.ReadFile(filepath.Join(svc.aclDir(), bannedListFile))
+	if err != nil {
+		return
+	}
+	svc.abuseMu.Lock()
+	defer svc.abuseMu.Unlock()
+	for _, address := range strings.Fields(string(content)) {
+		svc.bans[address] = &abuseBan{Address: address, Reason: "banned before the manager restarted", Since: now, Until: now.Add(defaultBanTime)}
+	}
+}
+
+// createBannedList writes the banned list when it doesn't exist yet, as a config referring to it can't be checked
+// without it. It returns whether it created the list.
+func (svc *service) createBannedList() (bool, error) {
+	if _, err := os.Stat(filepath.Join(svc.aclDir(), bannedListFile)); !os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, svc.writeBans()
+}
+
+// writeBans writes the banned list, which the config refers to, so a reloaded HAProxy keeps the bans
+func (svc *service) writeBans() error {
+	svc.abuseMu.Lock()
+	defer svc.abuseMu.Unlock()
+	return svc.writeBansLocked()
+}
+
+func (svc *service) writeBansLocked() error {
+	addresses := []string{}
+	for address := range svc.bans {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	content := ""
+	for _, address := range addresses {
+		content += address + "\n"
+	}
+	if err := os.MkdirAll(svc.aclDir(), 0755); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	path := filepath.Join(svc.aclDir(), bannedListFile)
+	if err := ioutil.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	return nil
+}
+
+// listBans returns the current bans, oldest first
+func (svc *service) listBans() []abuseBan {
+	svc.abuseMu.Lock()
+	defer svc.abuseMu.Unlock()
+	bans := []abuseBan{}
+	for _, ban := range svc.bans {
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Since.Equal(bans[j].Since) {
+			return bans[i].Address < bans[j].Address
+		}
+		return bans[i].Since.Before(bans[j].Since)
+	})
+	return bans
+}
+
+// checkAbuse lifts the expired bans, and bans the sources over the limits of the policy in the abuse table. The
+// banned list is changed through the runtime API so the bans apply at once, and written for the next reload. A ban
+// is only added or lifted once HAProxy took the change, the others are tried again at the next check.
+func (svc *service) checkAbuse(now time.Time) {
+	svc.abuseMu.Lock()
+	policy := svc.abusePolicy
+	svc.abuseMu.Unlock()
+	entries := []trackedCounter{}
+	if policy != nil {
+		output, err := svc.haproxyCommand("show table " + abuseTableName)
+		if err != nil {
+			log.Printf("unable to read the abuse table of %s: %v\n", svc.Name, err)
+		}
+		entries = parseTableEntries(abuseTableName, output)
+	}
+
+	// the changes are sent without the lock, so a slow admin socket doesn't hold up the renders and ListBans
+	svc.abuseMu.Lock()
+	lifted := []*abuseBan{}
+	addresses := []string{}
+	for address := range svc.bans {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		if ban := svc.bans[address]; !now.Before(ban.Until) {
+			lifted = append(lifted, ban)
+		}
+	}
+	banned := []*abuseBan{}
+	for _, entry := range entries {
+		if _, ok := svc.bans[entry.Key]; ok {
+			continue
+		}
+		if reason := policy.exceeded(entry); reason != "" {
+			banned = append(banned, &abuseBan{Address: entry.Key, Reason: reason, Since: now, Until: now.Add(policy.BanTime)})
+		}
+	}
+	svc.abuseMu.Unlock()
+	if len(lifted) == 0 && len(banned) == 0 {
+		return
+	}
+
+	path := svc.haproxyPath(filepath.Join(svc.aclDir(), bannedListFile))
+	appliedLifts := []*abuseBan{}
+	for _, ban := range lifted {
+		err := svc.haproxyUpdate("del acl " + path + " " + ban.Address)
+		if refusal, ok := err.(*runtimeAPIRefusal); ok && refusal.notFound() {
+			// HAProxy dropped the entry already, such as when it reloaded the list
+			err = nil
+		}
+		if err != nil {
+			log.Printf("unable to lift the ban of %s from %s in HAProxy, trying again at the next check: %v\n", ban.Address, svc.Name, err)
+			continue
+		}
+		appliedLifts = append(appliedLifts, ban)
+	}
+	appliedBans := []*abuseBan{}
+	for _, ban := range banned {
+		if err := svc.haproxyUpdate("add acl " + path + " " + ban.Address); err != nil {
+			log.Printf("unable to ban %s from %s in HAProxy, trying again at the next check: %v\n", ban.Address, svc.Name, err)
+			continue
+		}
+		appliedBans = append(appliedBans, ban)
+	}
+	if len(appliedLifts) == 0 && len(appliedBans) == 0 {
+		return
+	}
+
+	svc.abuseMu.Lock()
+	defer svc.abuseMu.Unlock()
+	for _, ban := range appliedLifts {
+		delete(svc.bans, ban.Address)
+		log.Printf("lifted the ban of %s from %s\n", ban.Address, svc.Name)
+		svc.events.record(workloadEvent{Time: now, Name: svc.Name, Action: "unban", Ban: ban})
+	}
+	for _, ban := range appliedBans {
+		svc.bans[ban.Address] = ban
+		log.Printf("banned %s from %s for %s: %s\n", ban.Address, svc.Name, policy.BanTime, ban.Reason)
+		svc.events.record(workloadEvent{Time: now, Name: svc.Name, Action: "ban", Ban: ban})
+	}
+	if err := svc.writeBansLocked(); err != nil {
+		log.Printf("unable to write the banned list of %s: %v\n", svc.Name, err)
+	}
+}
+
+// blockAbusers checks the abuse table at the interval of the policy until stop receives
+func blockAbusers(svc *service, stop chan struct{}) {
+	svc.loadBans(time.Now())
+	for {
+		interval := defaultAbuseInterval
+		svc.abuseMu.Lock()
+		if svc.abusePolicy != nil {
+			interval = svc.abusePolicy.Interval
+		}
+		svc.abuseMu.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		svc.checkAbuse(time.Now())
+	}
+}
+
+func banToProto(ban *abuseBan) *pb.Ban {
+	if ban == nil {
+		return nil
+	}
+	return &pb.Ban{
+		Address: ban.Address,
+		Reason:  ban.Reason,
+		Since:   ban.Since.UnixNano(),
+		Until:   ban.Until.UnixNano(),
+	}
+}
+
+func bansToProto(bans []abuseBan) []*pb.Ban {
+	out := []*pb.Ban{}
+	for i := range bans {
+		out = append(out, banToProto(&bans[i]))
+	}
+	return out
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+func TestLoadAbusePolicy(t *testing.T) {
+	kv := map[string]string{
+		"svc/abuse/http_err_rate": "50/10s",
+		"svc/abuse/conn_rate":     "100/1m",
+		"svc/abuse/ban_time":      "1h",
+	}
+	policy, err := loadAbusePolicy(kv, "svc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &abusePolicy{
+		Limits:   []abuseLimit{{Counter: "http_err_rate", Limit: 50, Period: "10s"}, {Counter: "conn_rate", Limit: 100, Period: "1m"}},
+		BanTime:  time.Hour,
+		Interval: defaultAbuseInterval,
+	}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("expected %+v, got %+v", expected, policy)
+	}
+	if store := policy.Store(); store != "http_err_rate(10s),conn_rate(1m)" {
+		t.Errorf("unexpected store: %s", store)
+	}
+
+	if policy, err := loadAbusePolicy(nil, "svc/"); policy != nil || err != nil {
+		t.Errorf("expected no policy without keys, got %+v %v", policy, err)
+	}
+
+	tests := []struct {
+		keys    map[string]string
+		invalid string
+	}{
+		{map[string]string{"ban_time": "1h"}, ""},
+		{map[string]string{"http_req_rate": "many"}, "http_req_rate"},
+		{map[string]string{"http_req_rate": "0/10s"}, "http_req_rate"},
+		{map[string]string{"http_req_rate": "100/10s", "ban_time": "forever"}, "ban_time"},
+		{map[string]string{"http_req_rate": "100/10s", "interval": "10ms"}, "interval"},
+		{map[string]string{"http_req_rate": "100/10s", "bytes_out_rate": "1/1s"}, "bytes_out_rate"},
+	}
+	for _, test := range tests {
+		kv := map[string]string{}
+		for key, value := range test.keys {
+			kv["svc/abuse/"+key] = value
+		}
+		_, err := loadAbusePolicy(kv, "svc/")
+		if invalid, ok := err.(*invalidKeyError); !ok || invalid.Key != "svc/abuse/"+test.invalid {
+			t.Errorf("%v: expected %s to be invalid, got %v", test.keys, test.invalid, err)
+		}
+	}
+}
+
+func TestCheckAbuse(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	m := testManager(newDockerRuntime(newFakeDocker()))
+	s := &server{manager: m}
+	svc, err := m.service("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.setAbusePolicy(&abusePolicy{
+		Limits:   []abuseLimit{{Counter: "http_err_rate", Limit: 50, Period: "10s"}},
+		BanTime:  10 * time.Minute,
+		Interval: time.Second,
+	})
+
+	commands := []string{}
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		commands = append(commands, command)
+		if command != "show table abuse" {
+			return "\n"
+		}
+		return `# table: abuse, type: ip, size:102400, used:2
+0x1: key=203.0.113.7 use=0 exp=600000 http_err_rate(10000)=73
+0x2: key=10.0.0.1 use=1 exp=600000 http_err_rate(10000)=2
+
+`
+	})()
+
+	now := time.Now()
+	svc.checkAbuse(now)
+	path := "/usr/local/etc/haproxy/acl/banned.acl"
+	if expected := []string{"show table abuse", "add acl " + path + " 203.0.113.7"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the offending source to be banned at once, got %v", commands)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(svc.aclDir(), bannedListFile))
+	if err != nil || string(content) != "203.0.113.7\n" {
+		t.Errorf("expected the ban to be written to the banned list, got %q %v", content, err)
+	}
+	bans, err := s.ListBans(context.Background(), &pb.ListBansRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*pb.Ban{{Address: "203.0.113.7", Reason: "http_err_rate 73 over 50/10s", Since: now.UnixNano(), Until: now.Add(10 * time.Minute).UnixNano()}}
+	if !reflect.DeepEqual(bans.Bans, expected) {
+		t.Errorf("expected %+v, got %+v", expected, bans.Bans)
+	}
+
+	// the table still counts the errors of the banned source until they decay
+	commands = nil
+	svc.checkAbuse(now.Add(time.Minute))
+	if expected := []string{"show table abuse"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected a banned source not to be banned again, got %v", commands)
+	}
+
+	commands = nil
+	svc.setAbusePolicy(nil)
+	svc.checkAbuse(now.Add(10 * time.Minute))
+	if expected := []string{"del acl " + path + " 203.0.113.7"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the ban to expire, got %v", commands)
+	}
+	if bans := svc.listBans(); len(bans) != 0 {
+		t.Errorf("expected no bans left, got %+v", bans)
+	}
+
+	actions := []string{}
+	for _, ev := range svc.events.list(svc.Name) {
+		if ev.Ban == nil || ev.Ban.Address != "203.0.113.7" {
+			t.Errorf("expected the events to name the ban, got %+v", ev)
+		}
+		actions = append(actions, ev.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{"ban", "unban"}) {
+		t.Errorf("expected ban and unban events, got %v", actions)
+	}
+}
+
+func TestCheckAbuseKeepsRejectedChanges(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	svc.setAbusePolicy(&abusePolicy{
+		Limits:   []abuseLimit{{Counter: "http_err_rate", Limit: 50, Period: "10s"}},
+		BanTime:  10 * time.Minute,
+		Interval: time.Second,
+	})
+
+	sending := make(chan string)
+	answers := make(chan string)
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		if command == "show table abuse" {
+			return "# table: abuse, type: ip, size:102400, used:1\n0x1: key=203.0.113.7 use=0 exp=600000 http_err_rate(10000)=73\n\n"
+		}
+		sending <- command
+		return <-answers
+	})()
+
+	done := make(chan struct{})
+	go func() {
+		svc.checkAbuse(time.Now())
+		close(done)
+	}()
+	<-sending
+	// the ban is being sent, which doesn't hold up ListBans and the renders
+	listed := make(chan []abuseBan)
+	go func() {
+		svc.writeBans()
+		listed <- svc.listBans()
+	}()
+	select {
+	case bans := <-listed:
+		if len(bans) != 0 {
+			t.Errorf("expected no bans before HAProxy took the ban, got %+v", bans)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the bans to be listed while the ban is sent")
+	}
+	answers <- "Unknown ACL identifier. Please use #<id> or <file>.\n"
+	<-done
+
+	if bans := svc.listBans(); len(bans) != 0 {
+		t.Errorf("expected a ban HAProxy rejected not to be kept, got %+v", bans)
+	}
+	if events := svc.events.list(svc.Name); len(events) != 0 {
+		t.Errorf("expected no ban events, got %+v", events)
+	}
+
+	// the source is banned at the next check
+	done = make(chan struct{})
+	go func() {
+		svc.checkAbuse(time.Now())
+		close(done)
+	}()
+	<-sending
+	answers <- "\n"
+	<-done
+	if bans := svc.listBans(); len(bans) != 1 || bans[0].Address != "203.0.113.7" {
+		t.Errorf("expected the source to be banned, got %+v", bans)
+	}
+}
+
+func TestCheckAbuseCarriesOnAfterRejections(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	svc.setAbusePolicy(&abusePolicy{
+		Limits:   []abuseLimit{{Counter: "http_err_rate", Limit: 50, Period: "10s"}},
+		BanTime:  10 * time.Minute,
+		Interval: time.Second,
+	})
+	now := time.Now()
+	for _, address := range []string{"198.51.100.1", "198.51.100.2"} {
+		svc.bans[address] = &abuseBan{Address: address, Since: now.Add(-time.Hour), Until: now.Add(-time.Minute)}
+	}
+
+	path := "/usr/local/etc/haproxy/acl/banned.acl"
+	answers := map[string]string{
+		"show table abuse": `# table: abuse, type: ip, size:102400, used:2
+0x1: key=203.0.113.3 use=0 exp=600000 http_err_rate(10000)=73
+0x2: key=203.0.113.4 use=0 exp=600000 http_err_rate(10000)=81
+
+`,
+		// a reload already dropped the entry
+		"del acl " + path + " 198.51.100.1": "Key not found.\n",
+		"del acl " + path + " 198.51.100.2": "Unknown ACL identifier. Please use #<id> or <file>.\n",
+		"add acl " + path + " 203.0.113.3":  "Unknown ACL identifier. Please use #<id> or <file>.\n",
+		"add acl " + path + " 203.0.113.4":  "\n",
+	}
+	commands := []string{}
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		commands = append(commands, command)
+		return answers[command]
+	})()
+
+	svc.checkAbuse(now)
+	if len(commands) != len(answers) {
+		t.Errorf("expected every change to be sent despite the rejections, got %v", commands)
+	}
+	addresses := []string{}
+	for _, ban := range svc.listBans() {
+		addresses = append(addresses, ban.Address)
+	}
+	if expected := []string{"198.51.100.2", "203.0.113.4"}; !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected the bans HAProxy took, and the lift it rejected, to be kept as %v, got %v", expected, addresses)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(svc.aclDir(), bannedListFile))
+	if err != nil || string(content) != "198.51.100.2\n203.0.113.4\n" {
+		t.Errorf("expected the banned list to follow the bans, got %q %v", content, err)
+	}
+}
+
+func TestLoadBans(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	svc.bans["198.51.100.4"] = &abuseBan{Address: "198.51.100.4"}
+	if err := svc.writeBans(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	now := time.Now()
+	restarted.loadBans(now)
+	bans := restarted.listBans()
+	if len(bans) != 1 || bans[0].Address != "198.51.100.4" || !bans[0].Until.Equal(now.Add(defaultBanTime)) {
+		t.Errorf("expected the ban to be kept across restarts, got %+v", bans)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+const (
+	// recentAccessLogSize is how many access log entries are kept in memory per service for GetAccessLogs
+	recentAccessLogSize = 1000
+	// defaultAccessLogMaxSize is the size at which the access log file is rotated, unless ACCESS_LOG_MAX_SIZE is set
+	defaultAccessLogMaxSize = 10 * 1024 * 1024
+	// accessLogBackups is how many rotated access log files are kept
+	accessLogBackups = 3
+	// acceptDateLayout is the format of the accept date in HAProxy's HTTP log format
+	acceptDateLayout = "02/Jan/2006:15:04:05.000"
+)
+
+// accessLogEntry is a request logged by HAProxy in its HTTP log format.
+// Timers are in milliseconds, -1 when the request didn't get to that stage.
+type accessLogEntry struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Frontend         string    `json:"frontend"`
+	Backend          string    `json:"backend"`
+	Server           string    `json:"server"`
+	Tq               int64     `json:"tq"`
+	Tw               int64     `json:"tw"`
+	Tc               int64     `json:"tc"`
+	Tr               int64     `json:"tr"`
+	Tt               int64     `json:"tt"`
+	Status           int       `json:"status"`
+	Bytes            int64     `json:"bytes"`
+	TerminationState string    `json:"termination_state"`
+	Request          string    `json:"request"`
+}
+
+// accessLogMaxSize parses ACCESS_LOG_MAX_SIZE
+func accessLogMaxSize() (int64, error) {
+	if AccessLogMaxSize == "" {
+		return defaultAccessLogMaxSize, nil
+	}
+	size, err := units.RAMInBytes(AccessLogMaxSize)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid ACCESS_LOG_MAX_SIZE: %q", AccessLogMaxSize)
+	}
+	return size, nil
+}
+
+// syslogMessage strips the syslog header (priority, timestamp and tag) from a message sent by HAProxy
+func syslogMessage(packet string) string {
+	packet = strings.TrimRight(packet, "\n\x00")
+	if strings.HasPrefix(packet, "<") {
+		if i := strings.Index(packet, ">"); i > 0 {
+			packet = packet[i+1:]
+		}
+	}
+	if i := strings.Index(packet, "]: "); i >= 0 {
+		return packet[i+3:]
+	}
+	if i := strings.Index(packet, ": "); i >= 0 {
+		return packet[i+2:]
+	}
+	return packet
+}
+
+// parseHTTPLog parses a message in HAProxy's HTTP log format, such as
+//
+//	10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET /index.html HTTP/1.1"
+func parseHTTPLog(message string) (accessLogEntry, error) {
+	entry := accessLogEntry{}
+	request := ""
+	if i := strings.Index(message, ` "`); i >= 0 {
+		request = strings.TrimSuffix(message[i+2:], `"`)
+		message = message[:i]
+	}
+	fields := strings.Fields(message)
+	if len(fields) < 11 || !strings.HasPrefix(fields[1], "[") {
+		return entry, fmt.Errorf("not an HTTP log line: %q", message)
+	}
+
+	entry.Client = fields[0]
+	date, err := time.ParseInLocation(acceptDateLayout, strings.Trim(fields[1], "[]"), time.Local)
+	if err != nil {
+		return entry, fmt.Errorf("invalid accept date %q: %v", fields[1], err)
+	}
+	entry.Time = date
+	entry.Frontend = strings.TrimSuffix(fields[2], "~")
+
+	backendServer := strings.SplitN(fields[3], "/", 2)
+	if len(backendServer) != 2 {
+		return entry, fmt.Errorf("invalid backend/server %q", fields[3])
+	}
+	entry.Backend, entry.Server = backendServer[0], backendServer[1]
+
+	timers := strings.Split(fields[4], "/")
+	if len(timers) != 5 {
+		return entry, fmt.Errorf("invalid timers %q", fields[4])
+	}
+	for i, dest := range []*int64{&entry.Tq, &entry.Tw, &entry.Tc, &entry.Tr, &entry.Tt} {
+		if *dest, err = strconv.ParseInt(strings.TrimPrefix(timers[i], "+"), 10, 64); err != nil {
+			return entry, fmt.Errorf("invalid timers %q", fields[4])
+		}
+	}
+
+	if entry.Status, err = strconv.Atoi(fields[5]); err != nil {
+		return entry, fmt.Errorf("invalid status %q", fields[5])
+	}
+	if entry.Bytes, err = strconv.ParseInt(strings.TrimPrefix(fields[6], "+"), 10, 64); err != nil {
+		return entry, fmt.Errorf("invalid byte count %q", fields[6])
+	}
+	// fields 7 and 8 are the captured request and response cookies
+	entry.TerminationState = fields[9]
+	entry.Request = request
+	return entry, nil
+}
+
+// rotatingFile is a log file which is rotated when it would grow over maxSize, keeping accessLogBackups old files
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to path.1, path.1 to path.2 and so on, and starts a new file
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := accessLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// accessLog receives the syslog messages of a service's HAProxy, and writes the requests in them to a JSON lines file
+type accessLog struct {
+	conn  net.PacketConn
+	out   *rotatingFile
+	stats *trafficStats
+	done  chan struct{}
+
+	mu     sync.Mutex
+	recent []accessLogEntry
+}
+
+// startAccessLog listens for HAProxy's logs, on a unix socket in the service's config dir, or on UDP when SYSLOG_UDP_HOST is set
+func startAccessLog(svc *service) (*accessLog, error) {
+	maxSize, err := accessLogMaxSize()
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.PacketConn
+	if SyslogUDPHost != "" {
+		conn, err = net.ListenPacket("udp", net.JoinHostPort(SyslogUDPHost, "0"))
+	} else {
+		os.Remove(svc.logSocketPath())
+		conn, err = net.ListenPacket("unixgram", svc.logSocketPath())
+		if err == nil {
+			// HAProxy may not run as the manager's user
+			err = os.Chmod(svc.logSocketPath(), 0666)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := openRotatingFile(svc.accessLogPath(), maxSize)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	l := &accessLog{conn: conn, out: out, stats: newTrafficStats(TrafficWindows), done: make(chan struct{})}
+	go l.receive()
+	return l, nil
+}
+
+// address is where HAProxy sends its logs, for the log line of the config
+func (l *accessLog) address(svc *service) string {
+	if addr, ok := l.conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.String()
+	}
+	return svc.haproxyPath(svc.logSocketPath())
+}
+
+func (l *accessLog) receive() {
+	defer close(l.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("access log receiver stopped: %v\n", err)
+			}
+			return
+		}
+		entry, err := parseHTTPLog(syslogMessage(string(buf[:n])))
+		if err != nil {
+			// HAProxy also logs events such as proxies starting or servers going down
+			continue
+		}
+		l.record(entry)
+		l.stats.observe(entry, time.Now())
+	}
+}
+
+func (l *accessLog) record(entry accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = append(l.recent, entry)
+	if len(l.recent) > recentAccessLogSize {
+		l.recent = l.recent[len(l.recent)-recentAccessLogSize:]
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("unable to write the access log: %v\n", err)
+	}
+}
+
+// entries returns up to limit of the most recent entries, optionally only those of a backend, oldest first
+func (l *accessLog) entries(limit int, backend string) []accessLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []accessLogEntry{}
+	for i := len(l.recent) - 1; i >= 0 && len(out) < limit; i-- {
+		if backend == "" || l.recent[i].Backend == backend {
+			out = append(out, l.recent[i])
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (l *accessLog) close() {
+	l.conn.Close()
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Close()
+}
+
+func accessLogToProto(entries []accessLogEntry) []*pb.AccessLogEntry {
+	out := []*pb.AccessLogEntry{}
+	for _, e := range entries {
+		out = append(out, &pb.AccessLogEntry{
+			Timestamp:        e.Time.UnixNano(),
+			Client:           e.Client,
+			Frontend:         e.Frontend,
+			Backend:          e.Backend,
+			Server:           e.Server,
+			Tq:               e.Tq,
+			Tw:               e.Tw,
+			Tc:               e.Tc,
+			Tr:               e.Tr,
+			Tt:               e.Tt,
+			Status:           int32(e.Status),
+			Bytes:            e.Bytes,
+			TerminationState: e.TerminationState,
+			Request:          e.Request,
+		})
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+const testHTTPLog = `10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 "GET /index.html HTTP/1.1"`
+
+func TestParseHTTPLog(t *testing.T) {
+	entry, err := parseHTTPLog(syslogMessage("<134>Feb  6 12:14:14 haproxy[14389]: " + testHTTPLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := accessLogEntry{
+		Time:             time.Date(2009, time.February, 6, 12, 14, 14, 655000000, time.Local),
+		Client:           "10.0.1.2:33317",
+		Frontend:         "http-in",
+		Backend:          "static",
+		Server:           "srv1",
+		Tq:               10,
+		Tw:               0,
+		Tc:               30,
+		Tr:               69,
+		Tt:               109,
+		Status:           200,
+		Bytes:            2750,
+		TerminationState: "----",
+		Request:          "GET /index.html HTTP/1.1",
+	}
+	if entry != expected {
+		t.Errorf("expected %+v, got %+v", expected, entry)
+	}
+
+	entry, err = parseHTTPLog(`10.0.1.2:33318 [06/Feb/2009:12:14:15.000] https-in~ static/<NOSRV> -1/-1/-1/-1/+5000 503 +212 - - SC-- 0/0/0/0/0 0/0 {example.com} "GET / HTTP/1.1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Frontend != "https-in" || entry.Server != "<NOSRV>" || entry.Tr != -1 || entry.Tt != 5000 || entry.Bytes != 212 || entry.TerminationState != "SC--" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	for _, line := range []string{"Proxy www started.", "Server backends/web1 is DOWN, reason: Layer4 connection problem"} {
+		if _, err := parseHTTPLog(line); err == nil {
+			t.Errorf("expected %q not to parse", line)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < accessLogBackups+3; i++ {
+		if _, err := fmt.Fprintf(f, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != fmt.Sprintf("line %d\n", accessLogBackups+2) {
+		t.Errorf("expected the current file to hold the last line, got %q (%v)", data, err)
+	}
+	for i := 1; i <= accessLogBackups; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", path, i)); err != nil {
+			t.Errorf("expected backup %d: %v", i, err)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, accessLogBackups+1)); !os.IsNotExist(err) {
+		t.Errorf("expected only %d backups to be kept", accessLogBackups)
+	}
+}
+
+func TestAccessLogReceivesHAProxyLogs(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	l, err := startAccessLog(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.accessLog = l
+	defer l.close()
+
+	if address := svc.logAddress(); address != "/usr/local/etc/haproxy/log.sock" {
+		t.Errorf("expected HAProxy to log to the socket in its config dir, got %s", address)
+	}
+
+	conn, err := net.Dial("unixgram", svc.logSocketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, message := range []string{"Proxy www started.", testHTTPLog} {
+		if _, err := fmt.Fprintf(conn, "<134>%s haproxy[1]: %s\n", time.Now().Format(time.Stamp), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the log line", func() bool {
+		return len(l.entries(10, "")) == 1
+	})
+
+	s := &server{manager: testManager(nil)}
+	s.manager.services[DefaultServiceName] = svc
+	logs, err := s.GetAccessLogs(context.Background(), &pb.AccessLogRequest{Backend: "static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.Entries) != 1 || logs.Entries[0].Status != 200 || logs.Entries[0].Tr != 69 {
+		t.Errorf("unexpected entries: %+v", logs.Entries)
+	}
+	if logs, _ := s.GetAccessLogs(context.Background(), &pb.AccessLogRequest{Backend: "other"}); len(logs.Entries) != 0 {
+		t.Errorf("expected no entries for another backend, got %+v", logs.Entries)
+	}
+
+	f, err := os.Open(svc.accessLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("expected a line in the access log file")
+	}
+	written := accessLogEntry{}
+	if err := json.Unmarshal(scanner.Bytes(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Backend != "static" || written.Request != "GET /index.html HTTP/1.1" {
+		t.Errorf("unexpected access log line: %s", scanner.Text())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// denyListFile is the global deny list, which always exists so that the first entry needs no reload
+const denyListFile = "deny.acl"
+
+// aclList is a list of client addresses and networks kept in an ACL file, which HAProxy matches sources against
+type aclList struct {
+	// File is the name of the list's file in the service's ACL dir
+	File    string
+	Entries []string
+
+	// key is the prefix of the list's keys
+	key string
+}
+
+func frontendAllowListFile(frontend string) string {
+	return "frontend." + frontend + ".allow.acl"
+}
+
+func backendAllowListFile(backend string) string {
+	return "backend." + backend + ".allow.acl"
+}
+
+// loadACLLists reads the ACL lists under the acl/ prefix of a service's keys, where the key of each entry is a label
+// and its value comma separated addresses or networks:
+//
+//	acl/deny/<entry>                       sources rejected by all of the frontends
+//	acl/frontends/<frontend>/allow/<entry> the only sources accepted by a frontend
+//	acl/backends/<backend>/allow/<entry>   the only sources a backend serves
+//
+// The lists are sorted by file name, and the deny list is always there.
+func loadACLLists(kv map[string]string, prefix string) ([]*aclList, error) {
+	lists := map[string]*aclList{denyListFile: {File: denyListFile, key: prefix + "acl/deny/"}}
+	for key, value := range subKeys(kv, prefix+"acl/") {
+		parts := strings.Split(key, "/")
+		var list *aclList
+		switch {
+		case len(parts) == 2 && parts[0] == "deny":
+			list = lists[denyListFile]
+		case len(parts) == 4 && parts[0] == "frontends" && parts[2] == "allow" && validProxyName(parts[1]):
+			list = &aclList{File: frontendAllowListFile(parts[1]), key: prefix + "acl/frontends/" + parts[1] + "/allow/"}
+		case len(parts) == 4 && parts[0] == "backends" && parts[2] == "allow" && validProxyName(parts[1]):
+			list = &aclList{File: backendAllowListFile(parts[1]), key: prefix + "acl/backends/" + parts[1] + "/allow/"}
+		default:
+			return nil, &invalidKeyError{prefix + "acl/" + key, "ACL lists are acl/deny/<entry>, acl/frontends/<frontend>/allow/<entry> or acl/backends/<backend>/allow/<entry>"}
+		}
+		if existing, ok := lists[list.File]; ok {
+			list = existing
+		}
+		lists[list.File] = list
+		for _, entry := range splitList(value) {
+			normalized, err := parseACLEntry(entry)
+			if err != nil {
+				return nil, &invalidKeyError{prefix + "acl/" + key, err.Error()}
+			}
+			list.Entries = append(list.Entries, normalized)
+		}
+	}
+
+	sorted := []*aclList{}
+	for _, list := range lists {
+		sort.Strings(list.Entries)
+		list.Entries = uniqueStrings(list.Entries)
+		sorted = append(sorted, list)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].File < sorted[j].File })
+	return sorted, nil
+}
+
+// parseACLEntry checks an address or a network, and returns it in its canonical form so lists compare equal
+func parseACLEntry(entry string) (string, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", fmt.Errorf("%q isn't a network such as 10.0.0.0/8", entry)
+		}
+		return network.String(), nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", fmt.Errorf("%q isn't an IP address", entry)
+	}
+	return ip.String(), nil
+}
+
+// uniqueStrings drops the repeated strings of a sorted list
+func uniqueStrings(sorted []string) []string {
+	unique := []string{}
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+// stagedACLs are the ACL lists of a render, which are only written once the config referring to them is accepted
+type stagedACLs struct {
+	svc     *service
+	changed []stagedACL
+	// created are the files of the new lists, written beforehand as the config check reads them. No HAProxy has
+	// loaded them yet.
+	created []string
+}
+
+// stagedACL is a list whose entries changed, with the entries of its file
+type stagedACL struct {
+	path     string
+	previous []string
+	entries  []string
+}
+
+// stageACLs works out the lists which changed, and creates the files of the new lists
+func (svc *service) stageACLs(lists []*aclList) (*stagedACLs, error) {
+	if err := os.MkdirAll(svc.aclDir(), 0755); err != nil {
+		return nil, newRenderError(renderErrorIO, err)
+	}
+	staged := &stagedACLs{svc: svc}
+	for _, list := range lists {
+		path := filepath.Join(svc.aclDir(), list.File)
+		previous, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			if err := writeACLFile(path, list.Entries); err != nil {
+				staged.discard()
+				return nil, err
+			}
+			staged.created = append(staged.created, path)
+			continue
+		}
+		if err != nil {
+			staged.discard()
+			return nil, newRenderError(renderErrorIO, err)
+		}
+		if string(previous) != aclContent(list.Entries) {
+			staged.changed = append(staged.changed, stagedACL{path: path, previous: strings.Fields(string(previous)), entries: list.Entries})
+		}
+	}
+	return staged, nil
+}
+
+// write writes the changed lists, and updates them in the running HAProxy through its runtime API, so that changing
+// the entries of a list needs no reload. It returns whether HAProxy has to reload anyway, as it didn't take the
+// changes of a list.
+func (s *stagedACLs) write() (bool, error) {
+	reload := false
+	for _, list := range s.changed {
+		if err := writeACLFile(list.path, list.entries); err != nil {
+			return false, err
+		}
+		if err := s.svc.updateLoadedACL(list.path, list.previous, list.entries); err != nil {
+			log.Printf("unable to update %s in HAProxy, reloading it: %v\n", filepath.Base(list.path), err)
+			reload = true
+		}
+	}
+	return reload, nil
+}
+
+// discard removes the files of the new lists, when the config referring to them was rejected
+func (s *stagedACLs) discard() {
+	for _, path := range s.created {
+		os.Remove(path)
+	}
+}
+
+// aclContent is the content of the file of a list with the entries
+func aclContent(entries []string) string {
+	content := ""
+	for _, entry := range entries {
+		content += entry + "\n"
+	}
+	return content
+}
+
+// writeACLFile writes the entries of a list to its file
+func writeACLFile(path string, entries []string) error {
+	// renaming replaces the file at once, HAProxy never reads a partially written list
+	if err := ioutil.WriteFile(path+".tmp", []byte(aclContent(entries)), 0644); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	return nil
+}
+
+// updateLoadedACL applies the changes of a list to the running HAProxy, which reads the file again when it reloads
+func (svc *service) updateLoadedACL(path string, previous, entries []string) error {
+	commands := []string{}
+	for _, entry := range previous {
+		if !containsString(entries, entry) {
+			commands = append(commands, "del acl "+svc.haproxyPath(path)+" "+entry)
+		}
+	}
+	for _, entry := range entries {
+		if !containsString(previous, entry) {
+			commands = append(commands, "add acl "+svc.haproxyPath(path)+" "+entry)
+		}
+	}
+	for _, command := range commands {
+		if err := svc.haproxyUpdate(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaleACLs removes the files of the lists which are gone, once the config doesn't refer to them anymore
+func (svc *service) removeStaleACLs(lists []*aclList) {
+	files, err := filepath.Glob(filepath.Join(svc.aclDir(), "*.acl"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		// the banned list is kept by the abuse blocker
+		stale := filepath.Base(file) != bannedListFile
+		for _, list := range lists {
+			if list.File == filepath.Base(file) {
+				stale = false
+			}
+		}
+		if stale {
+			os.Remove(file)
+		}
+	}
+}
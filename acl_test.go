@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadACLLists(t *testing.T) {
+	kv := map[string]string{
+		"svc/acl/deny/scraper":               "203.0.113.7",
+		"svc/acl/deny/cloud":                 "198.51.100.0/24, 203.0.113.7",
+		"svc/acl/frontends/www/allow/office": "10.1.0.0/16,2001:db8::/32",
+		"svc/acl/backends/admin/allow/vpn":   "10.8.0.1",
+		"svc/acl/backends/admin/allow/ops":   "192.168.1.20/24",
+	}
+	lists, err := loadACLLists(kv, "svc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*aclList{
+		{File: "backend.admin.allow.acl", Entries: []string{"10.8.0.1", "192.168.1.0/24"}, key: "svc/acl/backends/admin/allow/"},
+		{File: "deny.acl", Entries: []string{"198.51.100.0/24", "203.0.113.7"}, key: "svc/acl/deny/"},
+		{File: "frontend.www.allow.acl", Entries: []string{"10.1.0.0/16", "2001:db8::/32"}, key: "svc/acl/frontends/www/allow/"},
+	}
+	if !reflect.DeepEqual(lists, expected) {
+		t.Errorf("expected %+v, got %+v", expected, lists)
+	}
+
+	lists, err = loadACLLists(nil, "svc/")
+	if err != nil || len(lists) != 1 || lists[0].File != denyListFile || len(lists[0].Entries) != 0 {
+		t.Errorf("expected an empty deny list, got %+v %v", lists, err)
+	}
+
+	for key, value := range map[string]string{
+		"acl/deny/bad":                  "10.0.0.300",
+		"acl/deny/net":                  "10.0.0.0/33",
+		"acl/deny":                      "10.0.0.1",
+		"acl/allow/office":              "10.0.0.1",
+		"acl/frontends/www/deny/x":      "10.0.0.1",
+		"acl/frontends/a b/allow/x":     "10.0.0.1",
+		"acl/backends/api/allow/x/y":    "10.0.0.1",
+		"acl/frontends/www/allow/names": "example.com",
+	} {
+		_, err := loadACLLists(map[string]string{"svc/" + key: value}, "svc/")
+		if invalid, ok := err.(*invalidKeyError); !ok || invalid.Key != "svc/"+key {
+			t.Errorf("%s=%q: expected the key to be invalid, got %v", key, value, err)
+		}
+	}
+
+	kv = map[string]string{"svc/acl/frontends/api/allow/office": "10.1.0.0/16"}
+	if _, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil }); err == nil {
+		t.Error("expected the allow list of a missing frontend to be invalid")
+	}
+	kv["svc/frontends/api/bind"] = "*:8080"
+	kv["svc/acl/backends/backends/allow/office"] = "10.1.0.0/16"
+	lb, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.DenyList != denyListFile || lb.Frontends[0].AllowList != "frontend.api.allow.acl" || lb.Backends[0].AllowList != "backend.backends.allow.acl" {
+		t.Errorf("expected the frontend and backend to refer to their allow lists, got %+v %+v", lb.Frontends[0], lb.Backends[0])
+	}
+}
+
+func TestWriteACLs(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	writeACLs := func(lists []*aclList) (bool, error) {
+		staged, err := svc.stageACLs(lists)
+		if err != nil {
+			return false, err
+		}
+		return staged.write()
+	}
+
+	lists := []*aclList{
+		{File: denyListFile, Entries: []string{"203.0.113.7"}},
+		{File: "frontend.www.allow.acl", Entries: []string{"10.0.0.0/8"}},
+	}
+	if _, err := writeACLs(lists); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(svc.aclDir(), denyListFile))
+	if err != nil || string(content) != "203.0.113.7\n" {
+		t.Fatalf("expected the deny list to be written, got %q %v", content, err)
+	}
+
+	commands := []string{}
+	answer := "\n"
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		commands = append(commands, command)
+		return answer
+	})()
+	lists = []*aclList{
+		{File: denyListFile, Entries: []string{"198.51.100.0/24"}},
+		{File: "frontend.www.allow.acl", Entries: []string{"10.0.0.0/8"}},
+		{File: "backend.api.allow.acl", Entries: []string{"10.1.0.0/16"}},
+	}
+	if reload, err := writeACLs(lists); err != nil || reload {
+		t.Fatalf("expected the changes to be applied without a reload, got %v %v", reload, err)
+	}
+	path := "/usr/local/etc/haproxy/acl/deny.acl"
+	expected := []string{"del acl " + path + " 203.0.113.7", "add acl " + path + " 198.51.100.0/24"}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected only the changes of the loaded deny list to be sent to HAProxy, got %v", commands)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(svc.aclDir(), "backend.api.allow.acl"))
+	if err != nil || string(content) != "10.1.0.0/16\n" {
+		t.Errorf("expected the new allow list to be written, got %q %v", content, err)
+	}
+
+	// HAProxy answers the changes it rejects with an error, it has to reload to read the list
+	answer = "Unknown ACL identifier. Please use #<id> or <file>.\n"
+	lists[0].Entries = []string{"198.51.100.0/24", "203.0.113.9"}
+	if reload, err := writeACLs(lists); err != nil || !reload {
+		t.Errorf("expected a rejected change to need a reload, got %v %v", reload, err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(svc.aclDir(), denyListFile))
+	if err != nil || string(content) != "198.51.100.0/24\n203.0.113.9\n" {
+		t.Errorf("expected the deny list to be written, got %q %v", content, err)
+	}
+
+	svc.removeStaleACLs(lists[:1])
+	files, _ := filepath.Glob(filepath.Join(svc.aclDir(), "*"))
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, []string{filepath.Join(svc.aclDir(), denyListFile)}) {
+		t.Errorf("expected the stale lists to be removed, got %v", files)
+	}
+}
+
+func TestRenderKeepsACLsOfRejectedConfig(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	svc := newService(DefaultServiceName, newDockerRuntime(docker))
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(testConfig+`{{range ls (print "instances/" (env "INSTANCE_ID") "/services/" (env "SERVICE_NAME") "/acl/deny")}}    # {{.Value}}{{end}}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prefix := svc.kvPrefix()
+	// the lists created for the check of a rejected config are removed, so none of them are left behind
+	docker.failChecks("[ALERT] parsing [haproxy.cfg:12]: unknown keyword")
+	if _, _, err := svc.render(map[string]string{prefix + "acl/deny/scraper": "203.0.113.7"}, nil, false); err == nil {
+		t.Fatal("expected the config to be rejected")
+	}
+	if files, _ := filepath.Glob(filepath.Join(svc.aclDir(), "*")); len(files) != 0 {
+		t.Errorf("expected no lists to be left behind, got %v", files)
+	}
+	docker.failChecks("")
+	if _, _, err := svc.render(map[string]string{prefix + "acl/deny/scraper": "203.0.113.7"}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := []string{}
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		commands = append(commands, command)
+		return "\n"
+	})()
+	docker.failChecks("[ALERT] parsing [haproxy.cfg:12]: unknown keyword")
+	kv := map[string]string{prefix + "acl/deny/scraper": "198.51.100.4", prefix + "acl/frontends/www/allow/office": "10.1.0.0/16"}
+	if _, applied, err := svc.render(kv, nil, false); err == nil || applied {
+		t.Fatalf("expected the config to be rejected, got %v %v", applied, err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("expected no changes to be sent to HAProxy for a rejected config, got %v", commands)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(svc.aclDir(), denyListFile)); err != nil || string(content) != "203.0.113.7\n" {
+		t.Errorf("expected the deny list of the running config to be kept, got %q %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(svc.aclDir(), frontendAllowListFile("www"))); !os.IsNotExist(err) {
+		t.Errorf("expected the new allow list to be removed, got %v", err)
+	}
+
+	docker.failChecks("")
+	if _, applied, err := svc.render(kv, nil, false); err != nil || !applied {
+		t.Fatalf("expected the config to be applied, got %v %v", applied, err)
+	}
+	path := "/usr/local/etc/haproxy/acl/deny.acl"
+	if expected := []string{"del acl " + path + " 203.0.113.7", "add acl " + path + " 198.51.100.4"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the changes to be sent once the config is accepted, got %v", commands)
+	}
+}
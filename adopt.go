@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+)
+
+// containerSpec is the desired state of a managed container
+type containerSpec struct {
+	Name             string
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
+
+// ensureContainer makes sure a container matching spec is running and returns its ID.
+// A running container with the managed name is adopted if it matches the spec, otherwise it is replaced,
+// calling replacing with its ID first.
+func ensureContainer(dockerCli dockerAPI, spec containerSpec, replacing func(id string)) (string, error) {
+	ctx := context.Background()
+
+	existing, err := dockerCli.ContainerInspect(ctx, spec.Name)
+	if err != nil && !dockerClient.IsErrNotFound(err) {
+		return "", err
+	}
+	if err == nil {
+		drift := specDrift(spec, existing)
+		if drift == "" {
+			return existing.ID, nil
+		}
+		log.Printf("container %s has drifted (%s), recreating\n", spec.Name, drift)
+		replacing(existing.ID)
+		err := dockerCli.ContainerRemove(ctx, existing.ID, dockerTypes.ContainerRemoveOptions{Force: true})
+		if err != nil && !dockerClient.IsErrNotFound(err) {
+			return "", err
+		}
+	}
+
+	if err := pullImage(dockerCli, spec.Config.Image); err != nil {
+		return "", err
+	}
+
+	res, err := dockerCli.ContainerCreate(ctx, spec.Config, spec.HostConfig, spec.NetworkingConfig, spec.Name)
+	if err != nil {
+		return "", err
+	}
+
+	err = dockerCli.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return res.ID, nil
+}
+
+func pullImage(dockerCli dockerAPI, image string) error {
+	reader, err := dockerCli.ImagePull(context.Background(), image, dockerTypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = ioutil.ReadAll(reader)
+	return err
+}
+
+// specDrift compares a running container with the desired spec, returning a description of the first difference found
+func specDrift(spec containerSpec, existing dockerTypes.ContainerJSON) string {
+	if existing.State == nil || !existing.State.Running {
+		return "not running"
+	}
+	if existing.Config == nil || existing.HostConfig == nil {
+		return "incomplete container info"
+	}
+	if existing.Config.Image != spec.Config.Image {
+		return fmt.Sprintf("image %s != %s", existing.Config.Image, spec.Config.Image)
+	}
+	for k, v := range spec.Config.Labels {
+		if existing.Config.Labels[k] != v {
+			return fmt.Sprintf("label %s", k)
+		}
+	}
+	for _, env := range spec.Config.Env {
+		// the image's environment is merged into the container's
+		if !containsString(existing.Config.Env, env) {
+			return "environment"
+		}
+	}
+	if !reflect.DeepEqual(existing.Config.Healthcheck, spec.Config.Healthcheck) {
+		return "healthcheck"
+	}
+	if !sameStrings(existing.HostConfig.Binds, spec.HostConfig.Binds) {
+		return "binds"
+	}
+	if normalizeNetworkMode(existing.HostConfig.NetworkMode) != normalizeNetworkMode(spec.HostConfig.NetworkMode) {
+		return "network mode"
+	}
+	if spec.NetworkingConfig != nil {
+		for name := range spec.NetworkingConfig.EndpointsConfig {
+			if existing.NetworkSettings == nil || existing.NetworkSettings.Networks[name] == nil {
+				return "network " + name
+			}
+		}
+	}
+	if !samePortBindings(existing.HostConfig.PortBindings, spec.HostConfig.PortBindings) {
+		return "ports"
+	}
+	if existing.HostConfig.NanoCPUs != spec.HostConfig.NanoCPUs || existing.HostConfig.Memory != spec.HostConfig.Memory {
+		return "resource limits"
+	}
+	if !sameUlimits(existing.HostConfig.Ulimits, spec.HostConfig.Ulimits) {
+		return "ulimits"
+	}
+	if len(existing.HostConfig.Sysctls) != 0 || len(spec.HostConfig.Sysctls) != 0 {
+		if !reflect.DeepEqual(existing.HostConfig.Sysctls, spec.HostConfig.Sysctls) {
+			return "sysctls"
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	return reflect.DeepEqual(x, y)
+}
+
+func sameUlimits(a, b []*units.Ulimit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func samePortBindings(a, b nat.PortMap) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for port, bindings := range a {
+		other, ok := b[port]
+		if !ok || len(other) != len(bindings) {
+			return false
+		}
+		for i := range bindings {
+			if normalizeHostIP(bindings[i].HostIP) != normalizeHostIP(other[i].HostIP) || bindings[i].HostPort != other[i].HostPort {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeNetworkMode names the bridge network the same way whether it is left out, as in the spec, or reported by
+// Docker as the default network
+func normalizeNetworkMode(mode container.NetworkMode) container.NetworkMode {
+	if mode == "" || mode == "default" {
+		return "bridge"
+	}
+	return mode
+}
+
+func normalizeHostIP(ip string) string {
+	if ip == "" {
+		return "0.0.0.0"
+	}
+	return ip
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// latencyBuckets are the upper bounds in milliseconds of the latency histogram buckets, a last bucket takes anything slower
+var latencyBuckets = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000}
+
+// defaultAnalyticsWindows are the windows traffic stats are kept for, unless ANALYTICS_WINDOWS is set
+var defaultAnalyticsWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// latencyHistogram counts latencies in latencyBuckets
+type latencyHistogram [16]uint64
+
+func (h *latencyHistogram) add(ms int64) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return latencyBuckets[i] >= ms })
+	h[i]++
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i := range h {
+		h[i] += other[i]
+	}
+}
+
+// quantile estimates the q-quantile by interpolating within the bucket it falls in, 0 for an empty histogram
+func (h *latencyHistogram) quantile(q float64) float64 {
+	total := uint64(0)
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	seen := uint64(0)
+	for i, n := range h {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := int64(0)
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		if i == len(latencyBuckets) {
+			// the last bucket has no upper bound
+			return float64(lower)
+		}
+		upper := latencyBuckets[i]
+		return float64(lower) + float64(upper-lower)*(rank-float64(seen))/float64(n)
+	}
+	return float64(latencyBuckets[len(latencyBuckets)-1])
+}
+
+// trafficKey identifies a backend, or a server of a backend
+type trafficKey struct {
+	Backend string
+	// Server is empty for the totals of the backend
+	Server string
+}
+
+// trafficCounters summarize the requests to a backend or server
+type trafficCounters struct {
+	Requests uint64
+	// Tr is only counted for requests which got a response from a server
+	Tr           latencyHistogram
+	Tt           latencyHistogram
+	Statuses     map[int]uint64
+	Terminations map[string]uint64
+}
+
+func newTrafficCounters() *trafficCounters {
+	return &trafficCounters{
+		Statuses:     map[int]uint64{},
+		Terminations: map[string]uint64{},
+	}
+}
+
+func (c *trafficCounters) add(entry accessLogEntry) {
+	c.Requests++
+	if entry.Tr >= 0 {
+		c.Tr.add(entry.Tr)
+	}
+	if entry.Tt >= 0 {
+		c.Tt.add(entry.Tt)
+	}
+	c.Statuses[entry.Status]++
+	// the first two characters are the cause and the state of the session when it ended, the others are about cookies
+	state := entry.TerminationState
+	if len(state) > 2 {
+		state = state[:2]
+	}
+	c.Terminations[state]++
+}
+
+func (c *trafficCounters) merge(other *trafficCounters) {
+	c.Requests += other.Requests
+	c.Tr.merge(&other.Tr)
+	c.Tt.merge(&other.Tt)
+	for status, n := range other.Statuses {
+		c.Statuses[status] += n
+	}
+	for state, n := range other.Terminations {
+		c.Terminations[state] += n
+	}
+}
+
+// trafficSlot holds the counters of the requests logged during slotSize
+type trafficSlot struct {
+	start    time.Time
+	counters map[trafficKey]*trafficCounters
+}
+
+// trafficStats keeps rolling traffic stats per backend and server, in slots covering the longest window
+type trafficStats struct {
+	windows  []time.Duration
+	slotSize time.Duration
+
+	mu    sync.Mutex
+	slots []*trafficSlot
+}
+
+// newTrafficStats keeps stats for the given windows, in slots of a sixth of the shortest window
+func newTrafficStats(windows []time.Duration) *trafficStats {
+	slotSize := windows[0] / 6
+	for _, w := range windows {
+		if w/6 < slotSize {
+			slotSize = w / 6
+		}
+	}
+	if slotSize < time.Second {
+		slotSize = time.Second
+	}
+	return &trafficStats{windows: windows, slotSize: slotSize}
+}
+
+// parseAnalyticsWindows reads ANALYTICS_WINDOWS, a comma separated list of durations such as 1m,5m,1h
+func parseAnalyticsWindows() ([]time.Duration, error) {
+	if AnalyticsWindows == "" {
+		return defaultAnalyticsWindows, nil
+	}
+	windows := []time.Duration{}
+	for _, raw := range strings.Split(AnalyticsWindows, ",") {
+		w, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || w < time.Second {
+			return nil, fmt.Errorf("invalid ANALYTICS_WINDOWS entry: %q", raw)
+		}
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows, nil
+}
+
+func (s *trafficStats) retention() time.Duration {
+	return s.windows[len(s.windows)-1]
+}
+
+// observe counts a request at the time it was logged
+func (s *trafficStats) observe(entry accessLogEntry, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.Truncate(s.slotSize)
+	if len(s.slots) == 0 || s.slots[len(s.slots)-1].start != start {
+		s.slots = append(s.slots, &trafficSlot{start: start, counters: map[trafficKey]*trafficCounters{}})
+	}
+	s.expire(now)
+
+	slot := s.slots[len(s.slots)-1]
+	for _, key := range []trafficKey{{Backend: entry.Backend}, {Backend: entry.Backend, Server: entry.Server}} {
+		c := slot.counters[key]
+		if c == nil {
+			c = newTrafficCounters()
+			slot.counters[key] = c
+		}
+		c.add(entry)
+	}
+}
+
+// expire drops the slots which are older than the longest window. The caller must hold the lock.
+func (s *trafficStats) expire(now time.Time) {
+	oldest := now.Add(-s.retention())
+	i := 0
+	for i < len(s.slots) && !s.slots[i].start.Add(s.slotSize).After(oldest) {
+		i++
+	}
+	s.slots = s.slots[i:]
+}
+
+// snapshot sums the slots overlapping the last window
+func (s *trafficStats) snapshot(window time.Duration, now time.Time) map[trafficKey]*trafficCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+
+	oldest := now.Add(-window)
+	sums := map[trafficKey]*trafficCounters{}
+	for _, slot := range s.slots {
+		if !slot.start.Add(s.slotSize).After(oldest) {
+			continue
+		}
+		for key, c := range slot.counters {
+			sum := sums[key]
+			if sum == nil {
+				sum = newTrafficCounters()
+				sums[key] = sum
+			}
+			sum.merge(c)
+		}
+	}
+	return sums
+}
+
+// window returns the configured window matching raw, the shortest if raw is empty
+func (s *trafficStats) window(raw string) (time.Duration, error) {
+	if raw == "" {
+		return s.windows[0], nil
+	}
+	w, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, err
+	}
+	for _, configured := range s.windows {
+		if configured == w {
+			return w, nil
+		}
+	}
+	return 0, fmt.Errorf("stats are kept for %s, not %s", formatWindows(s.windows), raw)
+}
+
+func formatWindows(windows []time.Duration) string {
+	out := []string{}
+	for _, w := range windows {
+		out = append(out, w.String())
+	}
+	return strings.Join(out, ", ")
+}
+
+// sortedTrafficKeys orders backends by name, each followed by its servers
+func sortedTrafficKeys(counters map[trafficKey]*trafficCounters) []trafficKey {
+	keys := []trafficKey{}
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Backend != keys[j].Backend {
+			return keys[i].Backend < keys[j].Backend
+		}
+		return keys[i].Server < keys[j].Server
+	})
+	return keys
+}
+
+func latencyToProto(h *latencyHistogram) *pb.LatencyQuantiles {
+	return &pb.LatencyQuantiles{
+		P50: h.quantile(0.5),
+		P90: h.quantile(0.9),
+		P99: h.quantile(0.99),
+	}
+}
+
+func trafficToProto(window time.Duration, counters map[trafficKey]*trafficCounters) *pb.TrafficStats {
+	out := &pb.TrafficStats{Window: window.String()}
+	for _, key := range sortedTrafficKeys(counters) {
+		c := counters[key]
+		traffic := &pb.BackendTraffic{
+			Backend:      key.Backend,
+			Server:       key.Server,
+			Requests:     c.Requests,
+			Tr:           latencyToProto(&c.Tr),
+			Tt:           latencyToProto(&c.Tt),
+			Statuses:     map[string]uint64{},
+			Terminations: map[string]uint64{},
+		}
+		for status, n := range c.Statuses {
+			traffic.Statuses[strconv.Itoa(status)] = n
+		}
+		for state, n := range c.Terminations {
+			traffic.Terminations[state] = n
+		}
+		out.Backends = append(out.Backends, traffic)
+	}
+	return out
+}
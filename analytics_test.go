@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLatencyQuantiles(t *testing.T) {
+	h := &latencyHistogram{}
+	if q := h.quantile(0.5); q != 0 {
+		t.Errorf("expected 0 for an empty histogram, got %v", q)
+	}
+	// 90 fast requests and 10 slow ones
+	for i := 0; i < 90; i++ {
+		h.add(15)
+	}
+	for i := 0; i < 10; i++ {
+		h.add(1500)
+	}
+	tests := []struct {
+		q        float64
+		min, max float64
+	}{
+		{0.5, 10, 20},
+		{0.9, 10, 20},
+		{0.99, 1000, 2000},
+	}
+	for _, test := range tests {
+		if v := h.quantile(test.q); v < test.min || v > test.max {
+			t.Errorf("p%v: expected between %v and %v, got %v", test.q*100, test.min, test.max, v)
+		}
+	}
+
+	h.add(math.MaxInt32)
+	if v := h.quantile(1); v != float64(latencyBuckets[len(latencyBuckets)-1]) {
+		t.Errorf("expected the slowest bucket to report its lower bound, got %v", v)
+	}
+}
+
+func TestTrafficStatsWindows(t *testing.T) {
+	stats := newTrafficStats([]time.Duration{time.Minute, 10 * time.Minute})
+	start := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	ok := accessLogEntry{Backend: "web", Server: "web1", Tr: 20, Tt: 25, Status: 200, TerminationState: "----"}
+	failed := accessLogEntry{Backend: "web", Server: "web2", Tr: -1, Tt: 5000, Status: 503, TerminationState: "sC--"}
+	stats.observe(ok, start)
+	stats.observe(failed, start.Add(5*time.Minute))
+	stats.observe(ok, start.Add(9*time.Minute+30*time.Second))
+
+	now := start.Add(9*time.Minute + 40*time.Second)
+	recent := stats.snapshot(time.Minute, now)
+	if c := recent[trafficKey{Backend: "web"}]; c == nil || c.Requests != 1 {
+		t.Errorf("expected a single request in the last minute, got %+v", c)
+	}
+	all := stats.snapshot(10*time.Minute, now)
+	backend := all[trafficKey{Backend: "web"}]
+	if backend == nil || backend.Requests != 3 || backend.Statuses[503] != 1 || backend.Terminations["sC"] != 1 {
+		t.Fatalf("unexpected backend totals: %+v", backend)
+	}
+	if server := all[trafficKey{Backend: "web", Server: "web2"}]; server == nil || server.Requests != 1 || server.Tr.quantile(0.5) != 0 {
+		t.Errorf("expected web2 to have no response times, got %+v", server)
+	}
+
+	later := start.Add(16 * time.Minute)
+	if c := stats.snapshot(10*time.Minute, later)[trafficKey{Backend: "web"}]; c == nil || c.Requests != 1 {
+		t.Errorf("expected the old requests to expire, got %+v", c)
+	}
+}
+
+func TestParseAnalyticsWindows(t *testing.T) {
+	previous := AnalyticsWindows
+	defer func() { AnalyticsWindows = previous }()
+
+	AnalyticsWindows = "1h, 30s"
+	windows, err := parseAnalyticsWindows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 || windows[0] != 30*time.Second || windows[1] != time.Hour {
+		t.Errorf("unexpected windows: %v", windows)
+	}
+	AnalyticsWindows = "1m,soon"
+	if _, err := parseAnalyticsWindows(); err == nil {
+		t.Error("expected an invalid window to be rejected")
+	}
+}
+
+func TestTrafficStatsRPCAndMetrics(t *testing.T) {
+	m := testManager(nil)
+	svc := m.services[DefaultServiceName]
+	svc.accessLog = &accessLog{stats: newTrafficStats(defaultAnalyticsWindows)}
+	svc.accessLog.stats.observe(accessLogEntry{Backend: "web", Server: "web1", Tr: 20, Tt: 25, Status: 200, TerminationState: "----"}, time.Now())
+
+	s := &server{manager: m}
+	stats, err := s.GetTrafficStats(context.Background(), &pb.TrafficStatsRequest{Window: "5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Window != "5m0s" || len(stats.Backends) != 2 || stats.Backends[0].Server != "" || stats.Backends[1].Server != "web1" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if backend := stats.Backends[0]; backend.Requests != 1 || backend.Statuses["200"] != 1 || backend.Tr.P50 < 10 || backend.Tr.P50 > 20 {
+		t.Errorf("unexpected backend stats: %+v", backend)
+	}
+	if _, err := s.GetTrafficStats(context.Background(), &pb.TrafficStatsRequest{Window: "2m"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a window which isn't kept to be rejected, got %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	writeTrafficMetrics(out, m, time.Now())
+	for _, line := range []string{
+		`haproxy_manager_requests{service="lb-haproxy",backend="web",server="",window="1m0s"} 1`,
+		`haproxy_manager_responses{service="lb-haproxy",backend="web",server="web1",window="15m0s",status="200"} 1`,
+		`haproxy_manager_terminations{service="lb-haproxy",backend="web",server="",window="5m0s",state="--"} 1`,
+		`haproxy_manager_latency_milliseconds{service="lb-haproxy",backend="web",server="web1",window="1m0s",timer="tt",quantile="0.99"}`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected the metrics to contain %s, got:\n%s", line, out)
+		}
+	}
+}
@@ -1,56 +1,53 @@
 package main
 
 import (
-	"crypto/md5"
-	"io"
-	"log"
+	"bytes"
+	"io/ioutil"
 	"os"
-	"time"
-
-	"path/filepath"
-
-	dockerClient "github.com/docker/docker/client"
-	"github.com/subgraph/inotify"
 )
 
-func pollConfig(dockerCli *dockerClient.Client) {
-	filePath := filepath.Join(ConfigDir, "/services/", ServiceName, "/haproxy.cfg")
-	fileHash := ""
-	for {
-		f, err := os.Open(filePath)
-		if err != nil {
-			log.Println(err)
-		}
-		h := md5.New()
-		if _, err := io.Copy(h, f); err != nil {
-			log.Println(err)
+// applyConfig checks a new HAProxy config and, when it is valid, installs it and reconciles HAProxy with it.
+// An invalid config is left out, so HAProxy keeps running with the last valid one. With reload, an unchanged config
+// is reloaded too, as HAProxy only reads the files it refers to, such as the error pages, when it loads the config.
+// install, when set, writes the files which go with the config once the config is accepted and before HAProxy loads
+// it, and tells whether HAProxy has to reload to read them.
+func applyConfig(svc *service, config []byte, reload bool, install func() (bool, error)) error {
+	current, err := ioutil.ReadFile(svc.configPath())
+	if err == nil && bytes.Equal(current, config) {
+		if install != nil {
+			installReload, err := install()
+			if err != nil {
+				return err
+			}
+			reload = reload || installReload
 		}
-		newHash := string(h.Sum(nil))
-		if fileHash != newHash {
-			configureService(dockerCli)
-			fileHash = newHash
+		if reload {
+			configureService(svc)
 		}
-		f.Close()
-		time.Sleep(3 * time.Second)
+		return nil
 	}
-}
 
-func watchConfig(dockerCli *dockerClient.Client) {
-	filePath := filepath.Join(ConfigDir, "/services/", ServiceName, "/haproxy.cfg")
-	watcher, err := inotify.NewWatcher()
-	err = watcher.Watch(filePath)
-	if err != nil {
-		log.Fatal(err)
+	candidate := svc.candidateConfigPath()
+	if err := ioutil.WriteFile(candidate, config, 0644); err != nil {
+		return newRenderError(renderErrorIO, err)
 	}
-	for {
-		select {
-		case ev := <-watcher.Event:
-			log.Println("event:", ev, ev.Mask)
-			if ev.Mask == inotify.IN_MODIFY {
-				configureService(dockerCli)
-			}
-		case err := <-watcher.Error:
-			log.Println("error:", err)
+	defer os.Remove(candidate)
+
+	if output, err := svc.rt.Check(checkSpec(svc, candidate)); err != nil {
+		renderErr := newRenderError(renderErrorInvalidConfig, err)
+		renderErr.Output = output
+		return renderErr
+	}
+	if install != nil {
+		// the config is reloaded anyway
+		if _, err := install(); err != nil {
+			return err
 		}
 	}
+	// renaming replaces the config at once, HAProxy never reads a partially written file
+	if err := os.Rename(candidate, svc.configPath()); err != nil {
+		return newRenderError(renderErrorIO, err)
+	}
+	reconcileService(svc)
+	return nil
 }
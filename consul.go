@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulSettings are how the manager connects to Consul
+type consulSettings struct {
+	Addr string
+	// Token is the ACL token sent with each request
+	Token string
+	// TokenFile holds the ACL token instead of Token. It is read for each request, so the token can be rotated.
+	TokenFile string
+	// TLS is nil unless Consul is reached over HTTPS
+	TLS *tls.Config
+}
+
+// parseConsulSettings reads CONSUL_ADDRESS and the CONSUL_HTTP_* and TLS settings, loading the certificates they name
+func parseConsulSettings() (consulSettings, error) {
+	settings := consulSettings{Addr: ConsulAddr, Token: ConsulToken, TokenFile: ConsulTokenFile}
+	if settings.Token != "" && settings.TokenFile != "" {
+		return settings, fmt.Errorf("only one of CONSUL_HTTP_TOKEN and CONSUL_HTTP_TOKEN_FILE may be set")
+	}
+	Secrets.add(settings.Token)
+
+	useTLS := ConsulSSL || strings.HasPrefix(settings.Addr, "https://") ||
+		ConsulCACert != "" || ConsulClientCert != "" || ConsulClientKey != "" || ConsulTLSServerName != "" || ConsulSkipVerify
+	if !useTLS {
+		return settings, nil
+	}
+	if strings.HasPrefix(settings.Addr, "http://") {
+		return settings, fmt.Errorf("CONSUL_ADDRESS is %s, but TLS settings are set", settings.Addr)
+	}
+	if !strings.Contains(settings.Addr, "://") {
+		settings.Addr = "https://" + settings.Addr
+	}
+
+	settings.TLS = &tls.Config{ServerName: ConsulTLSServerName, InsecureSkipVerify: ConsulSkipVerify}
+	if ConsulCACert != "" {
+		pem, err := ioutil.ReadFile(ConsulCACert)
+		if err != nil {
+			return settings, fmt.Errorf("unable to read CONSUL_CACERT: %v", err)
+		}
+		settings.TLS.RootCAs = x509.NewCertPool()
+		if !settings.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return settings, fmt.Errorf("no certificates found in CONSUL_CACERT %s", ConsulCACert)
+		}
+	}
+	if (ConsulClientCert == "") != (ConsulClientKey == "") {
+		return settings, fmt.Errorf("CONSUL_CLIENT_CERT and CONSUL_CLIENT_KEY must be set together")
+	}
+	if ConsulClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(ConsulClientCert, ConsulClientKey)
+		if err != nil {
+			return settings, fmt.Errorf("unable to load the consul client certificate: %v", err)
+		}
+		settings.TLS.Certificates = []tls.Certificate{cert}
+	}
+	return settings, nil
+}
+
+// consulClient reads keys from the Consul KV store and healthy service instances from its catalog, with blocking queries
+type consulClient struct {
+	addr      string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+func newConsulClient(settings consulSettings) *consulClient {
+	addr := settings.Addr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	transport := http.DefaultTransport
+	if settings.TLS != nil {
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     settings.TLS,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+	return &consulClient{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     settings.Token,
+		tokenFile: settings.TokenFile,
+		client: &http.Client{
+			Transport: transport,
+			// Consul adds up to wait/16 of jitter to blocking queries
+			Timeout: sourceWait + sourceWait/16 + 30*time.Second,
+		},
+	}
+}
+
+// aclToken returns the token to send, reading the token file again so that a rotated token is picked up
+func (c *consulClient) aclToken() (string, error) {
+	if c.tokenFile == "" {
+		return c.token, nil
+	}
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the consul token: %v", err)
+	}
+	trimmed := strings.TrimSpace(string(token))
+	Secrets.add(trimmed)
+	return trimmed, nil
+}
+
+// get makes a blocking query when index is non-zero, returning the response and the index Consul answered at.
+// The caller closes the body.
+func (c *consulClient) get(ctx context.Context, path string, query url.Values, index uint64) (*http.Response, uint64, error) {
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", sourceWait.String())
+	}
+	req, err := http.NewRequest("GET", c.addr+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	token, err := c.aclToken()
+	if err != nil {
+		return nil, 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("consul denied access to %s (%s), check the ACL token", path, res.Status)
+	}
+	newIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("consul returned an invalid index: %q", res.Header.Get("X-Consul-Index"))
+	}
+	return res, newIndex, nil
+}
+
+// consulPair is a key as returned by the KV endpoint
+type consulPair struct {
+	Key   string
+	Value string
+}
+
+// list returns all keys under prefix. With a non-zero index it blocks until the data changes past that index or
+// sourceWait passes. The returned index is to be passed to the next call.
+func (c *consulClient) list(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error) {
+	res, newIndex, err := c.get(ctx, "/v1/kv/"+prefix, url.Values{"recurse": {"true"}}, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	kv := map[string]string{}
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		// nothing under the prefix yet
+		return kv, newIndex, nil
+	case http.StatusOK:
+	default:
+		return nil, 0, fmt.Errorf("consul returned %s for %s", res.Status, prefix)
+	}
+
+	pairs := []consulPair{}
+	if err := json.NewDecoder(res.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+	for _, pair := range pairs {
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("consul returned an invalid value for %s: %v", pair.Key, err)
+		}
+		kv[pair.Key] = string(value)
+	}
+	return kv, newIndex, nil
+}
+
+// catalogQuery is a Consul service looked up by a template, Tags are the comma separated tags its instances must have.
+// With Catalog set to dockerCatalog, Service is a backend whose containers are discovered instead.
+type catalogQuery struct {
+	Catalog string
+	Service string
+	Tags    string
+}
+
+// dockerCatalog marks the queries for labelled containers
+const dockerCatalog = "docker"
+
+func newCatalogQuery(service string, tags ...string) catalogQuery {
+	all := []string{}
+	for _, t := range tags {
+		for _, tag := range strings.Split(t, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				all = append(all, tag)
+			}
+		}
+	}
+	sort.Strings(all)
+	return catalogQuery{Service: service, Tags: strings.Join(all, ",")}
+}
+
+func (q catalogQuery) tags() []string {
+	if q.Tags == "" {
+		return nil
+	}
+	return strings.Split(q.Tags, ",")
+}
+
+func (q catalogQuery) String() string {
+	if q.Catalog == dockerCatalog {
+		return "the containers of backend " + q.Service
+	}
+	if q.Tags == "" {
+		return "the instances of " + q.Service
+	}
+	return "the instances of " + q.Service + " (" + q.Tags + ")"
+}
+
+// catalogInstance is a healthy instance of a service, as rendered into server lines
+type catalogInstance struct {
+	// Name is unique among the instances of a service and valid as an HAProxy server name
+	Name    string
+	ID      string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	// Weight is taken from the "weight" metadata of the instance, 1 if it has none
+	Weight int
+}
+
+// consulServiceEntry is an instance as returned by the health endpoint
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+}
+
+// serverNameEscaper replaces the characters HAProxy doesn't accept in server names
+var serverNameEscaper = strings.NewReplacer(" ", "_", "/", "_", "@", "_", "#", "_", "\t", "_")
+
+// instanceWeight reads the weight metadata of an instance, HAProxy accepts weights from 0 to 256
+func instanceWeight(meta map[string]string) int {
+	weight, err := strconv.Atoi(meta["weight"])
+	if err != nil || weight < 0 || weight > 256 {
+		return 1
+	}
+	return weight
+}
+
+// healthyInstances returns the instances of a service which pass their health checks and have the query's tags,
+// blocking like list with a non-zero index
+func (c *consulClient) healthyInstances(ctx context.Context, query catalogQuery, index uint64) ([]catalogInstance, uint64, error) {
+	params := url.Values{"passing": {"true"}}
+	for _, tag := range query.tags() {
+		params.Add("tag", tag)
+	}
+	res, newIndex, err := c.get(ctx, "/v1/health/service/"+url.PathEscape(query.Service), params, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s for service %s", res.Status, query.Service)
+	}
+
+	entries := []consulServiceEntry{}
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	instances := []catalogInstance{}
+	for _, entry := range entries {
+		// older Consul versions only filter on a single tag
+		if !hasTags(entry.Service.Tags, query.tags()) {
+			continue
+		}
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		instances = append(instances, catalogInstance{
+			Name:    serverNameEscaper.Replace(entry.Node.Node + "." + entry.Service.ID),
+			ID:      entry.Service.ID,
+			Node:    entry.Node.Node,
+			Address: address,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+			Meta:    entry.Service.Meta,
+			Weight:  instanceWeight(entry.Service.Meta),
+		})
+	}
+	sortInstances(instances)
+	return instances, newIndex, nil
+}
+
+func sortInstances(instances []catalogInstance) {
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+}
+
+func hasTags(tags []string, required []string) bool {
+	for _, r := range required {
+		if !containsString(tags, r) {
+			return false
+		}
+	}
+	return true
+}
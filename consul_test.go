@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves a KV store and the passing instances of services with Consul's blocking query semantics
+type fakeConsul struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	index     uint64
+	kv        map[string]string
+	instances map[string][]consulServiceEntry
+	changed   chan struct{}
+	// token is the ACL token requests must have, if it is set
+	token string
+}
+
+func newFakeConsul() *fakeConsul {
+	return startFakeConsul(httptest.NewServer)
+}
+
+// startFakeConsul serves the fake with start, such as httptest.NewTLSServer
+func startFakeConsul(start func(http.Handler) *httptest.Server) *fakeConsul {
+	c := &fakeConsul{index: 1, kv: map[string]string{}, instances: map[string][]consulServiceEntry{}, changed: make(chan struct{})}
+	// a ServeMux would redirect the empty path segment of an unset INSTANCE_ID
+	c.Server = start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+		if token != "" && r.Header.Get("X-Consul-Token") != token {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			c.serveHealth(w, r)
+			return
+		}
+		c.serveKV(w, r)
+	}))
+	return c
+}
+
+// update changes the data under the lock and wakes up the blocked queries
+func (c *fakeConsul) update(change func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	change()
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) put(key, value string) {
+	c.update(func() { c.kv[key] = value })
+}
+
+// register adds a passing instance of a service, or replaces the one with the same ID
+func (c *fakeConsul) register(service string, entry consulServiceEntry) {
+	c.deregister(service, entry.Service.ID)
+	c.update(func() { c.instances[service] = append(c.instances[service], entry) })
+}
+
+func (c *fakeConsul) deregister(service, id string) {
+	c.update(func() {
+		kept := []consulServiceEntry{}
+		for _, entry := range c.instances[service] {
+			if entry.Service.ID != id {
+				kept = append(kept, entry)
+			}
+		}
+		c.instances[service] = kept
+	})
+}
+
+// block waits for the index to move past the query's index, returning with the lock held unless the request ended
+func (c *fakeConsul) block(r *http.Request) bool {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	c.mu.Lock()
+	for index > 0 && c.index <= index {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return false
+		}
+		c.mu.Lock()
+	}
+	return true
+}
+
+func (c *fakeConsul) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !c.block(r) {
+		return
+	}
+	entries := c.instances[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+	if entries == nil {
+		entries = []consulServiceEntry{}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(w).Encode(entries)
+	c.mu.Unlock()
+}
+
+func (c *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if !c.block(r) {
+		return
+	}
+	pairs := []consulPair{}
+	for key, value := range c.kv {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, consulPair{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value))})
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	c.mu.Unlock()
+
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulKVList(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.put("svc/a", "1")
+	consul.put("other/b", "2")
+
+	kv := newConsulClient(consulSettings{Addr: consul.URL})
+	pairs, index, err := kv.list(context.Background(), "svc/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || pairs["svc/a"] != "1" {
+		t.Errorf("unexpected keys: %v", pairs)
+	}
+	if _, _, err := kv.list(context.Background(), "missing/", 0); err != nil {
+		t.Errorf("expected a missing prefix to have no keys, got %v", err)
+	}
+
+	// a blocking query returns once the data changes
+	changed := make(chan map[string]string)
+	go func() {
+		pairs, _, _ := kv.list(context.Background(), "svc/", index)
+		changed <- pairs
+	}()
+	select {
+	case <-changed:
+		t.Fatal("expected the query to block until a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	consul.put("svc/a", "3")
+	select {
+	case pairs := <-changed:
+		if pairs["svc/a"] != "3" {
+			t.Errorf("expected the changed value, got %v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking query didn't return")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := kv.list(ctx, "svc/", index+1); err == nil {
+		t.Error("expected a cancelled query to fail")
+	}
+}
+
+func TestWatchKVRendersConfig(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previous := Source
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+	defer func() { Source = previous }()
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	template := testConfig + `    maxconn {{keyOrDefault (print "instances/" (env "INSTANCE_ID") "/services/" (env "SERVICE_NAME") "/maxconn") "100"}}` + "\n"
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	rendered := func(line string) func() bool {
+		return func() bool {
+			config, err := ioutil.ReadFile(svc.configPath())
+			return err == nil && strings.Contains(string(config), line)
+		}
+	}
+	waitFor(t, "the default config", rendered("maxconn 100\n"))
+	consul.put(svc.kvPrefix()+"maxconn", "2000")
+	waitFor(t, "the config to follow consul", rendered("maxconn 2000\n"))
+	waitFor(t, "HAProxy to reload", func() bool {
+		signals := docker.receivedSignals(id)
+		return len(signals) > 0 && signals[len(signals)-1] == "SIGHUP"
+	})
+}
+
+func TestApplyConfigRejectsInvalidConfig(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	svc := newService(DefaultServiceName, newDockerRuntime(docker))
+
+	docker.failChecks("[ALERT] parsing [haproxy.cfg:2]: unknown keyword 'bogus'")
+	err := applyConfig(svc, []byte("global\n    bogus\n"), false, nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown keyword") {
+		t.Errorf("expected the check output in the error, got %v", err)
+	}
+	if config, _ := ioutil.ReadFile(svc.configPath()); string(config) != testConfig {
+		t.Errorf("expected the previous config to be kept, got:\n%s", config)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(svc.confDir(), "*.new")); len(matches) > 0 {
+		t.Errorf("expected the candidate config to be removed, found %v", matches)
+	}
+
+	docker.failChecks("")
+	if err := applyConfig(svc, []byte(testConfig+"    maxconn 10\n"), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := ioutil.ReadFile(svc.configPath()); !strings.Contains(string(config), "maxconn 10") {
+		t.Errorf("expected the valid config to be installed, got:\n%s", config)
+	}
+}
+
+func TestWatchKVDebouncesChanges(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previous, previousWait := Source, RenderWait
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+	RenderWait = renderWait{Min: 200 * time.Millisecond, Max: 2 * time.Second}
+	defer func() { Source, RenderWait = previous, previousWait }()
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	template := testConfig + `    maxconn {{keyOrDefault (print "instances/" (env "INSTANCE_ID") "/services/" (env "SERVICE_NAME") "/maxconn") "100"}}` + "\n"
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	waitFor(t, "the first reload", func() bool { return len(docker.receivedSignals(id)) == 1 })
+	for i := 1; i <= 5; i++ {
+		consul.put(svc.kvPrefix()+"maxconn", strconv.Itoa(i*1000))
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(t, "the last value", func() bool {
+		config, _ := ioutil.ReadFile(svc.configPath())
+		return strings.Contains(string(config), "maxconn 5000\n")
+	})
+	time.Sleep(2 * RenderWait.Min)
+	if signals := docker.receivedSignals(id); len(signals) != 2 {
+		t.Errorf("expected the burst to reload HAProxy once, got %v", signals)
+	}
+}
+
+func TestWatchKVReportsRenderErrors(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previous := Source
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+	defer func() { Source = previous }()
+
+	docker := newFakeDocker()
+	svc := newService(DefaultServiceName, newDockerRuntime(docker))
+	template := testConfig + `    {{key (print "instances/" (env "INSTANCE_ID") "/services/" (env "SERVICE_NAME") "/setting")}}` + "\n"
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	renderErrorKind := func(kind string) func() bool {
+		return func() bool {
+			status, err := serviceStatus(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind == "" {
+				return status.RenderError == nil
+			}
+			return status.RenderError != nil && status.RenderError.Kind == kind
+		}
+	}
+	waitFor(t, "the missing key to be reported", renderErrorKind(renderErrorMissingKey))
+
+	docker.failChecks("[ALERT] parsing [haproxy.cfg:5]: unknown keyword 'bogus'")
+	consul.put(svc.kvPrefix()+"setting", "bogus")
+	waitFor(t, "the invalid config to be reported", renderErrorKind(renderErrorInvalidConfig))
+	status, _ := serviceStatus(svc)
+	if !strings.Contains(status.RenderError.Output, "unknown keyword") {
+		t.Errorf("expected the check output, got %+v", status.RenderError)
+	}
+	kinds := []string{}
+	for _, ev := range status.Events {
+		if ev.Action == "render_error" {
+			kinds = append(kinds, ev.RenderError.Kind)
+		}
+	}
+	if !reflect.DeepEqual(kinds, []string{renderErrorMissingKey, renderErrorInvalidConfig}) {
+		t.Errorf("expected an event per render error, got %v", kinds)
+	}
+
+	docker.failChecks("")
+	consul.put(svc.kvPrefix()+"setting", "maxconn 10")
+	waitFor(t, "the render error to clear", renderErrorKind(""))
+}
+
+func testInstance(node, id, address string, port int, tags []string, meta map[string]string) consulServiceEntry {
+	entry := consulServiceEntry{}
+	entry.Node.Node = node
+	entry.Node.Address = "192.168.0.1"
+	entry.Service.ID = id
+	entry.Service.Address = address
+	entry.Service.Port = port
+	entry.Service.Tags = tags
+	entry.Service.Meta = meta
+	return entry
+}
+
+func TestHealthyInstances(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.register("web", testInstance("node1", "web-1", "10.0.0.1", 8080, []string{"prod", "v2"}, map[string]string{"weight": "50"}))
+	consul.register("web", testInstance("node2", "web 2", "", 8080, []string{"prod"}, map[string]string{"weight": "lots"}))
+	consul.register("web", testInstance("node3", "web-3", "10.0.0.3", 8080, []string{"staging"}, nil))
+
+	client := newConsulClient(consulSettings{Addr: consul.URL})
+	instances, index, err := client.healthyInstances(context.Background(), newCatalogQuery("web", "prod"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected the instances tagged prod, got %+v", instances)
+	}
+	if i := instances[0]; i.Name != "node1.web-1" || i.Address != "10.0.0.1" || i.Weight != 50 {
+		t.Errorf("unexpected instance: %+v", i)
+	}
+	if i := instances[1]; i.Name != "node2.web_2" || i.Address != "192.168.0.1" || i.Weight != 1 {
+		t.Errorf("expected the node address and the default weight, got %+v", i)
+	}
+	if instances, _, _ := client.healthyInstances(context.Background(), newCatalogQuery("web", "v2, prod"), 0); len(instances) != 1 {
+		t.Errorf("expected only the instance with both tags, got %+v", instances)
+	}
+
+	changed := make(chan []catalogInstance)
+	go func() {
+		instances, _, _ := client.healthyInstances(context.Background(), newCatalogQuery("web", "prod"), index)
+		changed <- instances
+	}()
+	consul.deregister("web", "web-1")
+	select {
+	case instances := <-changed:
+		if len(instances) != 1 {
+			t.Errorf("expected the deregistered instance to be gone, got %+v", instances)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking query didn't return")
+	}
+}
+
+func TestWatchKVFollowsCatalog(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previous := Source
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+	defer func() { Source = previous }()
+
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	template := testConfig + `
+backend web
+{{- range service (keyOrDefault (print "instances/" (env "INSTANCE_ID") "/services/" (env "SERVICE_NAME") "/backends_service") "web") "prod"}}
+    server {{.Name}} {{.Address}}:{{.Port}} weight {{.Weight}} check
+{{- end}}
+`
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	consul.register("web", testInstance("node1", "web-1", "10.0.0.1", 8080, []string{"prod"}, nil))
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	rendered := func(line string, present bool) func() bool {
+		return func() bool {
+			config, err := ioutil.ReadFile(svc.configPath())
+			return err == nil && strings.Contains(string(config), line) == present
+		}
+	}
+	waitFor(t, "the registered instance", rendered("server node1.web-1 10.0.0.1:8080 weight 1 check", true))
+	consul.register("web", testInstance("node2", "web-2", "10.0.0.2", 8080, []string{"prod"}, map[string]string{"weight": "10"}))
+	waitFor(t, "the new instance", rendered("server node2.web-2 10.0.0.2:8080 weight 10 check", true))
+	consul.deregister("web", "web-1")
+	waitFor(t, "the deregistered instance to be dropped", rendered("node1.web-1", false))
+
+	// the backend follows the service its key binds it to
+	consul.register("api", testInstance("node3", "api-1", "10.0.0.3", 9000, []string{"prod"}, nil))
+	consul.put(svc.kvPrefix()+"backends_service", "api")
+	waitFor(t, "the backend to follow the other service", rendered("server node3.api-1 10.0.0.3:9000", true))
+	if config, _ := ioutil.ReadFile(svc.configPath()); strings.Contains(string(config), "web-2") {
+		t.Errorf("expected the servers of the previous service to be dropped, got:\n%s", config)
+	}
+}
+
+func TestConsulACLToken(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.put("svc/a", "1")
+	consul.token = "first-token"
+
+	dir, err := ioutil.TempDir("", "consul-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newConsulClient(consulSettings{Addr: consul.URL, TokenFile: tokenFile})
+	if _, _, err := client.list(context.Background(), "svc/", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate the token
+	consul.mu.Lock()
+	consul.token = "second-token"
+	consul.mu.Unlock()
+	if _, _, err := client.list(context.Background(), "svc/", 0); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("expected the old token to be denied, got %v", err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("second-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if kv, _, err := client.list(context.Background(), "svc/", 0); err != nil || kv["svc/a"] != "1" {
+		t.Fatalf("expected the rotated token to be read, got %v %v", kv, err)
+	}
+	if redacted := string(Secrets.redact([]byte("first-token second-token"))); redacted != "[redacted] [redacted]" {
+		t.Errorf("expected both tokens to be redacted, got %q", redacted)
+	}
+}
+
+// setConsulEnv sets the consul settings as if they came from the environment, returning a func restoring them
+func setConsulEnv(addr, caCert, clientCert, clientKey string, ssl bool) func() {
+	previous := []string{ConsulAddr, ConsulCACert, ConsulClientCert, ConsulClientKey}
+	previousSSL := ConsulSSL
+	ConsulAddr, ConsulCACert, ConsulClientCert, ConsulClientKey, ConsulSSL = addr, caCert, clientCert, clientKey, ssl
+	return func() {
+		ConsulAddr, ConsulCACert, ConsulClientCert, ConsulClientKey = previous[0], previous[1], previous[2], previous[3]
+		ConsulSSL = previousSSL
+	}
+}
+
+func TestConsulTLS(t *testing.T) {
+	consul := startFakeConsul(httptest.NewTLSServer)
+	defer consul.Close()
+	consul.put("svc/a", "1")
+
+	dir, err := ioutil.TempDir("", "consul-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: consul.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the scheme comes from CONSUL_HTTP_SSL
+	defer setConsulEnv(strings.TrimPrefix(consul.URL, "https://"), caCert, "", "", true)()
+	settings, err := parseConsulSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Addr != consul.URL {
+		t.Errorf("expected %s, got %s", consul.URL, settings.Addr)
+	}
+	if kv, _, err := newConsulClient(settings).list(context.Background(), "svc/", 0); err != nil || kv["svc/a"] != "1" {
+		t.Fatalf("expected the keys over TLS, got %v %v", kv, err)
+	}
+
+	setConsulEnv(consul.URL, "", "", "", false)
+	settings, err = parseConsulSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newConsulClient(settings).list(context.Background(), "svc/", 0); err == nil {
+		t.Error("expected the certificate of an unknown CA to be rejected")
+	}
+}
+
+func TestParseConsulSettingsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                          string
+		addr, caCert, clientCert, key string
+	}{
+		{"http address with a CA", "http://consul:8500", notPEM, "", ""},
+		{"missing CA file", "consul:8501", filepath.Join(dir, "missing.pem"), "", ""},
+		{"CA file without certificates", "consul:8501", notPEM, "", ""},
+		{"client cert without key", "https://consul:8501", "", notPEM, ""},
+		{"invalid client cert", "https://consul:8501", "", notPEM, notPEM},
+	}
+	for _, test := range tests {
+		restore := setConsulEnv(test.addr, test.caCert, test.clientCert, test.key, false)
+		if _, err := parseConsulSettings(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		restore()
+	}
+
+	previousToken, previousFile := ConsulToken, ConsulTokenFile
+	defer func() { ConsulToken, ConsulTokenFile = previousToken, previousFile }()
+	ConsulToken, ConsulTokenFile = "token", filepath.Join(dir, "token")
+	if _, err := parseConsulSettings(); err == nil {
+		t.Error("expected an error with both a token and a token file")
+	}
+}
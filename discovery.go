@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	dockerClient "github.com/docker/docker/client"
+)
+
+const (
+	// backendLabel names the backend a container is a server of
+	backendLabel = "com.opencopilot.lb.backend"
+	// portLabel is the port the container serves the backend on
+	portLabel = "com.opencopilot.lb.port"
+	// weightLabel optionally sets the server's weight
+	weightLabel = "com.opencopilot.lb.weight"
+)
+
+// containerDiscovery finds the local containers labelled as servers of a backend, at their address on a Docker network
+// shared with HAProxy. Changes are noticed through the runtime's events stream.
+type containerDiscovery struct {
+	cli     dockerAPI
+	network string
+
+	mu    sync.Mutex
+	index uint64
+	// changed is closed and replaced whenever a labelled container starts or stops
+	changed chan struct{}
+}
+
+// newContainerDiscovery creates the network if it doesn't exist yet, and follows the labelled containers of rt
+func newContainerDiscovery(rt *dockerRuntime, network string) (*containerDiscovery, error) {
+	ctx := context.Background()
+	_, err := rt.cli.NetworkInspect(ctx, network, dockerTypes.NetworkInspectOptions{})
+	if dockerClient.IsErrNotFound(err) {
+		log.Printf("creating the docker network %s\n", network)
+		_, err = rt.cli.NetworkCreate(ctx, network, dockerTypes.NetworkCreate{CheckDuplicate: true, Driver: "bridge"})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &containerDiscovery{cli: rt.cli, network: network, index: 1, changed: make(chan struct{})}
+	rt.mu.Lock()
+	rt.discovery = d
+	rt.mu.Unlock()
+	return d, nil
+}
+
+func (d *containerDiscovery) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.index++
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// list returns the running containers labelled as servers of backend. With a non-zero index it blocks until a
+// labelled container starts or stops, or sourceWait passes.
+func (d *containerDiscovery) list(ctx context.Context, backend string, index uint64) ([]catalogInstance, uint64, error) {
+	timeout := time.After(sourceWait)
+	d.mu.Lock()
+	for index > 0 && d.index <= index {
+		changed := d.changed
+		d.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, index, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		d.mu.Lock()
+	}
+	current := d.index
+	d.mu.Unlock()
+
+	containers, err := d.cli.ContainerList(ctx, dockerTypes.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", backendLabel+"="+backend)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := []catalogInstance{}
+	for _, c := range containers {
+		name := strings.TrimPrefix(c.Names[0], "/")
+		port, err := strconv.Atoi(c.Labels[portLabel])
+		if err != nil || port <= 0 || port > 65535 {
+			log.Printf("container %s has no valid %s label, leaving it out of %s\n", name, portLabel, backend)
+			continue
+		}
+		var address string
+		if c.NetworkSettings != nil && c.NetworkSettings.Networks[d.network] != nil {
+			address = c.NetworkSettings.Networks[d.network].IPAddress
+		}
+		if address == "" {
+			log.Printf("container %s isn't on the %s network, leaving it out of %s\n", name, d.network, backend)
+			continue
+		}
+		instances = append(instances, catalogInstance{
+			Name:    serverNameEscaper.Replace(name),
+			ID:      c.ID,
+			Address: address,
+			Port:    port,
+			Meta:    c.Labels,
+			Weight:  instanceWeight(map[string]string{"weight": c.Labels[weightLabel]}),
+		})
+	}
+	sortInstances(instances)
+	return instances, current, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// startBackendContainer runs a container labelled as a server of backend, on the given network unless it is empty
+func startBackendContainer(t *testing.T, docker *fakeDocker, name, backend, port, networkName string) string {
+	config := &container.Config{
+		Image:  "nginx",
+		Labels: map[string]string{backendLabel: backend, portLabel: port},
+	}
+	var networking *network.NetworkingConfig
+	if networkName != "" {
+		networking = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{networkName: {}}}
+	}
+	res, err := docker.ContainerCreate(context.Background(), config, &container.HostConfig{}, networking, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := docker.ContainerStart(context.Background(), res.ID, dockerTypes.ContainerStartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return res.ID
+}
+
+func TestContainerDiscovery(t *testing.T) {
+	docker := newFakeDocker()
+	discovery, err := newContainerDiscovery(newDockerRuntime(docker), "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := docker.NetworkInspect(context.Background(), "lb", dockerTypes.NetworkInspectOptions{}); err != nil {
+		t.Fatalf("expected the network to be created, got %v", err)
+	}
+
+	web1 := startBackendContainer(t, docker, "web1", "web", "8080", "lb")
+	startBackendContainer(t, docker, "web-offnet", "web", "8080", "")
+	startBackendContainer(t, docker, "web-noport", "web", "http", "lb")
+	startBackendContainer(t, docker, "api1", "api", "9000", "lb")
+
+	instances, index, err := discovery.list(context.Background(), "web", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Name != "web1" || instances[0].Port != 8080 || !strings.HasPrefix(instances[0].Address, "172.18.") {
+		t.Fatalf("expected only web1, got %+v", instances)
+	}
+
+	changed := make(chan []catalogInstance)
+	go func() {
+		instances, _, _ := discovery.list(context.Background(), "web", index)
+		changed <- instances
+	}()
+	if err := docker.ContainerStop(context.Background(), web1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case instances := <-changed:
+		if len(instances) != 0 {
+			t.Errorf("expected the stopped container to be gone, got %+v", instances)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stop wasn't noticed")
+	}
+}
+
+func TestContainerDiscoveryFollowsNetworkConnects(t *testing.T) {
+	docker := newFakeDocker()
+	discovery, err := newContainerDiscovery(newDockerRuntime(docker), "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web1 := startBackendContainer(t, docker, "web1", "web", "8080", "")
+	instances, index, err := discovery.list(context.Background(), "web", 0)
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("expected the container off the network to be left out, got %+v %v", instances, err)
+	}
+
+	// the container is already running, only the network events tell it joined or left the network
+	for _, change := range []struct {
+		connect  func() error
+		expected int
+	}{
+		{func() error { return docker.NetworkConnect(context.Background(), "lb", web1, nil) }, 1},
+		{func() error { return docker.NetworkDisconnect(context.Background(), "lb", web1, false) }, 0},
+	} {
+		changed := make(chan []catalogInstance)
+		go func(index uint64) {
+			instances, _, _ := discovery.list(context.Background(), "web", index)
+			changed <- instances
+		}(index)
+		if err := change.connect(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case instances = <-changed:
+			if len(instances) != change.expected {
+				t.Errorf("expected %d instances, got %+v", change.expected, instances)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the network change wasn't noticed")
+		}
+		_, index, _ = discovery.list(context.Background(), "web", 0)
+	}
+}
+
+func TestHAProxyJoinsDiscoveryNetwork(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	previous := DiscoveryNetwork
+	DiscoveryNetwork = "lb"
+	defer func() { DiscoveryNetwork = previous }()
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	if _, err := newContainerDiscovery(rt, "lb"); err != nil {
+		t.Fatal(err)
+	}
+	svc := newService(DefaultServiceName, rt)
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := docker.ContainerInspect(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.NetworkSettings.Networks["lb"] == nil {
+		t.Errorf("expected HAProxy to join the network, got %+v", existing.NetworkSettings.Networks)
+	}
+
+	cs, err := rt.containerSpec(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing.NetworkSettings.Networks = nil
+	if drift := specDrift(cs, existing); drift != "network lb" {
+		t.Errorf("expected a container off the network to drift, got %q", drift)
+	}
+}
+
+func TestWatchKVFollowsContainers(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previousSource, previousDiscovery := Source, Discovery
+	defer func() { Source, Discovery = previousSource, previousDiscovery }()
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	discovery, err := newContainerDiscovery(rt, "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Discovery = discovery
+
+	svc := newService(DefaultServiceName, rt)
+	template := testConfig + "\nbackend web\n{{- range containers \"web\"}}\n    server {{.Name}} {{.Address}}:{{.Port}} check\n{{- end}}\n"
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	rendered := func(line string, present bool) func() bool {
+		return func() bool {
+			config, err := ioutil.ReadFile(svc.configPath())
+			return err == nil && strings.Contains(string(config), line) == present
+		}
+	}
+	waitFor(t, "the empty backend", rendered("backend web\n", true))
+	id := startBackendContainer(t, docker, "web1", "web", "8080", "lb")
+	waitFor(t, "the started container", rendered("server web1 172.18.", true))
+	if err := docker.ContainerStop(context.Background(), id, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the stopped container to be dropped", rendered("server web1", false))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// errorPageStatuses are the statuses which can have an error page, with their reasons
+var errorPageStatuses = map[int]string{
+	403: "Forbidden",
+	429: "Too Many Requests",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+}
+
+// maxErrorPageSize keeps an error page within HAProxy's buffer, less the space it reserves for rewriting headers
+const maxErrorPageSize = 16384 - 1024
+
+// defaultMaintenancePage is served during maintenance when no page is given
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body>
+</html>
+`
+
+// errorPage is an error page of a service, for all of its backends unless Backend is set
+type errorPage struct {
+	Status  int
+	Backend string
+	Size    int64
+}
+
+// errorPages are the error pages of a service, and whether it is in maintenance
+type errorPages struct {
+	Pages       []errorPage
+	Maintenance bool
+}
+
+// errorsDir holds the error pages of the service, as the HTTP responses HAProxy sends
+func (svc *service) errorsDir() string {
+	return filepath.Join(svc.confDir(), "/errors")
+}
+
+// errorPagePath is the file of an error page, backends' pages being in a directory of each backend
+func (svc *service) errorPagePath(status int, backend string) string {
+	if backend == "" {
+		return filepath.Join(svc.errorsDir(), strconv.Itoa(status)+".http")
+	}
+	return filepath.Join(svc.errorsDir(), "/backends/", backend, strconv.Itoa(status)+".http")
+}
+
+// maintenancePagePath is the page every HTTP frontend answers with during maintenance, which lasts as long as it exists
+func (svc *service) maintenancePagePath() string {
+	return filepath.Join(svc.errorsDir(), "/maintenance.http")
+}
+
+// errorResponse turns a page into the raw HTTP response HAProxy sends for the status
+func errorResponse(status int, contentType string, body []byte) ([]byte, error) {
+	reason, ok := errorPageStatuses[status]
+	if !ok {
+		return nil, fmt.Errorf("there are error pages for 403, 429, 502, 503 and 504, not %d", status)
+	}
+	if contentType == "" {
+		contentType = "text/html"
+	}
+	if strings.ContainsAny(contentType, "\r\n") {
+		return nil, fmt.Errorf("%q isn't a content type", contentType)
+	}
+	response := fmt.Sprintf("HTTP/1.0 %d %s\r\nCache-Control: no-cache\r\nConnection: close\r\nContent-Type: %s\r\n\r\n", status, reason, contentType)
+	if len(response)+len(body) > maxErrorPageSize {
+		return nil, fmt.Errorf("error pages are limited to %d bytes", maxErrorPageSize-len(response))
+	}
+	return append([]byte(response), body...), nil
+}
+
+func writeErrorPage(path string, response []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// renaming replaces the page at once, HAProxy never reads a partially written one
+	if err := ioutil.WriteFile(path+".tmp", response, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// setErrorPage stores the page of a status, for a backend or all of them if backend is empty
+func (svc *service) setErrorPage(status int, backend, contentType string, body []byte) error {
+	if backend != "" && !validProxyName(backend) {
+		return fmt.Errorf("%q isn't a backend name", backend)
+	}
+	response, err := errorResponse(status, contentType, body)
+	if err != nil {
+		return err
+	}
+	return writeErrorPage(svc.errorPagePath(status, backend), response)
+}
+
+// deleteErrorPage removes the page of a status, HAProxy's own page is sent again
+func (svc *service) deleteErrorPage(status int, backend string) error {
+	if backend != "" && !validProxyName(backend) {
+		return fmt.Errorf("%q isn't a backend name", backend)
+	}
+	return os.Remove(svc.errorPagePath(status, backend))
+}
+
+// setMaintenance starts the maintenance of the service with a page, the default one if body is empty, or ends it
+func (svc *service) setMaintenance(enabled bool, contentType string, body []byte) error {
+	if !enabled {
+		if err := os.Remove(svc.maintenancePagePath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if len(body) == 0 {
+		body = []byte(defaultMaintenancePage)
+	}
+	response, err := errorResponse(503, contentType, body)
+	if err != nil {
+		return err
+	}
+	return writeErrorPage(svc.maintenancePagePath(), response)
+}
+
+// errorPages lists the error pages of the service, sorted by backend and status
+func (svc *service) errorPages() (*errorPages, error) {
+	pages := &errorPages{Pages: []errorPage{}}
+	if _, err := os.Stat(svc.maintenancePagePath()); err == nil {
+		pages.Maintenance = true
+	}
+	dirs := map[string]string{"": svc.errorsDir()}
+	backends, err := ioutil.ReadDir(filepath.Join(svc.errorsDir(), "/backends"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, backend := range backends {
+		if backend.IsDir() {
+			dirs[backend.Name()] = filepath.Join(svc.errorsDir(), "/backends/", backend.Name())
+		}
+	}
+	for backend, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, file := range files {
+			status, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".http"))
+			if _, ok := errorPageStatuses[status]; !ok || err != nil || !strings.HasSuffix(file.Name(), ".http") {
+				continue
+			}
+			pages.Pages = append(pages.Pages, errorPage{Status: status, Backend: backend, Size: file.Size()})
+		}
+	}
+	sort.Slice(pages.Pages, func(i, j int) bool {
+		if pages.Pages[i].Backend != pages.Pages[j].Backend {
+			return pages.Pages[i].Backend < pages.Pages[j].Backend
+		}
+		return pages.Pages[i].Status < pages.Pages[j].Status
+	})
+	return pages, nil
+}
+
+// setErrorPages adds the errorfile lines of the pages to the defaults and the backends, dir being the error pages'
+// directory as seen by HAProxy. The pages of backends which don't exist are left out.
+func (lb *loadBalancer) setErrorPages(pages *errorPages, dir string) {
+	if pages == nil || dir == "" {
+		return
+	}
+	backends := map[string]*lbBackend{}
+	for _, backend := range lb.Backends {
+		backends[backend.Name] = backend
+	}
+	for _, page := range pages.Pages {
+		status := strconv.Itoa(page.Status)
+		if page.Backend == "" {
+			lb.ErrorFiles = append(lb.ErrorFiles, "errorfile "+status+" "+dir+"/"+status+".http")
+		} else if backend, ok := backends[page.Backend]; ok {
+			backend.ErrorFiles = append(backend.ErrorFiles, "errorfile "+status+" "+dir+"/backends/"+page.Backend+"/"+status+".http")
+		}
+	}
+	if pages.Maintenance {
+		lb.Maintenance = dir + "/maintenance.http"
+	}
+}
+
+func errorPagesToProto(pages *errorPages) *pb.ErrorPages {
+	out := &pb.ErrorPages{Maintenance: pages.Maintenance}
+	for _, page := range pages.Pages {
+		out.Pages = append(out.Pages, &pb.ErrorPage{Status: int32(page.Status), Backend: page.Backend, Size: page.Size})
+	}
+	return out
+}
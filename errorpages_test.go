@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorResponse(t *testing.T) {
+	response, err := errorResponse(503, "", []byte("<h1>Sorry</h1>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "HTTP/1.0 503 Service Unavailable\r\nCache-Control: no-cache\r\nConnection: close\r\nContent-Type: text/html\r\n\r\n<h1>Sorry</h1>"
+	if string(response) != expected {
+		t.Errorf("expected %q, got %q", expected, response)
+	}
+	response, err = errorResponse(429, "application/json", []byte(`{"error": "slow down"}`))
+	if err != nil || !strings.HasPrefix(string(response), "HTTP/1.0 429 Too Many Requests\r\n") || !strings.Contains(string(response), "Content-Type: application/json\r\n") {
+		t.Errorf("unexpected response %q %v", response, err)
+	}
+
+	for _, test := range []struct {
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{404, "", nil},
+		{200, "", nil},
+		{503, "text/html\r\nSet-Cookie: a=b", nil},
+		{503, "", make([]byte, maxErrorPageSize)},
+	} {
+		if _, err := errorResponse(test.status, test.contentType, test.body); err == nil {
+			t.Errorf("%d %q with %d bytes: expected an error", test.status, test.contentType, len(test.body))
+		}
+	}
+}
+
+func TestErrorPageRPCs(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	s := &server{manager: testManager(newDockerRuntime(newFakeDocker()))}
+	ctx := context.Background()
+
+	pages, err := s.ListErrorPages(ctx, &pb.ListErrorPagesRequest{})
+	if err != nil || len(pages.Pages) != 0 || pages.Maintenance {
+		t.Fatalf("expected no pages, got %v %v", pages, err)
+	}
+	if _, err := s.SetErrorPage(ctx, &pb.SetErrorPageRequest{Status: 503, Body: []byte("<h1>Back soon</h1>")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetErrorPage(ctx, &pb.SetErrorPageRequest{Status: 502, Backend: "api", Body: []byte(`{"error": "bad gateway"}`), ContentType: "application/json"}); err != nil {
+		t.Fatal(err)
+	}
+	pages, err = s.SetMaintenance(ctx, &pb.SetMaintenanceRequest{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := func(status int, contentType, body string) int64 {
+		response, _ := errorResponse(status, contentType, []byte(body))
+		return int64(len(response))
+	}
+	expected := []*pb.ErrorPage{
+		{Status: 503, Size: size(503, "", "<h1>Back soon</h1>")},
+		{Status: 502, Backend: "api", Size: size(502, "application/json", `{"error": "bad gateway"}`)},
+	}
+	if !reflect.DeepEqual(pages.Pages, expected) || !pages.Maintenance {
+		t.Errorf("expected %v in maintenance, got %v", expected, pages)
+	}
+	svc, _ := s.manager.service("")
+	page, err := ioutil.ReadFile(svc.maintenancePagePath())
+	if err != nil || !strings.Contains(string(page), "Down for maintenance") {
+		t.Errorf("expected the default maintenance page, got %q %v", page, err)
+	}
+	if status, err := s.GetStatus(ctx, &pb.ManagerStatusRequest{}); err != nil || !status.Maintenance {
+		t.Errorf("expected the status to show the maintenance, got %v %v", status, err)
+	}
+
+	for _, request := range []*pb.SetErrorPageRequest{
+		{Status: 404, Body: []byte("not found")},
+		{Status: 503, Backend: "../api"},
+	} {
+		if _, err := s.SetErrorPage(ctx, request); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected an invalid argument, got %v", request, err)
+		}
+	}
+
+	if _, err := s.DeleteErrorPage(ctx, &pb.DeleteErrorPageRequest{Status: 502, Backend: "api"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteErrorPage(ctx, &pb.DeleteErrorPageRequest{Status: 502, Backend: "api"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected a missing page not to be found, got %v", err)
+	}
+	pages, err = s.SetMaintenance(ctx, &pb.SetMaintenanceRequest{})
+	if err != nil || pages.Maintenance || len(pages.Pages) != 1 {
+		t.Errorf("expected the maintenance to end, got %v %v", pages, err)
+	}
+}
+
+func TestRenderErrorPages(t *testing.T) {
+	text, err := ioutil.ReadFile("haproxy.ctmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "instances/i-1/services/lb-haproxy/"
+	kv := map[string]string{
+		prefix + "frontends/www/bind":                "*:80",
+		prefix + "frontends/db/bind":                 "*:5432",
+		prefix + "frontends/db/mode":                 "tcp",
+		prefix + "frontends/db/default_backend":      "db",
+		prefix + "backends/api/servers/api1":         "10.0.1.1:8080",
+		prefix + "backends/backends/servers/w1":      "10.0.0.1:80",
+		prefix + "backends/db/servers/db1":           "10.0.2.1:5432",
+		prefix + "frontends/www/routes/api/host":     "api.example.com",
+		prefix + "frontends/www/routes/api/backend":  "api",
+		prefix + "abuse/conn_rate":                   "100/10s",
+		prefix + "frontends/www/rate_limit/requests": "100/10s",
+	}
+	env := map[string]string{"INSTANCE_ID": "i-1", "SERVICE_NAME": "lb-haproxy", "HAPROXY_ERRORS_DIR": "/errors"}
+	pages := &errorPages{Pages: []errorPage{{Status: 503}, {Status: 502, Backend: "api"}, {Status: 504, Backend: "gone"}}, Maintenance: true}
+	out, _, err := renderTemplate(string(text), kv, nil, pages, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{
+		"    timeout server 5000ms\n    errorfile 503 /errors/503.http\n",
+		// the tcp-request rules tracking the clients come before the http-request rules, and the maintenance denies
+		// the requests before they are rate limited
+		"\nfrontend www\n    bind *:80\n    mode http\n    tcp-request connection track-sc1 src table abuse\n    stick-table type ip size 100k expire 10m store http_req_rate(10s)\n    tcp-request connection track-sc0 src\n    errorfile 503 /errors/maintenance.http\n    http-request deny deny_status 503\n    http-request deny deny_status 429 if { sc_http_req_rate(0) gt 100 }\n",
+		"\nfrontend db\n    bind *:5432\n    mode tcp\n    option tcplog\n    tcp-request connection track-sc1 src table abuse\n    default_backend db\n",
+		"\nbackend api\n    mode http\n    balance roundrobin\n    errorfile 502 /errors/backends/api/502.http\n    server api1",
+	} {
+		if !strings.Contains(string(out), section) {
+			t.Errorf("expected the config to contain %q, got:\n%s", section, out)
+		}
+	}
+	if strings.Contains(string(out), "gone") {
+		t.Errorf("expected the page of a missing backend to be left out, got:\n%s", out)
+	}
+}
+
+func TestWatchKVRendersErrorPages(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	consul := newFakeConsul()
+	defer consul.Close()
+	previous := Source
+	Source = newConsulClient(consulSettings{Addr: consul.URL})
+	defer func() { Source = previous }()
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	s := &server{manager: testManager(rt)}
+	svc, _ := s.manager.service("")
+	template := testConfig + "    # rendered\n" + `{{range (loadBalancer "lb/").ErrorFiles}}    {{.}}` + "\n{{end}}"
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchKV(svc, quit)
+		close(done)
+	}()
+	defer func() {
+		quit <- struct{}{}
+		<-done
+	}()
+
+	rendered := func(line string) func() bool {
+		return func() bool {
+			config, err := ioutil.ReadFile(svc.configPath())
+			return err == nil && strings.Contains(string(config), line)
+		}
+	}
+	reloaded := func(times int) func() bool {
+		return func() bool {
+			return len(docker.receivedSignals(id)) == times
+		}
+	}
+	// the keys have to be read before there is anything to render again
+	waitFor(t, "the first render", rendered("# rendered\n"))
+	waitFor(t, "HAProxy to reload the first render", reloaded(1))
+	if _, err := s.SetErrorPage(context.Background(), &pb.SetErrorPageRequest{Status: 503, Body: []byte("<h1>Back soon</h1>")}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the config to refer to the page", rendered("    errorfile 503 /usr/local/etc/haproxy/errors/503.http\n"))
+	waitFor(t, "HAProxy to reload", reloaded(2))
+
+	// the config stays the same, but HAProxy only reads the new page when it reloads
+	if _, err := s.SetErrorPage(context.Background(), &pb.SetErrorPageRequest{Status: 503, Body: []byte("<h1>Back later</h1>")}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "HAProxy to reload the replaced page", reloaded(3))
+}
+
+func TestRenderReloadsOnceCatalogIsRead(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	if err := ioutil.WriteFile(svc.templatePath(), []byte(testConfig+`{{range service "web"}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a page was written, but the instances of web aren't known yet
+	if _, applied, err := svc.render(map[string]string{}, map[catalogQuery][]catalogInstance{}, true); err != nil || applied {
+		t.Fatalf("expected nothing to be applied before the catalog is read, got %v %v", applied, err)
+	}
+	if signals := docker.receivedSignals(id); len(signals) != 0 {
+		t.Errorf("expected no reload yet, got %v", signals)
+	}
+	catalog := map[catalogQuery][]catalogInstance{{Service: "web"}: {}}
+	if _, applied, err := svc.render(map[string]string{}, catalog, true); err != nil || !applied {
+		t.Fatalf("expected the config to be applied, got %v %v", applied, err)
+	}
+	if signals := docker.receivedSignals(id); !reflect.DeepEqual(signals, []string{"SIGHUP"}) {
+		t.Errorf("expected the unchanged config to be reloaded for the page, got %v", signals)
+	}
+}
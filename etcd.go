@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etcdKV reads keys from etcd v3 through its JSON gateway, watching for changes like a Consul blocking query
+type etcdKV struct {
+	addr   string
+	client *http.Client
+}
+
+func newEtcdKV(addr string) *etcdKV {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &etcdKV{
+		addr: strings.TrimSuffix(addr, "/"),
+		// watches are bounded by sourceWait through their context instead
+		client: &http.Client{},
+	}
+}
+
+// etcdHeader and etcdPair are the parts of the gateway's responses which are used, 64 bit integers are strings in its JSON
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// rangeEnd is the end of the range of keys starting with prefix
+func rangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// every key is after a prefix of only 0xff bytes, which "\x00" stands for
+	return "\x00"
+}
+
+func encodeKey(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+func (e *etcdKV) post(ctx context.Context, endpoint string, body interface{}) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.addr+endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s for %s", res.Status, endpoint)
+	}
+	return res, nil
+}
+
+// rangePrefix returns the keys under prefix and the revision of the store they were read at
+func (e *etcdKV) rangePrefix(ctx context.Context, prefix string) (map[string]string, uint64, error) {
+	res, err := e.post(ctx, "/v3/kv/range", map[string]string{"key": encodeKey(prefix), "range_end": encodeKey(rangeEnd(prefix))})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	var out struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []etcdPair `json:"kvs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	revision, err := strconv.ParseUint(out.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd returned an invalid revision: %q", out.Header.Revision)
+	}
+	kv := map[string]string{}
+	for _, pair := range out.Kvs {
+		key, err := base64.StdEncoding.DecodeString(pair.Key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("etcd returned an invalid key: %v", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("etcd returned an invalid value for %s: %v", key, err)
+		}
+		kv[string(key)] = string(value)
+	}
+	return kv, revision, nil
+}
+
+// waitForChange watches prefix from the revision after index, returning true once a key under it changes or the
+// history the watch starts from was compacted, and false if sourceWait passes first
+func (e *etcdKV) waitForChange(ctx context.Context, prefix string, index uint64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceWait)
+	defer cancel()
+	res, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            encodeKey(prefix),
+			"range_end":      encodeKey(rangeEnd(prefix)),
+			"start_revision": strconv.FormatUint(index+1, 10),
+		},
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, nil
+		}
+		return false, err
+	}
+	defer res.Body.Close()
+
+	// the gateway streams a JSON object per watch response
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var message struct {
+			Result struct {
+				CompactRevision string            `json:"compact_revision"`
+				Canceled        bool              `json:"canceled"`
+				Events          []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return false, err
+		}
+		if len(message.Result.Events) > 0 || message.Result.Canceled || (message.Result.CompactRevision != "" && message.Result.CompactRevision != "0") {
+			return true, nil
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("etcd closed the watch of %s", prefix)
+}
+
+func (e *etcdKV) list(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error) {
+	if index > 0 {
+		changed, err := e.waitForChange(ctx, prefix, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !changed {
+			return nil, index, nil
+		}
+	}
+	return e.rangePrefix(ctx, prefix)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd serves the range and watch endpoints of etcd's JSON gateway
+type fakeEtcd struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	revision uint64
+	kv       map[string]string
+	changed  chan struct{}
+}
+
+func newFakeEtcd() *fakeEtcd {
+	e := &fakeEtcd{revision: 1, kv: map[string]string{}, changed: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", e.serveRange)
+	mux.HandleFunc("/v3/watch", e.serveWatch)
+	e.Server = httptest.NewServer(mux)
+	return e
+}
+
+func (e *fakeEtcd) put(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.kv[key] = value
+	e.revision++
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func decodeKey(t string) string {
+	key, _ := base64.StdEncoding.DecodeString(t)
+	return string(key)
+}
+
+func (e *fakeEtcd) serveRange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key      string `json:"key"`
+		RangeEnd string `json:"range_end"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	key, end := decodeKey(req.Key), decodeKey(req.RangeEnd)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kvs := []etcdPair{}
+	for k, v := range e.kv {
+		if k >= key && k < end {
+			kvs = append(kvs, etcdPair{Key: encodeKey(k), Value: encodeKey(v)})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"header": etcdHeader{Revision: strconv.FormatUint(e.revision, 10)},
+		"kvs":    kvs,
+	})
+}
+
+// serveWatch only reports that something changed after the start revision, which is all the client looks at
+func (e *fakeEtcd) serveWatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CreateRequest struct {
+			StartRevision string `json:"start_revision"`
+		} `json:"create_request"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	start, _ := strconv.ParseUint(req.CreateRequest.StartRevision, 10, 64)
+
+	fmt.Fprintln(w, `{"result":{"created":true}}`)
+	w.(http.Flusher).Flush()
+	e.mu.Lock()
+	for e.revision < start {
+		changed := e.changed
+		e.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		e.mu.Lock()
+	}
+	e.mu.Unlock()
+	fmt.Fprintln(w, `{"result":{"events":[{"type":"PUT"}]}}`)
+}
+
+func TestRangeEnd(t *testing.T) {
+	tests := map[string]string{
+		"svc/":   "svc0",
+		"a\xff":  "b",
+		"\xff":   "\x00",
+		"web/01": "web/02",
+	}
+	for prefix, end := range tests {
+		if got := rangeEnd(prefix); got != end {
+			t.Errorf("%q: expected %q, got %q", prefix, end, got)
+		}
+	}
+}
+
+func TestEtcdKVList(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+	etcd.put("svc/a", "1")
+	etcd.put("svc0", "outside")
+
+	kv := newEtcdKV(strings.TrimPrefix(etcd.URL, "http://"))
+	pairs, index, err := kv.list(context.Background(), "svc/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || pairs["svc/a"] != "1" || index != 3 {
+		t.Errorf("unexpected keys at %d: %v", index, pairs)
+	}
+
+	changed := make(chan map[string]string)
+	go func() {
+		pairs, _, _ := kv.list(context.Background(), "svc/", index)
+		changed <- pairs
+	}()
+	select {
+	case <-changed:
+		t.Fatal("expected the list to wait for a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	etcd.put("svc/b", "2")
+	select {
+	case pairs := <-changed:
+		if pairs["svc/b"] != "2" {
+			t.Errorf("expected the new key, got %v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch didn't return")
+	}
+}
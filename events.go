@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// eventLogSize is how many events are kept per runtime
+const eventLogSize = 200
+
+// workloadEvent is a lifecycle event of a managed workload, such as it dying or being OOM killed
+type workloadEvent struct {
+	Time     time.Time
+	Name     string
+	ID       string
+	Action   string
+	ExitCode int64
+	Signal   string
+	Health   string
+	// RenderError is set on the render_error events of services
+	RenderError *renderError
+	// Ban is set on the ban and unban events of services
+	Ban *abuseBan
+	// Error is set on the start_error, stop_error and reconcile_error events of services
+	Error string
+}
+
+// workloadExit describes why a workload exited
+type workloadExit struct {
+	Code      int64
+	OOMKilled bool
+	// Signal is the last signal sent to the workload before it exited, if any
+	Signal string
+	// External is set when the workload was killed by someone other than the manager, e.g. docker rm
+	External bool
+	// Unhealthy is set when the manager stopped the workload for failing its health checks
+	Unhealthy bool
+}
+
+// eventLog keeps the most recent workload events
+type eventLog struct {
+	mu     sync.Mutex
+	events []workloadEvent
+}
+
+func (l *eventLog) record(ev workloadEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, ev)
+	if len(l.events) > eventLogSize {
+		l.events = l.events[len(l.events)-eventLogSize:]
+	}
+}
+
+// list returns the recorded events of the workload with the given name, oldest first
+func (l *eventLog) list(name string) []workloadEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := []workloadEvent{}
+	for _, ev := range l.events {
+		if ev.Name == name {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// signalName turns a signal number, as reported in Docker's kill events, into its name
+func signalName(signal string) string {
+	n, err := strconv.Atoi(signal)
+	if err != nil {
+		return signal
+	}
+	for name, sig := range signalsByName {
+		if int(sig) == n {
+			return name
+		}
+	}
+	return "SIG" + strconv.Itoa(n)
+}
+
+func eventsToProto(events []workloadEvent) []*pb.WorkloadEvent {
+	out := []*pb.WorkloadEvent{}
+	for _, ev := range events {
+		out = append(out, &pb.WorkloadEvent{
+			Timestamp:   ev.Time.UnixNano(),
+			Name:        ev.Name,
+			Id:          ev.ID,
+			Action:      ev.Action,
+			ExitCode:    ev.ExitCode,
+			Signal:      ev.Signal,
+			Health:      ev.Health,
+			RenderError: renderErrorToProto(ev.RenderError),
+			Ban:         banToProto(ev.Ban),
+			Error:       ev.Error,
+		})
+	}
+	return out
+}
+
+func renderErrorToProto(err *renderError) *pb.RenderError {
+	if err == nil {
+		return nil
+	}
+	return &pb.RenderError{
+		Kind:      err.Kind,
+		Message:   err.Err.Error(),
+		Output:    err.Output,
+		Timestamp: err.Time.UnixNano(),
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// fakeDocker is an in-memory stand-in for the Docker daemon, used by the --simulate mode and the tests.
+// Containers don't run anything: they stay running until they are killed, stopped or exited through exitContainer.
+type fakeDocker struct {
+	mu          sync.Mutex
+	nextID      int
+	containers  map[string]*fakeContainer
+	subscribers []*fakeSubscriber
+	// checkFailure makes the containers of checks fail with this output, when set
+	checkFailure string
+	// startFailure is returned by the starts of containers other than checks, when set
+	startFailure error
+	// networks are the names of the user defined networks
+	networks []string
+}
+
+// fakeSubscriber is a consumer of the fakeDocker's events stream
+type fakeSubscriber struct {
+	ctx      context.Context
+	filters  filters.Args
+	messages chan events.Message
+}
+
+// fakeContainer is a container known to the fakeDocker
+type fakeContainer struct {
+	id         string
+	name       string
+	config     *container.Config
+	hostConfig *container.HostConfig
+	// networks are the container's addresses by network
+	networks   map[string]*network.EndpointSettings
+	running    bool
+	exitCode   int
+	startedAt  time.Time
+	finishedAt time.Time
+	signals    []string
+	exited     chan struct{}
+	health     *dockerTypes.Health
+	output     string
+}
+
+type fakeNotFoundError struct {
+	id string
+}
+
+func (e fakeNotFoundError) NotFound() bool {
+	return true
+}
+
+func (e fakeNotFoundError) Error() string {
+	return fmt.Sprintf("Error: No such container: %s", e.id)
+}
+
+type fakeNetworkNotFoundError struct {
+	id string
+}
+
+func (e fakeNetworkNotFoundError) NotFound() bool {
+	return true
+}
+
+func (e fakeNetworkNotFoundError) Error() string {
+	return fmt.Sprintf("Error: No such network: %s", e.id)
+}
+
+// signalExitCodes are the exit codes of containers terminated by a signal, other signals leave the container running
+var signalExitCodes = map[string]int{
+	"SIGINT":  130,
+	"SIGKILL": 137,
+	"SIGTERM": 143,
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: map[string]*fakeContainer{},
+	}
+}
+
+// find looks a container up by ID, ID prefix or name, the caller must hold the lock
+func (d *fakeDocker) find(idOrName string) *fakeContainer {
+	name := strings.TrimPrefix(idOrName, "/")
+	for _, c := range d.containers {
+		if c.name == name || c.id == idOrName || (len(idOrName) >= 10 && strings.HasPrefix(c.id, idOrName)) {
+			return c
+		}
+	}
+	return nil
+}
+
+// publish sends a container event to the subscribers. The caller must hold the lock.
+func (d *fakeDocker) publish(c *fakeContainer, action string, attributes map[string]string) {
+	attrs := map[string]string{
+		"name":  c.name,
+		"image": c.config.Image,
+	}
+	for k, v := range c.config.Labels {
+		attrs[k] = v
+	}
+	for k, v := range attributes {
+		attrs[k] = v
+	}
+	d.send(events.Message{
+		Status: action,
+		ID:     c.id,
+		From:   c.config.Image,
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: c.id, Attributes: attrs},
+	})
+}
+
+// publishNetwork sends the event of a container connecting to or disconnecting from a network. The caller must hold
+// the lock.
+func (d *fakeDocker) publishNetwork(networkName, action string, c *fakeContainer) {
+	d.send(events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor:  events.Actor{ID: networkName, Attributes: map[string]string{"name": networkName, "type": "bridge", "container": c.id}},
+	})
+}
+
+// send timestamps an event and sends it to the subscribers whose filters match it. The caller must hold the lock.
+func (d *fakeDocker) send(msg events.Message) {
+	now := time.Now()
+	msg.Time = now.Unix()
+	msg.TimeNano = now.UnixNano()
+	attrs := msg.Actor.Attributes
+	live := []*fakeSubscriber{}
+	for _, sub := range d.subscribers {
+		if sub.ctx.Err() != nil {
+			continue
+		}
+		live = append(live, sub)
+		if sub.filters.Len() > 0 && !sub.filters.Match("type", msg.Type) {
+			continue
+		}
+		if sub.filters.Len() > 0 && !sub.filters.MatchKVList("label", attrs) {
+			continue
+		}
+		select {
+		case sub.messages <- msg:
+		case <-sub.ctx.Done():
+		}
+	}
+	d.subscribers = live
+}
+
+// exit stops a running container with the given exit code, removing it when AutoRemove is set. The caller must hold the lock.
+func (d *fakeDocker) exit(c *fakeContainer, exitCode int) {
+	if !c.running {
+		return
+	}
+	c.running = false
+	c.exitCode = exitCode
+	c.finishedAt = time.Now()
+	close(c.exited)
+	d.publish(c, "die", map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	if c.hostConfig.AutoRemove {
+		delete(d.containers, c.id)
+		d.publish(c, "destroy", nil)
+	}
+}
+
+// oomKill makes a running container exit as if the kernel had killed it for running out of memory
+func (d *fakeDocker) oomKill(idOrName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(idOrName)
+	if c == nil {
+		return fakeNotFoundError{idOrName}
+	}
+	d.publish(c, "oom", nil)
+	d.exit(c, signalExitCodes["SIGKILL"])
+	return nil
+}
+
+// exitContainer makes a running container exit with the given code, as if its process had exited
+func (d *fakeDocker) exitContainer(idOrName string, exitCode int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(idOrName)
+	if c == nil {
+		return fakeNotFoundError{idOrName}
+	}
+	d.exit(c, exitCode)
+	return nil
+}
+
+// probe records the result of a health probe of a running container, updating its health status as Docker does
+func (d *fakeDocker) probe(idOrName string, exitCode int, output string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(idOrName)
+	if c == nil {
+		return fakeNotFoundError{idOrName}
+	}
+	if c.health == nil {
+		return fmt.Errorf("container %s has no healthcheck", idOrName)
+	}
+	now := time.Now()
+	c.health.Log = append(c.health.Log, &dockerTypes.HealthcheckResult{Start: now, End: now, ExitCode: exitCode, Output: output})
+	if len(c.health.Log) > healthLogSize {
+		c.health.Log = c.health.Log[len(c.health.Log)-healthLogSize:]
+	}
+	previous := c.health.Status
+	if exitCode == 0 {
+		c.health.FailingStreak = 0
+		c.health.Status = dockerTypes.Healthy
+	} else {
+		c.health.FailingStreak++
+		if c.health.FailingStreak >= c.config.Healthcheck.Retries {
+			c.health.Status = dockerTypes.Unhealthy
+		}
+	}
+	if c.health.Status != previous {
+		d.publish(c, "health_status: "+c.health.Status, nil)
+	}
+	return nil
+}
+
+// failChecks makes the following checks fail with output, or pass again when output is empty
+func (d *fakeDocker) failChecks(output string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checkFailure = output
+}
+
+// failStarts makes the following starts of containers fail with err, or succeed again when err is nil
+func (d *fakeDocker) failStarts(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.startFailure = err
+}
+
+// receivedSignals returns the signals sent to a container which didn't terminate it
+func (d *fakeDocker) receivedSignals(idOrName string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(idOrName)
+	if c == nil {
+		return nil
+	}
+	return append([]string{}, c.signals...)
+}
+
+func (d *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if containerName != "" && d.find(containerName) != nil {
+		return container.ContainerCreateCreatedBody{}, fmt.Errorf("Conflict. The container name %q is already in use", "/"+containerName)
+	}
+	// Docker reports the bridge network of a container created without a network mode as the default one
+	hostConfigCopy := *hostConfig
+	if hostConfigCopy.NetworkMode == "" {
+		hostConfigCopy.NetworkMode = "default"
+	}
+	hostConfig = &hostConfigCopy
+	d.nextID++
+	c := &fakeContainer{
+		id:         fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.Itoa(d.nextID)))),
+		name:       containerName,
+		config:     config,
+		hostConfig: hostConfig,
+		networks:   map[string]*network.EndpointSettings{},
+		exited:     make(chan struct{}),
+	}
+	if networkingConfig != nil {
+		for name := range networkingConfig.EndpointsConfig {
+			if !containsString(d.networks, name) {
+				return container.ContainerCreateCreatedBody{}, fakeNetworkNotFoundError{name}
+			}
+			// every container gets its own address, whichever network it is on
+			c.networks[name] = &network.EndpointSettings{NetworkID: name, IPAddress: fmt.Sprintf("172.18.%d.%d", d.nextID/250, d.nextID%250+2)}
+		}
+	}
+	d.containers[c.id] = c
+	d.publish(c, "create", nil)
+	return container.ContainerCreateCreatedBody{ID: c.id}, nil
+}
+
+func (d *fakeDocker) ContainerStart(ctx context.Context, containerID string, options dockerTypes.ContainerStartOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	if d.startFailure != nil && c.config.Labels[checkLabel] == "" {
+		return d.startFailure
+	}
+	if !c.running {
+		c.running = true
+		c.startedAt = time.Now()
+		c.exited = make(chan struct{})
+		if hc := c.config.Healthcheck; hc != nil && len(hc.Test) > 0 && hc.Test[0] != "NONE" {
+			c.health = &dockerTypes.Health{Status: dockerTypes.Starting}
+		}
+		d.publish(c, "start", nil)
+		if c.config.Labels[checkLabel] != "" {
+			// checks are done as soon as they start
+			exitCode := 0
+			c.output = "Configuration file is valid\n"
+			if d.checkFailure != "" {
+				exitCode = 1
+				c.output = d.checkFailure + "\n"
+			}
+			d.exit(c, exitCode)
+		}
+	}
+	return nil
+}
+
+func (d *fakeDocker) ContainerKill(ctx context.Context, containerID, signal string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	if !c.running {
+		return fmt.Errorf("Cannot kill container: %s: Container %s is not running", containerID, c.id)
+	}
+	if sig, err := parseSignal(signal); err == nil {
+		d.publish(c, "kill", map[string]string{"signal": strconv.Itoa(int(sig))})
+	}
+	if exitCode, ok := signalExitCodes[signal]; ok {
+		d.exit(c, exitCode)
+		return nil
+	}
+	c.signals = append(c.signals, signal)
+	return nil
+}
+
+func (d *fakeDocker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	d.publish(c, "kill", map[string]string{"signal": "15"})
+	d.exit(c, signalExitCodes["SIGTERM"])
+	return nil
+}
+
+func (d *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options dockerTypes.ContainerRemoveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	if c.running {
+		if !options.Force {
+			return fmt.Errorf("You cannot remove a running container %s. Stop the container before attempting removal or force remove", c.id)
+		}
+		d.publish(c, "kill", map[string]string{"signal": "9"})
+		d.exit(c, signalExitCodes["SIGKILL"])
+	}
+	if d.containers[c.id] != nil {
+		delete(d.containers, c.id)
+		d.publish(c, "destroy", nil)
+	}
+	return nil
+}
+
+func (d *fakeDocker) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	resultC := make(chan container.ContainerWaitOKBody, 1)
+	errC := make(chan error, 1)
+
+	d.mu.Lock()
+	c := d.find(containerID)
+	var exited chan struct{}
+	if c != nil {
+		exited = c.exited
+	}
+	d.mu.Unlock()
+	if c == nil {
+		errC <- fakeNotFoundError{containerID}
+		return resultC, errC
+	}
+
+	go func() {
+		select {
+		case <-exited:
+			d.mu.Lock()
+			exitCode := c.exitCode
+			d.mu.Unlock()
+			resultC <- container.ContainerWaitOKBody{StatusCode: int64(exitCode)}
+		case <-ctx.Done():
+			errC <- ctx.Err()
+		}
+	}()
+	return resultC, errC
+}
+
+func (d *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (dockerTypes.ContainerJSON, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return dockerTypes.ContainerJSON{}, fakeNotFoundError{containerID}
+	}
+	status := "exited"
+	if c.running {
+		status = "running"
+	}
+	return dockerTypes.ContainerJSON{
+		ContainerJSONBase: &dockerTypes.ContainerJSONBase{
+			ID:   c.id,
+			Name: "/" + c.name,
+			State: &dockerTypes.ContainerState{
+				Status:     status,
+				Running:    c.running,
+				ExitCode:   c.exitCode,
+				StartedAt:  c.startedAt.Format(time.RFC3339Nano),
+				FinishedAt: c.finishedAt.Format(time.RFC3339Nano),
+				Health:     c.inspectHealth(),
+			},
+			Image:      c.config.Image,
+			HostConfig: c.hostConfig,
+		},
+		Config:          c.config,
+		NetworkSettings: &dockerTypes.NetworkSettings{Networks: c.copyNetworks()},
+	}, nil
+}
+
+// copyNetworks copies the networks of a container for ContainerInspect and ContainerList. The caller must hold the lock.
+func (c *fakeContainer) copyNetworks() map[string]*network.EndpointSettings {
+	networks := map[string]*network.EndpointSettings{}
+	for name, endpoint := range c.networks {
+		copied := *endpoint
+		networks[name] = &copied
+	}
+	return networks
+}
+
+// inspectHealth copies the health of a container for ContainerInspect. The caller must hold the lock.
+func (c *fakeContainer) inspectHealth() *dockerTypes.Health {
+	if c.health == nil {
+		return nil
+	}
+	health := *c.health
+	health.Log = append([]*dockerTypes.HealthcheckResult{}, c.health.Log...)
+	return &health
+}
+
+func (d *fakeDocker) ContainerList(ctx context.Context, options dockerTypes.ContainerListOptions) ([]dockerTypes.Container, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := options.Filters.Get("name")
+	containers := []dockerTypes.Container{}
+	for _, c := range d.containers {
+		if !c.running && !options.All {
+			continue
+		}
+		matches := len(names) == 0
+		for _, name := range names {
+			if strings.Contains(c.name, name) {
+				matches = true
+			}
+		}
+		if !matches || !options.Filters.MatchKVList("label", c.config.Labels) {
+			continue
+		}
+		state := "exited"
+		if c.running {
+			state = "running"
+		}
+		containers = append(containers, dockerTypes.Container{
+			ID:              c.id,
+			Names:           []string{"/" + c.name},
+			Image:           c.config.Image,
+			Labels:          c.config.Labels,
+			State:           state,
+			Ports:           fakePublishedPorts(c.hostConfig.PortBindings),
+			NetworkSettings: &dockerTypes.SummaryNetworkSettings{Networks: c.copyNetworks()},
+		})
+	}
+	return containers, nil
+}
+
+func fakePublishedPorts(bindings nat.PortMap) []dockerTypes.Port {
+	ports := []dockerTypes.Port{}
+	for port, portBindings := range bindings {
+		for _, binding := range portBindings {
+			hostPort, _ := nat.ParsePort(binding.HostPort)
+			ports = append(ports, dockerTypes.Port{
+				IP:          normalizeHostIP(binding.HostIP),
+				PrivatePort: uint16(port.Int()),
+				PublicPort:  uint16(hostPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+	return ports
+}
+
+func (d *fakeDocker) ContainerStats(ctx context.Context, containerID string, stream bool) (dockerTypes.ContainerStats, error) {
+	d.mu.Lock()
+	c := d.find(containerID)
+	d.mu.Unlock()
+	if c == nil {
+		return dockerTypes.ContainerStats{}, fakeNotFoundError{containerID}
+	}
+	stats := dockerTypes.StatsJSON{}
+	stats.PidsStats.Current = 1
+	stats.MemoryStats.Usage = 16 << 20
+	stats.MemoryStats.Limit = uint64(c.hostConfig.Memory)
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return dockerTypes.ContainerStats{}, err
+	}
+	return dockerTypes.ContainerStats{Body: ioutil.NopCloser(bytes.NewReader(data)), OSType: "linux"}, nil
+}
+
+func (d *fakeDocker) ContainerLogs(ctx context.Context, container string, options dockerTypes.ContainerLogsOptions) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(container)
+	if c == nil {
+		return nil, fakeNotFoundError{container}
+	}
+	// the output is framed as a stdout stream, as Docker does for containers without a TTY
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(len(c.output)))
+	return ioutil.NopCloser(bytes.NewReader(append(header, c.output...))), nil
+}
+
+func (d *fakeDocker) ImagePull(ctx context.Context, refStr string, options dockerTypes.ImagePullOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(`{"status":"Image is up to date for ` + refStr + `"}`)), nil
+}
+
+func (d *fakeDocker) NetworkCreate(ctx context.Context, name string, options dockerTypes.NetworkCreate) (dockerTypes.NetworkCreateResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if containsString(d.networks, name) {
+		return dockerTypes.NetworkCreateResponse{}, fmt.Errorf("network with name %s already exists", name)
+	}
+	d.networks = append(d.networks, name)
+	return dockerTypes.NetworkCreateResponse{ID: name}, nil
+}
+
+func (d *fakeDocker) NetworkInspect(ctx context.Context, networkID string, options dockerTypes.NetworkInspectOptions) (dockerTypes.NetworkResource, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !containsString(d.networks, networkID) {
+		return dockerTypes.NetworkResource{}, fakeNetworkNotFoundError{networkID}
+	}
+	return dockerTypes.NetworkResource{Name: networkID, ID: networkID, Driver: "bridge"}, nil
+}
+
+// NetworkConnect connects a container to a network, as the Docker client does
+func (d *fakeDocker) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !containsString(d.networks, networkID) {
+		return fakeNetworkNotFoundError{networkID}
+	}
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	if c.networks[networkID] != nil {
+		return fmt.Errorf("endpoint with name %s already exists in network %s", c.name, networkID)
+	}
+	d.nextID++
+	c.networks[networkID] = &network.EndpointSettings{NetworkID: networkID, IPAddress: fmt.Sprintf("172.18.%d.%d", d.nextID/250, d.nextID%250+2)}
+	d.publishNetwork(networkID, "connect", c)
+	return nil
+}
+
+// NetworkDisconnect disconnects a container from a network, as the Docker client does
+func (d *fakeDocker) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(containerID)
+	if c == nil {
+		return fakeNotFoundError{containerID}
+	}
+	if c.networks[networkID] == nil {
+		return fmt.Errorf("container %s is not connected to network %s", containerID, networkID)
+	}
+	delete(c.networks, networkID)
+	d.publishNetwork(networkID, "disconnect", c)
+	return nil
+}
+
+func (d *fakeDocker) Events(ctx context.Context, options dockerTypes.EventsOptions) (<-chan events.Message, <-chan error) {
+	sub := &fakeSubscriber{
+		ctx:      ctx,
+		filters:  options.Filters,
+		messages: make(chan events.Message, 100),
+	}
+	errs := make(chan error, 1)
+	d.mu.Lock()
+	d.subscribers = append(d.subscribers, sub)
+	d.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return sub.messages, errs
+}
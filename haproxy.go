@@ -1,130 +1,159 @@
 package main
 
 import (
-	"context"
-	"io/ioutil"
+	"fmt"
 	"log"
-
-	"path/filepath"
-
-	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
-	dockerClient "github.com/docker/docker/client"
-	"github.com/docker/go-connections/nat"
+	"time"
 )
 
-func ensureService(dockerCli *dockerClient.Client, quit chan struct{}) {
+func ensureService(svc *service, quit chan struct{}) {
+	backoff := &restartBackoff{}
 	for {
 		select {
 		case <-quit:
 			return
 		default:
-			startService(dockerCli)
+			exit, ranFor := startService(svc)
+			if !sleepOrQuit(backoff.next("HAProxy for "+svc.Name, exit, ranFor), quit) {
+				return
+			}
 		}
 	}
 }
 
-func startService(dockerCli *dockerClient.Client) {
-	alreadyRunning, _, err := isContainerRunning(dockerCli, "com.opencopilot.service."+ServiceName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if alreadyRunning {
-		log.Println("HAProxy already running, stopping")
-		stopService(dockerCli)
+// haproxySpec is the spec of the service's HAProxy, publishing the ports its config binds. It fails when the bind
+// lines can't be read, rather than dropping the ports.
+func haproxySpec(svc *service) (workloadSpec, error) {
+	spec := haproxyWorkload(svc)
+	if !spec.HostNetwork {
+		addrs, err := parseBindAddrs(svc.configPath())
+		if err != nil {
+			return workloadSpec{}, fmt.Errorf("unable to read the ports of %s: %v", svc.Name, err)
+		}
+		spec.Ports = addrs
 	}
-	log.Println("starting HAProxy")
+	return spec, nil
+}
+
+// haproxyWorkload is the spec of the service's HAProxy, without its ports
+func haproxyWorkload(svc *service) workloadSpec {
+	configFilePath := svc.configPath()
 
-	ctx := context.Background()
+	limits := HAProxyLimits.forMaxconn(globalMaxconn(configFilePath))
 
-	containerConfig := &container.Config{
+	return workloadSpec{
+		Name:  svc.haproxyName(),
 		Image: "haproxy:1.8.9",
 		Labels: map[string]string{
-			"com.opencopilot.service." + ServiceName: "haproxy",
+			svc.label(): "haproxy",
 		},
-		ExposedPorts: nat.PortSet{
-			"80/tcp":   struct{}{},
-			"8080/tcp": struct{}{},
+		Binds: []string{
+			svc.confDir() + ":/usr/local/etc/haproxy",
 		},
+		// the same flags the haproxy image's entrypoint adds: master-worker mode, in the foreground
+		Command:     []string{HAProxyBin, "-W", "-db", "-f", configFilePath},
+		HostNetwork: HAProxyNetworkMode == "host",
+		Network:     DiscoveryNetwork,
+		Limits:      &limits,
+		Healthcheck: haproxyHealthcheck(configFilePath),
 	}
+}
 
-	reader, err := dockerCli.ImagePull(ctx, containerConfig.Image, dockerTypes.ImagePullOptions{})
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer reader.Close()
-	if _, err := ioutil.ReadAll(reader); err != nil {
-		log.Panic(err)
+// checkSpec checks the HAProxy config at path, a file in the service's config dir
+func checkSpec(svc *service, path string) workloadSpec {
+	spec := haproxyWorkload(svc)
+	return workloadSpec{
+		Name:    svc.checkName(),
+		Image:   spec.Image,
+		Cmd:     []string{"haproxy", "-c", "-f", svc.haproxyPath(path)},
+		Command: []string{HAProxyBin, "-c", "-f", path},
+		Binds:   spec.Binds,
+		// the check doesn't bind the ports, so it doesn't need the host network either
 	}
+}
 
-	hostConfig := &container.HostConfig{
-		// RestartPolicy: container.RestartPolicy{Name: "always"},
-		AutoRemove: true,
-		Binds: []string{
-			filepath.Join(ConfigDir, "/services/", ServiceName) + ":/usr/local/etc/haproxy",
-		},
-		PortBindings: nat.PortMap{
-			"80/tcp": []nat.PortBinding{
-				{HostIP: "0.0.0.0", HostPort: "80"},
-			},
-			"8080/tcp": []nat.PortBinding{
-				{HostIP: "127.0.0.1", HostPort: "8080"},
-			},
-		},
+func startService(svc *service) (workloadExit, time.Duration) {
+	log.Printf("ensuring HAProxy is running for %s\n", svc.Name)
+
+	spec, err := haproxySpec(svc)
+	if err != nil {
+		svc.recordWorkloadError("start_error", err)
+		return workloadExit{Code: -1}, 0
 	}
-	res, err := dockerCli.ContainerCreate(ctx, containerConfig, hostConfig, nil, "com.opencopilot.service."+ServiceName)
+	id, err := svc.rt.Start(spec)
 	if err != nil {
-		log.Println(err)
+		// the supervisor retries with a backoff, as for HAProxy exiting right after it started
+		svc.recordWorkloadError("start_error", err)
+		return workloadExit{Code: -1}, 0
 	}
-
-	startErr := dockerCli.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{})
-	if startErr != nil {
-		log.Fatal(startErr)
+	started := time.Now()
+
+	log.Printf("HAProxy running with ID: %s\n", shortID(id))
+
+	unhealthy := make(chan bool, 1)
+	exited := make(chan struct{})
+	go func() {
+		unhealthy <- watchHealth(svc.rt, "HAProxy for "+svc.Name, spec, id, exited)
+	}()
+	exit, err := svc.rt.Wait(id)
+	close(exited)
+	exit.Unhealthy = <-unhealthy
+	if err != nil {
+		log.Printf("lost track of HAProxy: %v\n", err)
+		return workloadExit{Code: -1}, time.Since(started)
+	}
+	log.Printf("HAProxy %s\n", describeExit(exit))
+	if exit.Code != 0 {
+		logWorkloadOutput(svc.rt, spec.Name)
 	}
+	return exit, time.Since(started)
+}
 
-	log.Printf("HAProxy container started with ID: %s\n", res.ID[:10])
+func stopService(svc *service) error {
+	log.Printf("stopping HAProxy for %s\n", svc.Name)
 
-	waitForContainerStop(dockerCli, res.ID)
+	if err := svc.rt.Stop(svc.haproxyName()); err != nil {
+		svc.recordWorkloadError("stop_error", err)
+		return err
+	}
+	return nil
 }
 
-func stopService(dockerCli *dockerClient.Client) {
-	log.Println("stopping HAProxy")
+func configureService(svc *service) {
+	log.Println("configuring " + svc.Name)
+	// send a SIGHUP to the service to have it reload the config
+	if err := svc.rt.Signal(svc.haproxyName(), "SIGHUP"); err != nil {
+		log.Println(err)
+	}
+}
 
-	ctx := context.Background()
-	args := filters.NewArgs(
-		filters.Arg("name", "com.opencopilot.service."+ServiceName),
-	)
-	containers, err := dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+// reconcileService replaces HAProxy when the config requires a different spec (such as a new port set),
+// otherwise the running HAProxy is told to reload its config
+func reconcileService(svc *service) {
+	spec, err := haproxySpec(svc)
 	if err != nil {
-		log.Fatal(err)
-
+		// the running HAProxy keeps its ports
+		svc.recordWorkloadError("reconcile_error", err)
+		return
+	}
+	state, err := svc.rt.Inspect(spec.Name)
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	for _, container := range containers {
-		dockerCli.ContainerKill(ctx, container.ID, "SIGTERM")
-		// dockerCli.ContainerStop(ctx, container.ID, nil)
-		log.Printf("removing container with ID: %s\n", container.ID[:10])
+	if state == nil || !state.Running {
+		// the supervisor starts it with the new spec
+		return
 	}
-}
-
-func configureService(dockerCli *dockerClient.Client) {
-	log.Println("configuring " + ServiceName)
-	// Go find the docker container running the service and send a SIGHUP to have it reload the config
-	ctx := context.Background()
-	args := filters.NewArgs(
-		filters.Arg("label", "com.opencopilot.service="+ServiceName),
-		filters.Arg("name", "com.opencopilot.service."+ServiceName),
-	)
-	containers, err := dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+	id, err := svc.rt.Start(spec)
 	if err != nil {
-		log.Fatal(err)
-
+		// the running HAProxy is left as it is
+		svc.recordWorkloadError("reconcile_error", err)
+		return
 	}
-	for _, container := range containers {
-		dockerCli.ContainerKill(ctx, container.ID, "SIGHUP")
+	if id != state.ID {
+		log.Printf("HAProxy spec changed, replaced %s with %s\n", shortID(state.ID), shortID(id))
+		return
 	}
+	configureService(svc)
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+func TestEnsureServiceRestartsExitedContainer(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	name := testHAProxySpec(t, svc).Name
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		ensureService(svc, quit)
+		close(done)
+	}()
+
+	first := waitForRunning(t, docker, name, "")
+	if err := docker.oomKill(name); err != nil {
+		t.Fatal(err)
+	}
+	second := waitForRunning(t, docker, name, first)
+
+	quit <- struct{}{}
+	if err := docker.exitContainer(second, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor didn't stop")
+	}
+}
+
+func TestEnsureServiceRetriesFailedStarts(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	name := testHAProxySpec(t, svc).Name
+	docker.failStarts(errors.New("driver failed programming external connectivity: port is already allocated"))
+
+	quit := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		ensureService(svc, quit)
+		close(done)
+	}()
+
+	waitFor(t, "a start_error event", func() bool {
+		for _, ev := range svc.events.list(svc.Name) {
+			if ev.Action == "start_error" && strings.Contains(ev.Error, "port is already allocated") {
+				return true
+			}
+		}
+		return false
+	})
+	docker.failStarts(nil)
+	id := waitForRunning(t, docker, name, "")
+
+	quit <- struct{}{}
+	if err := docker.exitContainer(id, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor didn't stop")
+	}
+}
+
+func TestStartAdoptsMatchingContainer(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	first, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected the running container %s to be adopted, got %s", first, second)
+	}
+
+	spec := testHAProxySpec(t, svc)
+	spec.Image = "haproxy:1.8.10"
+	third, err := rt.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Error("expected a container with a different image to be replaced")
+	}
+}
+
+func TestHAProxySpecFollowsBindLines(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	cs, err := rt.containerSpec(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nat.PortMap{
+		"80/tcp":   []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "80"}},
+		"8080/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+	}
+	if !reflect.DeepEqual(cs.HostConfig.PortBindings, expected) {
+		t.Errorf("unexpected port bindings: %v", cs.HostConfig.PortBindings)
+	}
+	if nofile := cs.HostConfig.Ulimits[0].Soft; nofile != 2*500+nofileHeadroom {
+		t.Errorf("expected the nofile ulimit to follow maxconn, got %d", nofile)
+	}
+}
+
+func TestHAProxySpecFailsOnConflictingPorts(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	publishPort(t, docker, "web", "80")
+
+	_, err := rt.containerSpec(testHAProxySpec(t, svc))
+	if err == nil || !strings.Contains(err.Error(), "0.0.0.0:80") {
+		t.Errorf("expected port 80 to be reported as in use by another container, got %v", err)
+	}
+}
+
+func TestReconcileServiceSignalsReload(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconcileService(svc)
+
+	if signals := docker.receivedSignals(id); !reflect.DeepEqual(signals, []string{"SIGHUP"}) {
+		t.Errorf("expected a single SIGHUP, got %v", signals)
+	}
+}
+
+func TestReconcileServiceRecreatesOnPortChange(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, testConfig+"    bind *:443\n")
+	reconcileService(svc)
+
+	existing, err := docker.ContainerInspect(context.Background(), testHAProxySpec(t, svc).Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.ID == id {
+		t.Fatal("expected the container to be replaced")
+	}
+	if _, ok := existing.HostConfig.PortBindings["443/tcp"]; !ok {
+		t.Errorf("expected port 443 to be published, got %v", existing.HostConfig.PortBindings)
+	}
+	if len(docker.receivedSignals(existing.ID)) != 0 {
+		t.Error("expected the new container not to be signalled")
+	}
+}
+
+func TestReconcileServiceKeepsContainerOnPortConflict(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishPort(t, docker, "web", "443")
+	writeConfig(t, testConfig+"    bind *:443\n")
+	reconcileService(svc)
+
+	existing, err := docker.ContainerInspect(context.Background(), testHAProxySpec(t, svc).Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.ID != id {
+		t.Error("expected the running container to be kept")
+	}
+	if !hasEvent(svc, "reconcile_error", "0.0.0.0:443") {
+		t.Errorf("expected a reconcile_error event naming port 443, got %+v", svc.events.list(svc.Name))
+	}
+}
+
+func TestUnreadableBindLinesKeepContainer(t *testing.T) {
+	defer setupConfigDir(t, testConfig+"    bind *:http\n")()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	ctx := context.Background()
+
+	startService(svc)
+	if _, err := docker.ContainerInspect(ctx, svc.haproxyName()); err == nil {
+		t.Error("expected HAProxy not to be started")
+	}
+	if !hasEvent(svc, "start_error", `"*:http"`) {
+		t.Errorf("expected a start_error event naming the bind address, got %+v", svc.events.list(svc.Name))
+	}
+
+	writeConfig(t, testConfig)
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, testConfig+"    bind *:http\n")
+	reconcileService(svc)
+
+	existing, err := docker.ContainerInspect(ctx, svc.haproxyName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.ID != id {
+		t.Error("expected the running container to be kept")
+	}
+	if len(docker.receivedSignals(id)) != 0 {
+		t.Error("expected the running container not to be reloaded")
+	}
+	if !hasEvent(svc, "reconcile_error", `"*:http"`) {
+		t.Errorf("expected a reconcile_error event naming the bind address, got %+v", svc.events.list(svc.Name))
+	}
+}
+
+// publishPort starts a container named name that publishes the host port
+func publishPort(t *testing.T, docker *fakeDocker, name, port string) {
+	ctx := context.Background()
+	res, err := docker.ContainerCreate(ctx, &container.Config{Image: "nginx"}, &container.HostConfig{
+		PortBindings: nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostPort: port}}},
+	}, nil, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := docker.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hasEvent tells whether the service recorded an event with the action, whose error contains text
+func hasEvent(svc *service, action, text string) bool {
+	for _, ev := range svc.events.list(svc.Name) {
+		if ev.Action == action && strings.Contains(ev.Error, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// testHAProxySpec is the spec of the service's HAProxy, failing the test if it can't be made
+func testHAProxySpec(t *testing.T, svc *service) workloadSpec {
+	spec, err := haproxySpec(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+const (
+	// healthLogSize is how many probe results are kept per workload, the same as Docker keeps
+	healthLogSize = 5
+	// maxProbeOutput is how much of the output of a probe is kept, the same as Docker keeps
+	maxProbeOutput = 4096
+	// defaultStatsURI is the stats URI HAProxy uses when a stats section doesn't set one
+	defaultStatsURI = "/haproxy?stats"
+)
+
+// healthSettings configure the health probes of the managed workloads
+type healthSettings struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Retries is how many probes have to fail in a row for a workload to be unhealthy
+	Retries int
+	// RestartAfter is how many intervals a workload may stay unhealthy before it is restarted, 0 never restarts it
+	RestartAfter int
+	// HAProxyProbe is how HAProxy is probed: "stats", "socket" or "none"
+	HAProxyProbe string
+}
+
+// healthcheck is a probe run inside a workload, a shell command which exits with 0 while the workload is healthy
+type healthcheck struct {
+	Command  string
+	Interval time.Duration
+	Timeout  time.Duration
+	Retries  int
+}
+
+// workloadHealth is the outcome of the recent health probes of a workload
+type workloadHealth struct {
+	// Status is "starting", "healthy" or "unhealthy"
+	Status        string
+	FailingStreak int
+	Log           []healthProbe
+}
+
+// healthProbe is the result of a single health probe
+type healthProbe struct {
+	Start    time.Time
+	End      time.Time
+	ExitCode int
+	Output   string
+}
+
+// defaultHealthSettings are used for the settings which aren't set
+var defaultHealthSettings = healthSettings{
+	Interval:     10 * time.Second,
+	Timeout:      5 * time.Second,
+	Retries:      3,
+	RestartAfter: 3,
+	HAProxyProbe: "stats",
+}
+
+// parseHealthSettings reads the HEALTHCHECK_* settings, and HAPROXY_HEALTHCHECK
+func parseHealthSettings() (healthSettings, error) {
+	settings := defaultHealthSettings
+	durations := []struct {
+		setting string
+		value   string
+		dest    *time.Duration
+	}{
+		{"HEALTHCHECK_INTERVAL", HealthcheckInterval, &settings.Interval},
+		{"HEALTHCHECK_TIMEOUT", HealthcheckTimeout, &settings.Timeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration < 0 {
+			return settings, fmt.Errorf("invalid %s: %q", d.setting, d.value)
+		}
+		*d.dest = duration
+	}
+	counts := []struct {
+		setting string
+		value   string
+		dest    *int
+	}{
+		{"HEALTHCHECK_RETRIES", HealthcheckRetries, &settings.Retries},
+		{"HEALTHCHECK_RESTART_AFTER", HealthcheckRestartAfter, &settings.RestartAfter},
+	}
+	for _, c := range counts {
+		if c.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c.value)
+		if err != nil || n < 0 {
+			return settings, fmt.Errorf("invalid %s: %q", c.setting, c.value)
+		}
+		*c.dest = n
+	}
+	if settings.Interval == 0 || settings.Timeout == 0 || settings.Retries == 0 {
+		return settings, fmt.Errorf("HEALTHCHECK_INTERVAL, HEALTHCHECK_TIMEOUT and HEALTHCHECK_RETRIES must not be 0")
+	}
+	switch HAProxyHealthcheck {
+	case "":
+	case "stats", "socket", "none":
+		settings.HAProxyProbe = HAProxyHealthcheck
+	default:
+		return settings, fmt.Errorf("invalid HAPROXY_HEALTHCHECK: %q", HAProxyHealthcheck)
+	}
+	return settings, nil
+}
+
+func (s healthSettings) healthcheck(command string) *healthcheck {
+	return &healthcheck{
+		Command:  command,
+		Interval: s.Interval,
+		Timeout:  s.Timeout,
+		Retries:  s.Retries,
+	}
+}
+
+// haproxyHealthcheck probes HAProxy through its stats page, or through its runtime socket, as found in the config at path.
+// The probes run inside the HAProxy container, so they can use the addresses and paths of the config as they are.
+func haproxyHealthcheck(path string) *healthcheck {
+	switch HealthSettings.HAProxyProbe {
+	case "none":
+		return nil
+	case "socket":
+		if socket := statsSocket(path); socket != "" {
+			// socat isn't part of the haproxy image, an image with it has to be used for this probe
+			return HealthSettings.healthcheck(fmt.Sprintf(`echo "show info" | socat stdio unix-connect:%s | grep -q "^Pid:"`, socket))
+		}
+		log.Printf("%s has no stats socket, probing the stats page instead\n", path)
+	}
+	addr, uri, ok := statsEndpoint(path)
+	if !ok {
+		log.Printf("%s has no stats page, HAProxy won't be health checked\n", path)
+		return nil
+	}
+	ip := addr.IP
+	if ip == "0.0.0.0" {
+		ip = "127.0.0.1"
+	}
+	// the haproxy image has no HTTP client, so the request is made with bash's /dev/tcp
+	return HealthSettings.healthcheck(fmt.Sprintf(
+		`bash -c 'exec 3<>/dev/tcp/%s/%d && printf "GET %s HTTP/1.0\r\n\r\n" >&3 && head -n 1 <&3 | grep -q " 200 "'`,
+		ip, addr.Port, uri,
+	))
+}
+
+// statsEndpoint finds the address and URI of the stats page in the HAProxy config at path,
+// from the first listen or frontend section which enables stats
+func statsEndpoint(path string) (bindAddr, string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return bindAddr{}, "", false
+	}
+	defer f.Close()
+
+	var addr *bindAddr
+	uri := ""
+	stats := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			// a new section starts
+			if stats && addr != nil {
+				break
+			}
+			addr, uri, stats = nil, "", false
+			continue
+		}
+		switch {
+		case fields[0] == "bind" && len(fields) > 1 && addr == nil:
+			if parsed, err := parseBindAddr(strings.Split(fields[1], ",")[0]); err == nil && len(parsed) > 0 {
+				addr = &parsed[0]
+			}
+		case fields[0] == "stats" && len(fields) > 1 && fields[1] == "enable":
+			stats = true
+		case fields[0] == "stats" && len(fields) > 2 && fields[1] == "uri":
+			stats = true
+			uri = fields[2]
+		}
+	}
+	if !stats || addr == nil {
+		return bindAddr{}, "", false
+	}
+	if uri == "" || strings.ContainsAny(uri, `'"\`) {
+		uri = defaultStatsURI
+	}
+	return *addr, uri, true
+}
+
+// statsSocket returns the path of the first stats socket in the global section of the HAProxy config at path
+func statsSocket(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	inGlobal := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inGlobal = fields[0] == "global"
+			continue
+		}
+		if inGlobal && len(fields) > 2 && fields[0] == "stats" && fields[1] == "socket" {
+			socket := strings.TrimPrefix(fields[2], "unix@")
+			if strings.HasPrefix(socket, "/") {
+				return socket
+			}
+		}
+	}
+	return ""
+}
+
+// unhealthyIntervals is how many probe intervals a workload has been unhealthy for
+func unhealthyIntervals(health *workloadHealth, hc *healthcheck) int {
+	if health == nil || health.Status != "unhealthy" {
+		return 0
+	}
+	return health.FailingStreak - hc.Retries + 1
+}
+
+// watchHealth follows the health of the workload with the given ID until exited is closed, stopping it when it has
+// been unhealthy for HealthSettings.RestartAfter intervals. It returns whether it stopped the workload.
+func watchHealth(rt Runtime, what string, spec workloadSpec, id string, exited chan struct{}) bool {
+	hc := spec.Healthcheck
+	if hc == nil || HealthSettings.RestartAfter == 0 {
+		return false
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return false
+		case <-ticker.C:
+		}
+		state, err := rt.Inspect(spec.Name)
+		if err != nil {
+			log.Printf("unable to check the health of %s: %v\n", what, err)
+			continue
+		}
+		if state == nil || state.ID != id {
+			return false
+		}
+		if intervals := unhealthyIntervals(state.Health, hc); intervals >= HealthSettings.RestartAfter {
+			log.Printf("%s has been unhealthy for %d intervals, restarting it\n", what, intervals)
+			if err := rt.Stop(spec.Name); err != nil {
+				log.Printf("unable to stop %s: %v\n", what, err)
+				continue
+			}
+			return true
+		}
+	}
+}
+
+// runProbe runs a health probe as a shell command on the host, for the process runtime
+func runProbe(hc *healthcheck) healthProbe {
+	probe := healthProbe{Start: time.Now()}
+	cmd := exec.Command("sh", "-c", hc.Command)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		probe.End = time.Now()
+		probe.ExitCode = -1
+		probe.Output = err.Error()
+		return probe
+	}
+	timer := time.AfterFunc(hc.Timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timedOut := !timer.Stop()
+	probe.End = time.Now()
+	probe.Output = output.String()
+	if len(probe.Output) > maxProbeOutput {
+		probe.Output = probe.Output[:maxProbeOutput]
+	}
+	switch {
+	case timedOut:
+		probe.ExitCode = -1
+		probe.Output = fmt.Sprintf("health check exceeded timeout (%s)", hc.Timeout)
+	case err != nil:
+		probe.ExitCode = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			probe.ExitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+	}
+	return probe
+}
+
+// update adds a probe result, as Docker does: a workload is healthy after a probe succeeds and unhealthy after
+// Retries probes failed in a row. It returns whether the status changed.
+func (h *workloadHealth) update(probe healthProbe, retries int) bool {
+	h.Log = append(h.Log, probe)
+	if len(h.Log) > healthLogSize {
+		h.Log = h.Log[len(h.Log)-healthLogSize:]
+	}
+	previous := h.Status
+	if probe.ExitCode == 0 {
+		h.FailingStreak = 0
+		h.Status = "healthy"
+	} else {
+		h.FailingStreak++
+		if h.FailingStreak >= retries {
+			h.Status = "unhealthy"
+		}
+	}
+	return h.Status != previous
+}
+
+func healthToProto(health *workloadHealth) *pb.Health {
+	if health == nil {
+		return nil
+	}
+	out := &pb.Health{
+		Status:        health.Status,
+		FailingStreak: int64(health.FailingStreak),
+	}
+	for _, probe := range health.Log {
+		out.Log = append(out.Log, &pb.HealthProbe{
+			Start:    probe.Start.UnixNano(),
+			End:      probe.End.UnixNano(),
+			ExitCode: int64(probe.ExitCode),
+			Output:   probe.Output,
+		})
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsEndpoint(t *testing.T) {
+	tests := []struct {
+		config string
+		addr   bindAddr
+		uri    string
+		ok     bool
+	}{
+		{testConfig, bindAddr{}, "", false},
+		{"listen stats\n    bind 127.0.0.1:8080\n    stats enable\n", bindAddr{"127.0.0.1", 8080}, defaultStatsURI, true},
+		{"frontend www\n    bind *:80\n\nlisten stats\n    bind *:9000\n    stats uri /status\n", bindAddr{"0.0.0.0", 9000}, "/status", true},
+		{"listen stats\n    stats enable\n", bindAddr{}, "", false},
+	}
+	for _, test := range tests {
+		path := writeTempConfig(t, test.config)
+		addr, uri, ok := statsEndpoint(path)
+		os.RemoveAll(filepath.Dir(path))
+		if addr != test.addr || uri != test.uri || ok != test.ok {
+			t.Errorf("%q: expected %v %q %v, got %v %q %v", test.config, test.addr, test.uri, test.ok, addr, uri, ok)
+		}
+	}
+}
+
+func TestStatsSocket(t *testing.T) {
+	path := writeTempConfig(t, "global\n    stats socket /var/run/haproxy.sock mode 600 level admin\n\nlisten stats\n    stats socket /ignored\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	if socket := statsSocket(path); socket != "/var/run/haproxy.sock" {
+		t.Errorf("unexpected stats socket: %q", socket)
+	}
+}
+
+func TestHealthUpdate(t *testing.T) {
+	health := &workloadHealth{Status: "starting"}
+	failure := healthProbe{ExitCode: 1}
+	steps := []struct {
+		probe   healthProbe
+		status  string
+		changed bool
+	}{
+		{failure, "starting", false},
+		{healthProbe{}, "healthy", true},
+		{failure, "healthy", false},
+		{failure, "healthy", false},
+		{failure, "unhealthy", true},
+		{failure, "unhealthy", false},
+		{healthProbe{}, "healthy", true},
+	}
+	for i, step := range steps {
+		changed := health.update(step.probe, 3)
+		if health.Status != step.status || changed != step.changed {
+			t.Errorf("probe %d: expected %s (changed %v), got %s (changed %v)", i+1, step.status, step.changed, health.Status, changed)
+		}
+	}
+	if len(health.Log) != healthLogSize {
+		t.Errorf("expected the last %d probes to be kept, got %d", healthLogSize, len(health.Log))
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	hc := &healthcheck{Timeout: 100 * time.Millisecond}
+
+	hc.Command = "echo ok"
+	if probe := runProbe(hc); probe.ExitCode != 0 || probe.Output != "ok\n" {
+		t.Errorf("expected a passing probe, got %+v", probe)
+	}
+	hc.Command = "exit 3"
+	if probe := runProbe(hc); probe.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %+v", probe)
+	}
+	hc.Command = "sleep 5"
+	if probe := runProbe(hc); probe.ExitCode != -1 || !strings.Contains(probe.Output, "timeout") {
+		t.Errorf("expected the probe to time out, got %+v", probe)
+	}
+}
+
+func TestHAProxySpecProbesStatsPage(t *testing.T) {
+	defer setupConfigDir(t, strings.Replace(testConfig, "127.0.0.1:8080\n", "127.0.0.1:8080\n    stats enable\n", 1))()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+
+	spec := testHAProxySpec(t, svc)
+	if spec.Healthcheck == nil || !strings.Contains(spec.Healthcheck.Command, "/dev/tcp/127.0.0.1/8080 ") {
+		t.Errorf("expected a probe of the stats page, got %+v", spec.Healthcheck)
+	}
+}
+
+func TestWatchHealthRestartsUnhealthyWorkload(t *testing.T) {
+	defer setupConfigDir(t, strings.Replace(testConfig, "127.0.0.1:8080\n", "127.0.0.1:8080\n    stats enable\n", 1))()
+	previous := HealthSettings
+	HealthSettings = healthSettings{Interval: 10 * time.Millisecond, Timeout: time.Second, Retries: 2, RestartAfter: 2}
+	defer func() { HealthSettings = previous }()
+
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+	spec := testHAProxySpec(t, svc)
+	id, err := rt.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := make(chan bool, 1)
+	go func() {
+		restarted <- watchHealth(rt, "HAProxy", spec, id, make(chan struct{}))
+	}()
+	for i := 0; i < 3; i++ {
+		if err := docker.probe(id, 1, "connection refused"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case ok := <-restarted:
+		if !ok {
+			t.Error("expected the workload to be stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the unhealthy workload wasn't stopped")
+	}
+	if existing, err := docker.ContainerInspect(context.Background(), id); err == nil && existing.State.Running {
+		t.Error("expected the unhealthy container to be stopped")
+	}
+
+	events := rt.Events(spec.Name)
+	if len(events) == 0 || events[0].Action != "health_status" || events[0].Health != "unhealthy" {
+		t.Errorf("expected a health_status event, got %+v", events)
+	}
+}
+
+func writeTempConfig(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "haproxy-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
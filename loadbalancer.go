@@ -0,0 +1,748 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultBackendName is the backend which existed before frontends and backends could be defined in the keys.
+// Its servers can still be set directly under backends/, or taken from backends_service.
+const defaultBackendName = "backends"
+
+// defaultFrontendBind is where the www frontend of the default service listens, when it has no frontends
+const defaultFrontendBind = "*:80"
+
+// proxyNamePattern restricts the names of frontends, backends, servers and routes to what HAProxy accepts
+var proxyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// headerNamePattern is the characters of an HTTP header name
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// loadBalancer is the frontends and backends of a service, read from the keys under its prefix:
+//
+//	frontends/<frontend>/bind                          comma separated addresses, e.g. *:80,*:8080
+//	frontends/<frontend>/mode                          http (the default) or tcp
+//	frontends/<frontend>/default_backend               the backend of the requests no route matches
+//	frontends/<frontend>/routes/<route>/backend        the backend of the requests the route matches
+//	frontends/<frontend>/routes/<route>/host           comma separated host names
+//	frontends/<frontend>/routes/<route>/path_prefix    comma separated path prefixes
+//	frontends/<frontend>/routes/<route>/path_regex     a regular expression the path must match
+//	frontends/<frontend>/routes/<route>/header/<name>  the value a request header must have
+//	frontends/<frontend>/routes/<route>/sni            comma separated TLS server names, in tcp mode
+//	frontends/<frontend>/rate_limit/<setting>          the limits of each client, see parseRateLimit
+//	backends/<backend>/servers/<server>                a server address, host:port, or a serverRecord
+//	backends/<backend>/service                         a Consul service whose healthy instances are servers
+//	backends/<backend>/service_tags                    comma separated tags the instances must have
+//	backends/<backend>/mode                            http or tcp, the mode of the frontends using it by default
+//	backends/<backend>/balance                         the balance algorithm, roundrobin by default
+//	backends/<backend>/http_check/<setting>            the HTTP health check, see parseHTTPCheck
+//	backends/<backend>/sticky/<setting>                the sticky sessions, see parseSticky
+//	backends/<backend>/tcp_check/<step>                a tcp-check step, run in the order of the step names
+//	acl/...                                            the allow and deny lists, see loadACLLists
+//	abuse/<setting>                                    the limits sources are banned over, see loadAbusePolicy
+//
+// A route matches when all of its conditions do, and routes are tried in the order of their names. Without any
+// frontends the service has the www frontend on *:80, see setDefaultBind. Labelled containers are added to the backend
+// they name.
+// Only sni routes are allowed in tcp mode, and a tcp frontend needs a default_backend as the defaults' is http.
+type loadBalancer struct {
+	Frontends []*lbFrontend
+	Backends  []*lbBackend
+	// DenyList is the file of the sources all of the frontends reject, in the ACL dir
+	DenyList string
+	// BannedList is the file of the sources banned for abuse, in the ACL dir
+	BannedList string
+	// Abuse is nil unless the frontends track their sources in the abuse table
+	Abuse *abusePolicy
+	// ErrorFiles are the errorfile lines of the pages of all of the backends
+	ErrorFiles []string
+	// Maintenance is the page the http frontends answer every request with, empty unless in maintenance
+	Maintenance string
+}
+
+type lbFrontend struct {
+	Name  string
+	Binds []string
+	Mode  string
+	// DefaultBackend is empty to use the default_backend of the defaults section
+	DefaultBackend string
+	Routes         []*lbRoute
+	// RateLimit are the lines tracking clients in the frontend's stick table and limiting them
+	RateLimit []string
+	// AllowList is the file of the only sources the frontend accepts, in the ACL dir, if it has one
+	AllowList string
+
+	// key is the prefix of the frontend's keys
+	key string
+}
+
+// setDefaultBind has the www frontend of a service without frontends listen on bind instead, unless it is empty
+func (lb *loadBalancer) setDefaultBind(bind string) {
+	if bind == "" {
+		return
+	}
+	for _, frontend := range lb.Frontends {
+		// the www frontend has no keys
+		if frontend.key == "" {
+			frontend.Binds = []string{bind}
+		}
+	}
+}
+
+// InspectsSNI reports whether the frontend has to wait for the TLS client hello to route connections
+func (f *lbFrontend) InspectsSNI() bool {
+	for _, route := range f.Routes {
+		if len(route.SNIs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionRateLimit are the rate limit lines which come before the http-request rules of the frontend: its stick
+// table, and the tcp-request rules tracking and limiting the clients
+func (f *lbFrontend) ConnectionRateLimit() []string {
+	lines := []string{}
+	for _, line := range f.RateLimit {
+		if !strings.HasPrefix(line, "http-request ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// RequestRateLimit are the http-request rules tracking and limiting the clients of the frontend
+func (f *lbFrontend) RequestRateLimit() []string {
+	lines := []string{}
+	for _, line := range f.RateLimit {
+		if strings.HasPrefix(line, "http-request ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// lbRoute sends the requests matching all of its conditions to Backend
+type lbRoute struct {
+	Name         string
+	Backend      string
+	Hosts        []string
+	PathPrefixes []string
+	PathRegex    string
+	Headers      []lbHeaderMatch
+	SNIs         []string
+
+	// key is the prefix of the route's keys
+	key string
+}
+
+type lbHeaderMatch struct {
+	Name  string
+	Value string
+}
+
+type lbBackend struct {
+	Name    string
+	Mode    string
+	Balance string
+	// TCPCheck are the tcp-check steps, such as send PING or expect string +PONG
+	TCPCheck []string
+	// HTTPCheck are the arguments of option httpchk, and HTTPCheckExpect those of http-check expect
+	HTTPCheck       string
+	HTTPCheckExpect string
+	// Persistence are the lines making sessions sticky, such as cookie SERVERID insert indirect nocache
+	Persistence []string
+	// AllowList is the file of the only sources the backend serves, in the ACL dir, if it has one
+	AllowList string
+	// ErrorFiles are the errorfile lines of the backend's own pages
+	ErrorFiles []string
+	Servers    []lbServer
+}
+
+// lbServer is a server line, Options are its keywords such as check or weight 10
+type lbServer struct {
+	Name    string
+	Address string
+	Port    int
+	Options []string
+}
+
+// invalidKeyError is a key which doesn't fit the schema of loadBalancer
+type invalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *invalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %s: %s", e.Key, e.Reason)
+}
+
+// subKeys returns the keys under prefix, relative to it
+func subKeys(kv map[string]string, prefix string) map[string]string {
+	sub := map[string]string{}
+	for key, value := range kv {
+		if strings.HasPrefix(key, prefix) && key != prefix {
+			sub[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	return sub
+}
+
+// childNames returns the sorted names of the directories directly under the keys
+func childNames(keys map[string]string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for key := range keys {
+		i := strings.Index(key, "/")
+		if i <= 0 || seen[key[:i]] {
+			continue
+		}
+		seen[key[:i]] = true
+		names = append(names, key[:i])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitList splits a comma separated value, dropping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// haproxyArg escapes a value so that HAProxy reads it as a single word
+var haproxyArg = strings.NewReplacer(`\`, `\\`, " ", `\ `, "\t", `\	`, "#", `\#`, `'`, `\'`, `"`, `\"`).Replace
+
+// loadLoadBalancer reads the frontends and backends from the keys under prefix. lookup returns the instances of a
+// catalog query, so the servers of Consul services and labelled containers can be filled in.
+func loadLoadBalancer(kv map[string]string, prefix string, lookup func(catalogQuery) []catalogInstance) (*loadBalancer, error) {
+	lb := &loadBalancer{}
+	backendNames := map[string]bool{defaultBackendName: true}
+
+	frontendKeys := subKeys(kv, prefix+"frontends/")
+	for _, name := range childNames(frontendKeys) {
+		frontend, err := loadFrontend(prefix+"frontends/"+name+"/", name, subKeys(frontendKeys, name+"/"))
+		if err != nil {
+			return nil, err
+		}
+		lb.Frontends = append(lb.Frontends, frontend)
+		if frontend.DefaultBackend != "" {
+			backendNames[frontend.DefaultBackend] = true
+		}
+		for _, route := range frontend.Routes {
+			backendNames[route.Backend] = true
+		}
+	}
+	if len(lb.Frontends) == 0 {
+		lb.Frontends = []*lbFrontend{{Name: "www", Binds: []string{defaultFrontendBind}, Mode: "http", DefaultBackend: defaultBackendName}}
+	}
+	// backends take the mode of the frontends using them, unless they set one
+	usedModes := map[string]string{}
+	for _, frontend := range lb.Frontends {
+		if frontend.DefaultBackend != "" {
+			usedModes[frontend.DefaultBackend] = frontend.Mode
+		}
+		for _, route := range frontend.Routes {
+			usedModes[route.Backend] = frontend.Mode
+		}
+	}
+
+	backendKeys := subKeys(kv, prefix+"backends/")
+	for _, name := range childNames(backendKeys) {
+		backendNames[name] = true
+	}
+	names := []string{}
+	for name := range backendNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mode := usedModes[name]
+		if mode == "" {
+			mode = "http"
+		}
+		backend, err := loadBackend(kv, prefix, name, mode, subKeys(backendKeys, name+"/"), lookup)
+		if err != nil {
+			return nil, err
+		}
+		lb.Backends = append(lb.Backends, backend)
+	}
+	if err := lb.checkModes(); err != nil {
+		return nil, err
+	}
+	if err := lb.setACLLists(kv, prefix); err != nil {
+		return nil, err
+	}
+	lb.BannedList = bannedListFile
+	abuse, err := loadAbusePolicy(kv, prefix)
+	if err != nil {
+		return nil, err
+	}
+	lb.Abuse = abuse
+	return lb, nil
+}
+
+// setACLLists refers the frontends and backends to their allow lists
+func (lb *loadBalancer) setACLLists(kv map[string]string, prefix string) error {
+	lists, err := loadACLLists(kv, prefix)
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	lb.DenyList = denyListFile
+	for _, frontend := range lb.Frontends {
+		frontend.AllowList = frontendAllowListFile(frontend.Name)
+		files[frontend.AllowList] = true
+	}
+	for _, backend := range lb.Backends {
+		backend.AllowList = backendAllowListFile(backend.Name)
+		files[backend.AllowList] = true
+	}
+	for _, list := range lists {
+		if list.File != denyListFile && !files[list.File] {
+			return &invalidKeyError{list.key, "there is no such frontend or backend"}
+		}
+		delete(files, list.File)
+	}
+	// those left have no list
+	for _, frontend := range lb.Frontends {
+		if files[frontend.AllowList] {
+			frontend.AllowList = ""
+		}
+	}
+	for _, backend := range lb.Backends {
+		if files[backend.AllowList] {
+			backend.AllowList = ""
+		}
+	}
+	return nil
+}
+
+// checkModes makes sure the frontends only use backends of the same mode, which HAProxy requires
+func (lb *loadBalancer) checkModes() error {
+	modes := map[string]string{}
+	for _, backend := range lb.Backends {
+		modes[backend.Name] = backend.Mode
+	}
+	for _, frontend := range lb.Frontends {
+		if frontend.DefaultBackend != "" && modes[frontend.DefaultBackend] != frontend.Mode {
+			return &invalidKeyError{frontend.key + "default_backend", fmt.Sprintf("backend %s isn't in %s mode", frontend.DefaultBackend, frontend.Mode)}
+		}
+		for _, route := range frontend.Routes {
+			if modes[route.Backend] != frontend.Mode {
+				return &invalidKeyError{route.key + "backend", fmt.Sprintf("backend %s isn't in %s mode", route.Backend, frontend.Mode)}
+			}
+		}
+	}
+	return nil
+}
+
+// loadMode reads the mode key, def being the mode when it isn't set
+func loadMode(key, value, def string) (string, error) {
+	switch value {
+	case "":
+		return def, nil
+	case "http", "tcp":
+		return value, nil
+	default:
+		return "", &invalidKeyError{key, fmt.Sprintf("unknown mode %q, it is http or tcp", value)}
+	}
+}
+
+func validProxyName(name string) bool {
+	return proxyNamePattern.MatchString(name) && name != "stats" && name != abuseTableName
+}
+
+func loadFrontend(prefix, name string, keys map[string]string) (*lbFrontend, error) {
+	if !validProxyName(name) {
+		return nil, &invalidKeyError{prefix, "frontend names may only contain letters, digits, '-', '_', '.' and ':', and stats and abuse are taken"}
+	}
+	mode, err := loadMode(prefix+"mode", keys["mode"], "http")
+	if err != nil {
+		return nil, err
+	}
+	frontend := &lbFrontend{Name: name, Mode: mode, DefaultBackend: keys["default_backend"], key: prefix}
+	for _, bind := range splitList(keys["bind"]) {
+		if _, err := parseBindAddr(bind); err != nil {
+			return nil, &invalidKeyError{prefix + "bind", err.Error()}
+		}
+		frontend.Binds = append(frontend.Binds, bind)
+	}
+	if len(frontend.Binds) == 0 {
+		return nil, &invalidKeyError{prefix + "bind", "a frontend needs at least one address"}
+	}
+	if frontend.DefaultBackend != "" && !validProxyName(frontend.DefaultBackend) {
+		return nil, &invalidKeyError{prefix + "default_backend", "not a valid backend name"}
+	}
+	if frontend.DefaultBackend == "" && mode == "tcp" {
+		return nil, &invalidKeyError{prefix + "default_backend", "a tcp frontend needs a default backend"}
+	}
+
+	if rateLimit := subKeys(keys, "rate_limit/"); len(rateLimit) > 0 {
+		if frontend.RateLimit, err = parseRateLimit(prefix+"rate_limit/", mode, rateLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	routeKeys := subKeys(keys, "routes/")
+	for _, routeName := range childNames(routeKeys) {
+		route, err := loadRoute(prefix+"routes/"+routeName+"/", routeName, mode, subKeys(routeKeys, routeName+"/"))
+		if err != nil {
+			return nil, err
+		}
+		frontend.Routes = append(frontend.Routes, route)
+	}
+	return frontend, nil
+}
+
+func loadRoute(prefix, name, mode string, keys map[string]string) (*lbRoute, error) {
+	route := &lbRoute{
+		Name:         name,
+		Backend:      keys["backend"],
+		Hosts:        splitList(strings.ToLower(keys["host"])),
+		PathPrefixes: splitList(keys["path_prefix"]),
+		PathRegex:    keys["path_regex"],
+		SNIs:         splitList(strings.ToLower(keys["sni"])),
+		key:          prefix,
+	}
+	if !validProxyName(route.Backend) {
+		return nil, &invalidKeyError{prefix + "backend", "a route needs a valid backend name"}
+	}
+	for _, host := range route.Hosts {
+		if strings.ContainsAny(host, " \t/") {
+			return nil, &invalidKeyError{prefix + "host", fmt.Sprintf("%q isn't a host name", host)}
+		}
+	}
+	for _, path := range route.PathPrefixes {
+		if !strings.HasPrefix(path, "/") {
+			return nil, &invalidKeyError{prefix + "path_prefix", fmt.Sprintf("%q doesn't start with /", path)}
+		}
+	}
+	if route.PathRegex != "" {
+		if _, err := regexp.Compile(route.PathRegex); err != nil {
+			return nil, &invalidKeyError{prefix + "path_regex", err.Error()}
+		}
+	}
+	headers := subKeys(keys, "header/")
+	headerNames := []string{}
+	for header := range headers {
+		headerNames = append(headerNames, header)
+	}
+	sort.Strings(headerNames)
+	for _, header := range headerNames {
+		if !headerNamePattern.MatchString(header) {
+			return nil, &invalidKeyError{prefix + "header/" + header, "not a valid header name"}
+		}
+		route.Headers = append(route.Headers, lbHeaderMatch{Name: header, Value: headers[header]})
+	}
+	for key, value := range keys {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, &invalidKeyError{prefix + key, "values can't span several lines"}
+		}
+	}
+	for _, sni := range route.SNIs {
+		if strings.ContainsAny(sni, " \t/:") {
+			return nil, &invalidKeyError{prefix + "sni", fmt.Sprintf("%q isn't a server name", sni)}
+		}
+	}
+	httpConditions := len(route.Hosts) > 0 || len(route.PathPrefixes) > 0 || route.PathRegex != "" || len(route.Headers) > 0
+	switch {
+	case mode == "tcp" && httpConditions:
+		return nil, &invalidKeyError{prefix, "routes of tcp frontends can only match the sni"}
+	case mode == "http" && len(route.SNIs) > 0:
+		return nil, &invalidKeyError{prefix + "sni", "sni routes need a tcp frontend, TLS is terminated in http mode"}
+	case !httpConditions && len(route.SNIs) == 0:
+		return nil, &invalidKeyError{prefix, "a route needs a host, path_prefix, path_regex, header or sni condition"}
+	}
+	return route, nil
+}
+
+// Condition is the route's condition as anonymous ACLs, which HAProxy ANDs together
+func (r *lbRoute) Condition() string {
+	acls := []string{}
+	escaped := func(values []string) string {
+		out := []string{}
+		for _, value := range values {
+			out = append(out, haproxyArg(value))
+		}
+		return strings.Join(out, " ")
+	}
+	if len(r.Hosts) > 0 {
+		// the port is dropped from the Host header
+		acls = append(acls, "{ req.hdr(host),field(1,:) -i "+escaped(r.Hosts)+" }")
+	}
+	if len(r.PathPrefixes) > 0 {
+		acls = append(acls, "{ path_beg "+escaped(r.PathPrefixes)+" }")
+	}
+	if r.PathRegex != "" {
+		acls = append(acls, "{ path_reg "+haproxyArg(r.PathRegex)+" }")
+	}
+	for _, header := range r.Headers {
+		acls = append(acls, "{ req.hdr("+header.Name+") -m str "+haproxyArg(header.Value)+" }")
+	}
+	if len(r.SNIs) > 0 {
+		acls = append(acls, "{ req.ssl_sni -i "+escaped(r.SNIs)+" }")
+	}
+	return strings.Join(acls, " ")
+}
+
+// balanceAlgorithms are the balance algorithms which take no arguments
+var balanceAlgorithms = []string{"roundrobin", "static-rr", "leastconn", "first", "source"}
+
+// urlParamPattern is a query string parameter name
+var urlParamPattern = regexp.MustCompile(`^[A-Za-z0-9_.~-]+$`)
+
+// parseBalance checks a balance algorithm, roundrobin when it is empty. The algorithms hashing a part of the
+// request are uri, url_param <name> and hdr(<name>), which need http mode.
+func parseBalance(balance, mode string) (string, error) {
+	balance = strings.TrimSpace(balance)
+	if balance == "" {
+		return "roundrobin", nil
+	}
+	if containsString(balanceAlgorithms, balance) {
+		return balance, nil
+	}
+	fields := strings.Fields(balance)
+	valid := false
+	switch {
+	case balance == "uri":
+		valid = true
+	case fields[0] == "url_param":
+		valid = len(fields) == 2 && urlParamPattern.MatchString(fields[1])
+	case strings.HasPrefix(balance, "hdr(") && strings.HasSuffix(balance, ")"):
+		valid = headerNamePattern.MatchString(balance[4 : len(balance)-1])
+	default:
+		return "", fmt.Errorf("unknown balance algorithm %q", balance)
+	}
+	if !valid {
+		return "", fmt.Errorf("invalid balance algorithm %q, it is uri, url_param <name> or hdr(<name>)", balance)
+	}
+	if mode != "http" {
+		return "", fmt.Errorf("balance %s needs http mode", balance)
+	}
+	return balance, nil
+}
+
+var (
+	httpMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+	statusPattern     = regexp.MustCompile(`^[1-5][0-9][0-9]$`)
+	statusClass       = regexp.MustCompile(`^[1-5]xx$`)
+)
+
+// parseHTTPCheck reads the http_check keys of a backend into the arguments of option httpchk and http-check expect:
+//
+//	path            the path requested, which enables the check
+//	method          the method of the request, GET by default
+//	host            the Host header of the request, for servers with virtual hosts
+//	expect_status   the status the response must have, e.g. 200, or a class such as 2xx
+//	expect_string   a string the response body must contain, instead of expect_status
+//
+// Without expect_status or expect_string, HAProxy accepts the 2xx and 3xx statuses.
+func parseHTTPCheck(prefix string, keys map[string]string) (string, string, error) {
+	for key, value := range keys {
+		if !containsString([]string{"path", "method", "host", "expect_status", "expect_string"}, key) {
+			return "", "", &invalidKeyError{prefix + key, "unknown http_check setting"}
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return "", "", &invalidKeyError{prefix + key, "values can't span several lines"}
+		}
+	}
+	path := keys["path"]
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t#") {
+		return "", "", &invalidKeyError{prefix + "path", "the check needs a path starting with /, without spaces"}
+	}
+	method := keys["method"]
+	if method == "" {
+		method = "GET"
+	}
+	if !httpMethodPattern.MatchString(method) {
+		return "", "", &invalidKeyError{prefix + "method", fmt.Sprintf("%q isn't an HTTP method", method)}
+	}
+	check := method + " " + path
+	if host := keys["host"]; host != "" {
+		if strings.ContainsAny(host, " \t#/\\") {
+			return "", "", &invalidKeyError{prefix + "host", fmt.Sprintf("%q isn't a host name", host)}
+		}
+		// HAProxy 1.8 only takes headers appended to the HTTP version
+		check += ` HTTP/1.1\r\nHost:\ ` + host
+	}
+
+	status, body := keys["expect_status"], keys["expect_string"]
+	switch {
+	case status != "" && body != "":
+		return "", "", &invalidKeyError{prefix + "expect_string", "a check expects either a status or a string"}
+	case statusPattern.MatchString(status):
+		return check, "status " + status, nil
+	case statusClass.MatchString(status):
+		return check, "rstatus ^" + status[:1], nil
+	case status != "":
+		return "", "", &invalidKeyError{prefix + "expect_status", fmt.Sprintf("%q isn't a status such as 200 or 2xx", status)}
+	case body != "":
+		return check, "string " + haproxyData(body), nil
+	}
+	return check, "", nil
+}
+
+// haproxyData escapes a value so that HAProxy reads it as a single word, keeping escape sequences such as \r\n
+var haproxyData = strings.NewReplacer(" ", `\ `, "\t", `\	`, "#", `\#`, `'`, `\'`, `"`, `\"`).Replace
+
+var hexPattern = regexp.MustCompile(`^([0-9A-Fa-f]{2})+$`)
+
+// tcpCheckStep turns a step of a backend's tcp check into the arguments of a tcp-check line. A step is one of
+// connect, connect <port>, send <text>, send-binary <hex>, expect <text>, expect-regex <regex> or expect-binary <hex>.
+func tcpCheckStep(step string) (string, error) {
+	if strings.ContainsAny(step, "\r\n") {
+		return "", fmt.Errorf("a step can't span several lines")
+	}
+	parts := strings.SplitN(strings.TrimSpace(step), " ", 2)
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+	switch parts[0] {
+	case "connect":
+		if arg == "" {
+			return "connect", nil
+		}
+		if port, err := strconv.Atoi(arg); err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("%q isn't a port", arg)
+		}
+		return "connect port " + arg, nil
+	case "send", "expect", "expect-regex":
+		if arg == "" {
+			return "", fmt.Errorf("%s needs an argument", parts[0])
+		}
+		switch parts[0] {
+		case "send":
+			return "send " + haproxyData(arg), nil
+		case "expect":
+			return "expect string " + haproxyData(arg), nil
+		}
+		if _, err := regexp.Compile(arg); err != nil {
+			return "", err
+		}
+		return "expect rstring " + haproxyData(arg), nil
+	case "send-binary", "expect-binary":
+		if !hexPattern.MatchString(arg) {
+			return "", fmt.Errorf("%q isn't hex encoded", arg)
+		}
+		if parts[0] == "send-binary" {
+			return "send-binary " + arg, nil
+		}
+		return "expect binary " + arg, nil
+	default:
+		return "", fmt.Errorf("unknown step %q, it is connect, send, send-binary, expect, expect-regex or expect-binary", parts[0])
+	}
+}
+
+// loadBackend reads a backend's servers. The default backend also gets the servers directly under backends/, or the
+// instances of backends_service.
+func loadBackend(kv map[string]string, prefix, name, mode string, keys map[string]string, lookup func(catalogQuery) []catalogInstance) (*lbBackend, error) {
+	keyPrefix := prefix + "backends/" + name + "/"
+	if !validProxyName(name) {
+		return nil, &invalidKeyError{keyPrefix, "backend names may only contain letters, digits, '-', '_', '.' and ':', and stats and abuse are taken"}
+	}
+	mode, err := loadMode(keyPrefix+"mode", keys["mode"], mode)
+	if err != nil {
+		return nil, err
+	}
+	backend := &lbBackend{Name: name, Mode: mode}
+	if backend.Balance, err = parseBalance(keys["balance"], mode); err != nil {
+		return nil, &invalidKeyError{keyPrefix + "balance", err.Error()}
+	}
+	checks := subKeys(keys, "tcp_check/")
+	steps := []string{}
+	for step := range checks {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		line, err := tcpCheckStep(checks[step])
+		if err != nil {
+			return nil, &invalidKeyError{keyPrefix + "tcp_check/" + step, err.Error()}
+		}
+		backend.TCPCheck = append(backend.TCPCheck, line)
+	}
+	httpCheck := subKeys(keys, "http_check/")
+	if len(httpCheck) > 0 {
+		if len(backend.TCPCheck) > 0 {
+			return nil, &invalidKeyError{keyPrefix + "http_check/", "a backend has either a tcp_check or an http_check"}
+		}
+		if backend.HTTPCheck, backend.HTTPCheckExpect, err = parseHTTPCheck(keyPrefix+"http_check/", httpCheck); err != nil {
+			return nil, err
+		}
+	}
+	cookies := false
+	if sticky := subKeys(keys, "sticky/"); len(sticky) > 0 {
+		if backend.Persistence, cookies, err = parseSticky(keyPrefix+"sticky/", mode, sticky); err != nil {
+			return nil, err
+		}
+	}
+
+	// serverKeys are the keys of the servers by their names
+	servers := subKeys(keys, "servers/")
+	serverKeys := map[string]string{}
+	for server := range servers {
+		serverKeys[server] = keyPrefix + "servers/" + server
+	}
+	service, serviceTags := keys["service"], keys["service_tags"]
+	if name == defaultBackendName {
+		if legacy := kv[prefix+"backends_service"]; legacy != "" {
+			service, serviceTags = legacy, kv[prefix+"backends_service_tags"]
+		} else {
+			for key, value := range subKeys(kv, prefix+"backends/") {
+				if !strings.Contains(key, "/") {
+					servers[key] = value
+					serverKeys[key] = prefix + "backends/" + key
+				}
+			}
+		}
+	}
+
+	serverNames := []string{}
+	for server := range servers {
+		serverNames = append(serverNames, server)
+	}
+	sort.Strings(serverNames)
+	for _, server := range serverNames {
+		key := serverKeys[server]
+		if !proxyNamePattern.MatchString(server) {
+			return nil, &invalidKeyError{key, "server names may only contain letters, digits, '-', '_', '.' and ':'"}
+		}
+		host, port, options, err := parseServerValue(servers[server])
+		if err != nil {
+			return nil, &invalidKeyError{key, err.Error()}
+		}
+		backend.Servers = append(backend.Servers, lbServer{Name: server, Address: host, Port: port, Options: options.keywords()})
+	}
+
+	instances := []catalogInstance{}
+	if service != "" {
+		instances = append(instances, lookup(newCatalogQuery(service, serviceTags))...)
+	}
+	instances = append(instances, lookup(catalogQuery{Catalog: dockerCatalog, Service: name})...)
+	for _, instance := range instances {
+		weight := instance.Weight
+		backend.Servers = append(backend.Servers, lbServer{
+			Name:    instance.Name,
+			Address: instance.Address,
+			Port:    instance.Port,
+			Options: serverOptions{Weight: &weight}.keywords(),
+		})
+	}
+	if cookies {
+		// the cookie names the server by its name, which is unique in the backend
+		for i := range backend.Servers {
+			backend.Servers[i].Options = append(backend.Servers[i].Options, "cookie "+backend.Servers[i].Name)
+		}
+	}
+	return backend, nil
+}
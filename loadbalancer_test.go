@@ -0,0 +1,282 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadLoadBalancer(t *testing.T) {
+	prefix := "svc/"
+	kv := map[string]string{
+		prefix + "backends/web1":                               "10.0.0.1:80",
+		prefix + "frontends/http/bind":                         "*:80, *:8080",
+		prefix + "frontends/http/default_backend":              "site",
+		prefix + "frontends/http/routes/10-api/backend":        "api",
+		prefix + "frontends/http/routes/10-api/host":           "API.example.com,api.example.org",
+		prefix + "frontends/http/routes/10-api/path_prefix":    "/v1",
+		prefix + "frontends/http/routes/20-img/backend":        "img",
+		prefix + "frontends/http/routes/20-img/path_regex":     `^/img/.+\.png$`,
+		prefix + "frontends/http/routes/30-beta/backend":       "api",
+		prefix + "frontends/http/routes/30-beta/header/X-Beta": "on off",
+		prefix + "backends/api/servers/a1":                     "10.0.1.1:8080",
+		prefix + "backends/api/service":                        "api",
+		prefix + "backends/api/service_tags":                   "prod",
+	}
+	lookups := []catalogQuery{}
+	lookup := func(query catalogQuery) []catalogInstance {
+		lookups = append(lookups, query)
+		if query.Service == "api" && query.Catalog == "" {
+			return []catalogInstance{{Name: "n1.api-1", Address: "10.0.2.1", Port: 9000, Weight: 3}}
+		}
+		return nil
+	}
+	lb, err := loadLoadBalancer(kv, prefix, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lb.Frontends) != 1 {
+		t.Fatalf("expected one frontend, got %+v", lb.Frontends)
+	}
+	frontend := lb.Frontends[0]
+	if !reflect.DeepEqual(frontend.Binds, []string{"*:80", "*:8080"}) || frontend.DefaultBackend != "site" {
+		t.Errorf("unexpected frontend: %+v", frontend)
+	}
+	conditions := []string{}
+	for _, route := range frontend.Routes {
+		conditions = append(conditions, route.Backend+" if "+route.Condition())
+	}
+	expected := []string{
+		"api if { req.hdr(host),field(1,:) -i api.example.com api.example.org } { path_beg /v1 }",
+		`img if { path_reg ^/img/.+\\.png$ }`,
+		`api if { req.hdr(X-Beta) -m str on\ off }`,
+	}
+	if !reflect.DeepEqual(conditions, expected) {
+		t.Errorf("expected the routes\n%q\ngot\n%q", expected, conditions)
+	}
+
+	backends := map[string]*lbBackend{}
+	names := []string{}
+	for _, backend := range lb.Backends {
+		backends[backend.Name] = backend
+		names = append(names, backend.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"api", "backends", "img", "site"}) {
+		t.Errorf("expected the defined and referenced backends, got %v", names)
+	}
+	expectedServers := []lbServer{
+		{Name: "a1", Address: "10.0.1.1", Port: 8080, Options: []string{"check"}},
+		{Name: "n1.api-1", Address: "10.0.2.1", Port: 9000, Options: []string{"weight 3", "check"}},
+	}
+	if !reflect.DeepEqual(backends["api"].Servers, expectedServers) {
+		t.Errorf("expected the static servers then the instances, got %+v", backends["api"].Servers)
+	}
+	if servers := backends["backends"].Servers; len(servers) != 1 || servers[0].Name != "web1" {
+		t.Errorf("expected the servers directly under backends/ in the default backend, got %+v", servers)
+	}
+	if !containsQuery(lookups, catalogQuery{Catalog: dockerCatalog, Service: "img"}) || !containsQuery(lookups, catalogQuery{Service: "api", Tags: "prod"}) {
+		t.Errorf("expected the containers of every backend and the services to be looked up, got %v", lookups)
+	}
+}
+
+func containsQuery(queries []catalogQuery, query catalogQuery) bool {
+	for _, q := range queries {
+		if q == query {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoadLoadBalancerDefaults(t *testing.T) {
+	lb, err := loadLoadBalancer(map[string]string{"svc/backends_service": "web"}, "svc/", func(catalogQuery) []catalogInstance { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lb.Frontends) != 1 || lb.Frontends[0].Name != "www" || lb.Frontends[0].Binds[0] != "*:80" {
+		t.Errorf("expected the www frontend without frontends, got %+v", lb.Frontends)
+	}
+	if len(lb.Backends) != 1 || lb.Backends[0].Name != defaultBackendName {
+		t.Errorf("expected only the default backend, got %+v", lb.Backends)
+	}
+}
+
+func TestLoadLoadBalancerTCP(t *testing.T) {
+	prefix := "svc/"
+	kv := map[string]string{
+		prefix + "frontends/tls/bind":                 "*:443",
+		prefix + "frontends/tls/mode":                 "tcp",
+		prefix + "frontends/tls/default_backend":      "fallback",
+		prefix + "frontends/tls/routes/shop/sni":      "Shop.example.com,www.shop.example.com",
+		prefix + "frontends/tls/routes/shop/backend":  "shop",
+		prefix + "frontends/redis/bind":               "*:6379",
+		prefix + "frontends/redis/mode":               "tcp",
+		prefix + "frontends/redis/default_backend":    "redis",
+		prefix + "backends/redis/balance":             "first",
+		prefix + "backends/redis/servers/r1":          "10.0.3.1:6379",
+		prefix + "backends/redis/tcp_check/1":         "send PING\\r\\n",
+		prefix + "backends/redis/tcp_check/2":         "expect +PONG",
+		prefix + "backends/redis/tcp_check/3":         "send-binary 0a0B",
+		prefix + "backends/redis/tcp_check/4":         "expect-regex ^role:master",
+		prefix + "backends/redis/tcp_check/0-connect": "connect 6380",
+	}
+	lb, err := loadLoadBalancer(kv, prefix, func(catalogQuery) []catalogInstance { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontends := map[string]*lbFrontend{}
+	for _, frontend := range lb.Frontends {
+		frontends[frontend.Name] = frontend
+	}
+	tls := frontends["tls"]
+	if tls == nil || tls.Mode != "tcp" || !tls.InspectsSNI() || frontends["redis"].InspectsSNI() {
+		t.Fatalf("expected tls to inspect the SNI, got %+v", frontends)
+	}
+	if condition := tls.Routes[0].Condition(); condition != "{ req.ssl_sni -i shop.example.com www.shop.example.com }" {
+		t.Errorf("unexpected condition: %s", condition)
+	}
+
+	modes := map[string]string{}
+	for _, backend := range lb.Backends {
+		modes[backend.Name] = backend.Mode
+		if backend.Name != "redis" {
+			continue
+		}
+		expected := []string{"connect port 6380", `send PING\r\n`, "expect string +PONG", "send-binary 0a0B", "expect rstring ^role:master"}
+		if backend.Balance != "first" || !reflect.DeepEqual(backend.TCPCheck, expected) {
+			t.Errorf("unexpected redis backend: %+v", backend)
+		}
+	}
+	expectedModes := map[string]string{"backends": "http", "fallback": "tcp", "redis": "tcp", "shop": "tcp"}
+	if !reflect.DeepEqual(modes, expectedModes) {
+		t.Errorf("expected the backends to take the mode of their frontends, got %v", modes)
+	}
+}
+
+func TestLoadLoadBalancerInvalidKeys(t *testing.T) {
+	tests := []struct {
+		key, value string
+		// invalid is the key the error must name
+		invalid string
+	}{
+		{"frontends/web/bind", "", "frontends/web/bind"},
+		{"frontends/web/bind", "*:http", "frontends/web/bind"},
+		{"frontends/stats/bind", "*:80", "frontends/stats/"},
+		{"frontends/web/routes/r/host", "example.com", "frontends/web/routes/r/backend"},
+		{"frontends/web/routes/r/backend", "api", "frontends/web/routes/r/"},
+		{"frontends/web/routes/r/path_prefix", "api", "frontends/web/routes/r/path_prefix"},
+		{"frontends/web/routes/r/path_regex", "(", "frontends/web/routes/r/path_regex"},
+		{"frontends/web/routes/r/header/X Bad", "1", "frontends/web/routes/r/header/X Bad"},
+		{"frontends/web/routes/r/header/X-Good", "1\nbind *:22", "frontends/web/routes/r/header/X-Good"},
+		{"backends/api/servers/a1", "10.0.0.1", "backends/api/servers/a1"},
+		{"backends/api/servers/a1", "10.0.0.1:99999", "backends/api/servers/a1"},
+		{"backends/a b/servers/a1", "10.0.0.1:80", "backends/a b/"},
+		{"backends/abuse/servers/a1", "10.0.0.1:80", "backends/abuse/"},
+		{"backends/web1", "10.0.0.1", "backends/web1"},
+		{"frontends/web/mode", "udp", "frontends/web/mode"},
+		{"frontends/web/routes/r/sni", "example.com", "frontends/web/routes/r/sni"},
+		{"backends/api/balance", "random", "backends/api/balance"},
+		{"backends/api/tcp_check/1", "send", "backends/api/tcp_check/1"},
+		{"backends/api/tcp_check/1", "expect-binary xyz", "backends/api/tcp_check/1"},
+		{"backends/api/tcp_check/1", "connect 0", "backends/api/tcp_check/1"},
+		{"backends/api/tcp_check/1", "close", "backends/api/tcp_check/1"},
+		{"backends/backends/mode", "tcp", "frontends/web/default_backend"},
+	}
+	for _, test := range tests {
+		kv := map[string]string{"svc/frontends/web/bind": "*:80", "svc/frontends/web/default_backend": "backends", "svc/" + test.key: test.value}
+		if strings.HasPrefix(test.key, "frontends/web/routes/r/") && !strings.HasSuffix(test.key, "/backend") && test.key != "frontends/web/routes/r/host" {
+			kv["svc/frontends/web/routes/r/backend"] = "api"
+		}
+		_, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil })
+		invalid, ok := err.(*invalidKeyError)
+		if !ok || invalid.Key != "svc/"+test.invalid {
+			t.Errorf("%s=%q: expected %s to be invalid, got %v", test.key, test.value, test.invalid, err)
+		}
+	}
+}
+
+func TestLoadLoadBalancerTCPInvalidKeys(t *testing.T) {
+	tests := []struct {
+		keys    map[string]string
+		invalid string
+	}{
+		{map[string]string{"frontends/db/default_backend": ""}, "frontends/db/default_backend"},
+		{map[string]string{"frontends/db/routes/r/backend": "db", "frontends/db/routes/r/host": "example.com"}, "frontends/db/routes/r/"},
+		{map[string]string{"frontends/db/routes/r/backend": "web", "frontends/db/routes/r/sni": "example.com", "backends/web/mode": "http"}, "frontends/db/routes/r/backend"},
+	}
+	for _, test := range tests {
+		kv := map[string]string{"svc/frontends/db/bind": "*:5432", "svc/frontends/db/mode": "tcp", "svc/frontends/db/default_backend": "db"}
+		for key, value := range test.keys {
+			kv["svc/"+key] = value
+		}
+		_, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil })
+		invalid, ok := err.(*invalidKeyError)
+		if !ok || invalid.Key != "svc/"+test.invalid {
+			t.Errorf("%v: expected %s to be invalid, got %v", test.keys, test.invalid, err)
+		}
+	}
+}
+
+func TestParseBalance(t *testing.T) {
+	tests := []struct {
+		balance, mode, expected string
+		err                     bool
+	}{
+		{"", "http", "roundrobin", false},
+		{"leastconn", "tcp", "leastconn", false},
+		{"source", "tcp", "source", false},
+		{"first", "http", "first", false},
+		{"uri", "http", "uri", false},
+		{"hdr(X-User)", "http", "hdr(X-User)", false},
+		{"url_param session", "http", "url_param session", false},
+		{"uri", "tcp", "", true},
+		{"hdr()", "http", "", true},
+		{"hdr(X User)", "http", "", true},
+		{"url_param", "http", "", true},
+		{"random", "http", "", true},
+	}
+	for _, test := range tests {
+		balance, err := parseBalance(test.balance, test.mode)
+		if (err != nil) != test.err || balance != test.expected {
+			t.Errorf("%q in %s mode: expected %q (error %v), got %q %v", test.balance, test.mode, test.expected, test.err, balance, err)
+		}
+	}
+}
+
+func TestParseHTTPCheck(t *testing.T) {
+	tests := []struct {
+		keys          map[string]string
+		check, expect string
+		invalid       string
+	}{
+		{map[string]string{"path": "/health"}, "GET /health", "", ""},
+		{map[string]string{"path": "/health", "method": "HEAD", "expect_status": "204"}, "HEAD /health", "status 204", ""},
+		{map[string]string{"path": "/", "host": "www.example.com", "expect_status": "2xx"}, `GET / HTTP/1.1\r\nHost:\ www.example.com`, "rstatus ^2", ""},
+		{map[string]string{"path": "/status", "expect_string": "all good"}, "GET /status", `string all\ good`, ""},
+		{map[string]string{"method": "GET"}, "", "", "path"},
+		{map[string]string{"path": "/a b"}, "", "", "path"},
+		{map[string]string{"path": "/", "method": "get"}, "", "", "method"},
+		{map[string]string{"path": "/", "host": "a b"}, "", "", "host"},
+		{map[string]string{"path": "/", "expect_status": "ok"}, "", "", "expect_status"},
+		{map[string]string{"path": "/", "expect_status": "200", "expect_string": "ok"}, "", "", "expect_string"},
+		{map[string]string{"path": "/", "timeout": "2s"}, "", "", "timeout"},
+	}
+	for _, test := range tests {
+		check, expect, err := parseHTTPCheck("b/http_check/", test.keys)
+		if test.invalid != "" {
+			if invalid, ok := err.(*invalidKeyError); !ok || invalid.Key != "b/http_check/"+test.invalid {
+				t.Errorf("%v: expected %s to be invalid, got %v", test.keys, test.invalid, err)
+			}
+			continue
+		}
+		if err != nil || check != test.check || expect != test.expect {
+			t.Errorf("%v: expected %q %q, got %q %q %v", test.keys, test.check, test.expect, check, expect, err)
+		}
+	}
+
+	kv := map[string]string{"svc/backends/db/tcp_check/1": "connect", "svc/backends/db/http_check/path": "/"}
+	if _, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil }); err == nil {
+		t.Error("expected a backend with both checks to be invalid")
+	}
+}
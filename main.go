@@ -1,19 +1,13 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"io"
 	"log"
 	"os"
 	"os/signal"
-	"syscall"
-
 	"path/filepath"
-
-	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
-	dockerClient "github.com/docker/docker/client"
+	"syscall"
 )
 
 var (
@@ -21,10 +15,84 @@ var (
 	ConfigDir = os.Getenv("CONFIG_DIR")
 	// InstanceID is the instance id of this device
 	InstanceID = os.Getenv("INSTANCE_ID")
-	// ConsulAddr is where consul-template can reach consul
+	// ConfigSourceName selects where the keys of the templates are read from: "consul" (the default), "etcd", "dir" or "api"
+	ConfigSourceName = os.Getenv("CONFIG_SOURCE")
+	// ConsulAddr is where the config is read from consul
 	ConsulAddr = os.Getenv("CONSUL_ADDRESS")
-	// ServiceName is the name of the service
-	ServiceName = "lb-haproxy"
+	// ConsulToken is the ACL token sent to consul
+	ConsulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+	// ConsulTokenFile is a file holding the ACL token sent to consul, which is read again for each request
+	ConsulTokenFile = os.Getenv("CONSUL_HTTP_TOKEN_FILE")
+	// ConsulSSL makes the manager reach consul over HTTPS
+	ConsulSSL = os.Getenv("CONSUL_HTTP_SSL") == "true"
+	// ConsulSkipVerify disables the verification of consul's certificate
+	ConsulSkipVerify = os.Getenv("CONSUL_HTTP_SSL_VERIFY") == "false"
+	// ConsulCACert is a PEM file of the CAs consul's certificate is verified with
+	ConsulCACert = os.Getenv("CONSUL_CACERT")
+	// ConsulClientCert and ConsulClientKey are the PEM files of the certificate the manager presents to consul
+	ConsulClientCert = os.Getenv("CONSUL_CLIENT_CERT")
+	ConsulClientKey  = os.Getenv("CONSUL_CLIENT_KEY")
+	// ConsulTLSServerName is the name consul's certificate is verified against, instead of the host of ConsulAddr
+	ConsulTLSServerName = os.Getenv("CONSUL_TLS_SERVER_NAME")
+	// EtcdAddr is where the config is read from etcd, through its JSON gateway
+	EtcdAddr = os.Getenv("ETCD_ADDRESS")
+	// ConfigSourceDir is the directory tree of key files read by the "dir" config source
+	ConfigSourceDir = os.Getenv("CONFIG_SOURCE_DIR")
+	// RenderWaitSetting is how long rendering waits for changes to settle, "min" or "min:max" e.g. 2s:10s
+	RenderWaitSetting = os.Getenv("RENDER_WAIT")
+	// DefaultServiceName is the name of the service which always exists, more services can be created through the API
+	DefaultServiceName = "lb-haproxy"
+	// HAProxyNetworkMode is the network mode of the HAProxy container, "host" runs it on the host network instead of publishing ports
+	HAProxyNetworkMode = os.Getenv("HAPROXY_NETWORK_MODE")
+	// DiscoveryNetwork enables the discovery of backend containers by their labels, HAProxy reaches them on this Docker network
+	DiscoveryNetwork = os.Getenv("DOCKER_DISCOVERY_NETWORK")
+	// HAProxyCPUs limits the number of CPUs available to HAProxy, e.g. 1.5
+	HAProxyCPUs = os.Getenv("HAPROXY_CPUS")
+	// HAProxyMemory limits the memory available to HAProxy, e.g. 512m
+	HAProxyMemory = os.Getenv("HAPROXY_MEMORY")
+	// HAProxyNoFile overrides the nofile ulimit of HAProxy, which is otherwise computed from the global maxconn
+	HAProxyNoFile = os.Getenv("HAPROXY_NOFILE")
+	// HAProxySysctls are comma separated key=value sysctls set in the HAProxy container
+	HAProxySysctls = os.Getenv("HAPROXY_SYSCTLS")
+	// RuntimeName selects how HAProxy is run, "docker" (the default) or "process"
+	RuntimeName = os.Getenv("RUNTIME")
+	// HAProxyBin is the haproxy binary used by the process runtime
+	HAProxyBin = os.Getenv("HAPROXY_BIN")
+	// StopOnExit stops the managed workloads when the manager shuts down. By default they are left running, so a
+	// restarted or upgraded manager adopts them without dropping traffic.
+	StopOnExit = os.Getenv("STOP_ON_EXIT") == "true"
+	// HealthcheckInterval is how often the managed workloads are probed, e.g. 10s
+	HealthcheckInterval = os.Getenv("HEALTHCHECK_INTERVAL")
+	// HealthcheckTimeout is how long a probe may take, e.g. 5s
+	HealthcheckTimeout = os.Getenv("HEALTHCHECK_TIMEOUT")
+	// HealthcheckRetries is how many probes have to fail in a row for a workload to be unhealthy
+	HealthcheckRetries = os.Getenv("HEALTHCHECK_RETRIES")
+	// HealthcheckRestartAfter is how many intervals a workload may stay unhealthy before it is restarted, 0 disables restarts
+	HealthcheckRestartAfter = os.Getenv("HEALTHCHECK_RESTART_AFTER")
+	// HAProxyHealthcheck selects the HAProxy probe: "stats" (the default) fetches the stats page, "socket" queries the stats socket, "none" disables it
+	HAProxyHealthcheck = os.Getenv("HAPROXY_HEALTHCHECK")
+	// SyslogUDPHost makes the access log receivers listen on UDP on this address instead of on a unix socket in each service's config dir
+	SyslogUDPHost = os.Getenv("SYSLOG_UDP_HOST")
+	// AccessLogMaxSize is the size at which access log files are rotated, e.g. 10m
+	AccessLogMaxSize = os.Getenv("ACCESS_LOG_MAX_SIZE")
+	// AnalyticsWindows are the comma separated windows traffic stats are kept for, e.g. 1m,5m,1h
+	AnalyticsWindows = os.Getenv("ANALYTICS_WINDOWS")
+	// MetricsAddr is where the traffic metrics are served, "none" disables them
+	MetricsAddr = os.Getenv("METRICS_ADDRESS")
+	// HAProxyLimits are the resource limits parsed from the settings above
+	HAProxyLimits resourceLimits
+	// TrafficWindows are the windows parsed from AnalyticsWindows
+	TrafficWindows = defaultAnalyticsWindows
+	// HealthSettings are the health probe settings parsed from the settings above
+	HealthSettings = defaultHealthSettings
+	// ConsulSettings are parsed from the consul settings above
+	ConsulSettings consulSettings
+	// RenderWait is parsed from RenderWaitSetting
+	RenderWait renderWait
+	// Source is the config source selected by ConfigSourceName
+	Source configSource = newConsulClient(ConsulSettings)
+	// Discovery finds the labelled backend containers, nil unless DiscoveryNetwork is set
+	Discovery *containerDiscovery
 )
 
 func copyFile(src, dest string) error {
@@ -48,109 +116,135 @@ func copyFile(src, dest string) error {
 	return nil
 }
 
-func ensureConfigDirectory() {
-	if ConfigDir == "" {
-		ConfigDir = "/etc/opencopilot"
+// shortID abbreviates a container ID for logging, process IDs are left as they are
+func shortID(id string) string {
+	if len(id) > 10 {
+		return id[:10]
 	}
-	confPath := filepath.Join(ConfigDir, "/services/", ServiceName)
-	log.Printf("ensuring the configuration path exists: %s", confPath)
-	err := os.MkdirAll(confPath, os.ModePerm)
+	return id
+}
+
+// logWorkloadOutput logs the last lines of output of a workload, to show why it exited
+func logWorkloadOutput(rt Runtime, name string) {
+	output, err := rt.Logs(name, 20)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("unable to get the output of %s: %v\n", name, err)
+		return
 	}
+	log.Printf("last output of %s:\n%s", name, output)
+}
 
-	configFilePath := filepath.Join(ConfigDir, "/services/", ServiceName, "/haproxy.cfg")
-	configTemplateFilePath := filepath.Join(ConfigDir, "/services/", ServiceName, "/haproxy.ctmpl")
+func main() {
+	log.SetOutput(redactingWriter{out: os.Stderr, secrets: Secrets})
 
-	if _, err := os.Stat(configFilePath); os.IsNotExist(err) { // if config doesn't exist, add the default
-		err := copyFile("./haproxy.cfg", configFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if ConfigDir == "" {
+		ConfigDir = "/etc/opencopilot"
 	}
 
-	if _, err := os.Stat(configTemplateFilePath); err == nil { // if config template exists, remove it
-		err = os.Remove(configTemplateFilePath)
-		if err != nil {
-			log.Fatal(err)
-		}
+	limits, err := parseResourceLimits()
+	if err != nil {
+		log.Fatal(err)
 	}
+	HAProxyLimits = limits
 
-	err = copyFile("./haproxy.ctmpl", configTemplateFilePath)
+	health, err := parseHealthSettings()
 	if err != nil {
 		log.Fatal(err)
 	}
+	HealthSettings = health
 
-}
+	if _, err := accessLogMaxSize(); err != nil {
+		log.Fatal(err)
+	}
 
-func isContainerRunning(dockerCli *dockerClient.Client, containerName string) (bool, *string, error) {
-	ctx := context.Background()
-	args := filters.NewArgs(
-		filters.Arg("name", containerName),
-	)
-	containers, err := dockerCli.ContainerList(ctx, dockerTypes.ContainerListOptions{
-		Filters: args,
-	})
+	windows, err := parseAnalyticsWindows()
 	if err != nil {
-		return false, nil, err
+		log.Fatal(err)
 	}
-	for _, container := range containers {
-		return true, &container.ID, nil
+	TrafficWindows = windows
+
+	wait, err := parseRenderWait()
+	if err != nil {
+		log.Fatal(err)
 	}
-	return false, nil, nil
-}
+	RenderWait = wait
 
-func waitForContainerStop(dockerCli *dockerClient.Client, containerID string) {
-	statusCh, errCh := dockerCli.ContainerWait(context.Background(), containerID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
+	simulate := flag.Bool("simulate", false, "run against an in-memory fake of Docker instead of a real daemon")
+	flag.Parse()
+
+	var rt Runtime
+	if *simulate {
+		log.Println("simulating, no containers will be run")
+		rt = newDockerRuntime(newFakeDocker())
+	} else {
+		rt, err = newRuntime(RuntimeName)
 		if err != nil {
 			log.Fatal(err)
 		}
-	case status := <-statusCh:
-		log.Printf("status: %v", status.StatusCode)
 	}
-}
-
-func main() {
-	log.Println("ensuring config directory")
-	ensureConfigDirectory()
-
-	dockerCli, err := dockerClient.NewClientWithOpts(dockerClient.WithVersion("1.37"))
-	if err != nil {
-		log.Fatal(err)
+	if DiscoveryNetwork != "" {
+		docker, ok := rt.(*dockerRuntime)
+		if !ok {
+			log.Fatal("DOCKER_DISCOVERY_NETWORK needs the docker runtime")
+		}
+		Discovery, err = newContainerDiscovery(docker, DiscoveryNetwork)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if ConsulAddr == "" {
 		ConsulAddr = "localhost:8500"
 	}
+	consul, err := parseConsulSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ConsulSettings = consul
+	if EtcdAddr == "" {
+		EtcdAddr = "localhost:2379"
+	}
+	if ConfigSourceDir == "" {
+		ConfigSourceDir = filepath.Join(ConfigDir, "/kv")
+	}
+	Source, err = newConfigSource(ConfigSourceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if HAProxyBin == "" {
+		HAProxyBin = "haproxy"
+	}
+	if MetricsAddr == "" {
+		MetricsAddr = ":9101"
+	}
 
 	sigs := make(chan os.Signal, 1)
-	stopEnsuringService := make(chan struct{}, 1)
-	stopEnsuringConsulTemplate := make(chan struct{}, 1)
-
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Println("starting consul-template")
-	go ensureConsulTemplate(dockerCli, stopEnsuringConsulTemplate)
-
-	log.Println("ensuring that HAProxy is running...")
-	go ensureService(dockerCli, stopEnsuringService)
+	m := newManager(rt)
+	log.Println("starting services")
+	if err := m.loadServices(); err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println("starting HAProxy Manager gRPC server")
-	go startServer(dockerCli)
-
-	// go pollConfig(dockerCli)
-	go watchConfig(dockerCli)
+	go startServer(m)
 
-	func() {
-		<-sigs
-		log.Println("received shutdown signal")
+	if MetricsAddr != "none" {
+		log.Printf("serving metrics on %s\n", MetricsAddr)
+		go startMetricsServer(m)
+	}
 
-		stopEnsuringConsulTemplate <- struct{}{}
-		stopConsulTemplate(dockerCli)
+	<-sigs
+	log.Println("received shutdown signal")
+	shutdownManager(m)
+}
 
-		stopEnsuringService <- struct{}{}
-		stopService(dockerCli)
-	}()
+// shutdownManager shuts the manager down, leaving the managed workloads running for the next manager to adopt unless
+// StopOnExit is set
+func shutdownManager(m *manager) {
+	if !StopOnExit {
+		log.Println("leaving managed workloads running")
+	}
+	m.shutdown(StopOnExit)
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `global
+    daemon
+    maxconn 500
+
+defaults
+    mode http
+
+listen stats
+    bind 127.0.0.1:8080
+
+frontend www
+    bind *:80
+`
+
+// setupConfigDir points ConfigDir at a temporary directory holding config as the service's haproxy.cfg.
+// The returned function removes it again.
+func setupConfigDir(t *testing.T, config string) func() {
+	dir, err := ioutil.TempDir("", "haproxy-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := ConfigDir
+	ConfigDir = dir
+	if err := os.MkdirAll(filepath.Join(dir, "/services/", DefaultServiceName), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, config)
+	return func() {
+		ConfigDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func writeConfig(t *testing.T, config string) {
+	err := ioutil.WriteFile(filepath.Join(ConfigDir, "/services/", DefaultServiceName, "/haproxy.cfg"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForRunning waits for a running container with the given name and an ID other than notID, returning its ID
+func waitForRunning(t *testing.T, docker *fakeDocker, name string, notID string) string {
+	id := ""
+	waitFor(t, name+" to be running", func() bool {
+		existing, err := docker.ContainerInspect(context.Background(), name)
+		if err != nil || !existing.State.Running || existing.ID == notID {
+			return false
+		}
+		id = existing.ID
+		return true
+	})
+	return id
+}
+
+// testManager returns a manager with the default service registered but not started
+func testManager(rt Runtime) *manager {
+	m := newManager(rt)
+	m.services[DefaultServiceName] = newService(DefaultServiceName, rt)
+	return m
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"path/filepath"
+)
+
+var (
+	errInvalidServiceName = errors.New("service names may only contain lowercase letters, digits and dashes")
+	errServiceExists      = errors.New("service already exists")
+	errServiceNotFound    = errors.New("service not found")
+	errDefaultService     = errors.New("the default service can't be deleted")
+)
+
+// manager runs the load balancer services of this host
+type manager struct {
+	rt Runtime
+
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+func newManager(rt Runtime) *manager {
+	return &manager{
+		rt:       rt,
+		services: map[string]*service{},
+	}
+}
+
+// loadServices starts the default service and every other service which has a config dir
+func (m *manager) loadServices() error {
+	names := []string{DefaultServiceName}
+	dirs, err := ioutil.ReadDir(filepath.Join(ConfigDir, "/services/"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && dir.Name() != DefaultServiceName && serviceNamePattern.MatchString(dir.Name()) {
+			names = append(names, dir.Name())
+		}
+	}
+	for _, name := range names {
+		if _, err := m.createService(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createService sets up a new service and starts it
+func (m *manager) createService(name string) (*service, error) {
+	if !serviceNamePattern.MatchString(name) {
+		return nil, errInvalidServiceName
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.services[name]; ok {
+		return nil, errServiceExists
+	}
+
+	svc := newService(name, m.rt)
+	if err := svc.ensureConfigDirectory(); err != nil {
+		return nil, err
+	}
+	svc.start()
+	m.services[name] = svc
+	return svc, nil
+}
+
+// deleteService stops a service and removes its config dir
+func (m *manager) deleteService(name string) error {
+	if name == DefaultServiceName {
+		return errDefaultService
+	}
+
+	m.mu.Lock()
+	svc, ok := m.services[name]
+	delete(m.services, name)
+	m.mu.Unlock()
+	if !ok {
+		return errServiceNotFound
+	}
+
+	log.Printf("deleting service %s\n", name)
+	svc.stop(true)
+	// keys set through the API belong to the service, unlike those kept in an external store
+	if api, ok := Source.(*apiSource); ok {
+		if err := api.set(svc.kvPrefix(), nil); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(svc.confDir())
+}
+
+// service returns the service with the given name, the default service if name is empty
+func (m *manager) service(name string) (*service, error) {
+	if name == "" {
+		name = DefaultServiceName
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	svc, ok := m.services[name]
+	if !ok {
+		return nil, errServiceNotFound
+	}
+	return svc, nil
+}
+
+func (m *manager) serviceNames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for name := range m.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shutdown stops all services, leaving their workloads running if stopWorkloads isn't set
+func (m *manager) shutdown(stopWorkloads bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, svc := range m.services {
+		svc.stop(stopWorkloads)
+	}
+}
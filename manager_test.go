@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadServicesFindsConfigDirs(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	for _, dir := range []string{"internal", "Not_A_Service"} {
+		if err := os.MkdirAll(filepath.Join(ConfigDir, "/services/", dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docker := newFakeDocker()
+	m := newManager(newDockerRuntime(docker))
+	if err := m.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.shutdown(true)
+
+	if names := m.serviceNames(); !reflect.DeepEqual(names, []string{"internal", DefaultServiceName}) {
+		t.Errorf("unexpected services: %v", names)
+	}
+	waitForRunning(t, docker, "com.opencopilot.service.internal", "")
+	if _, err := os.Stat(filepath.Join(ConfigDir, "/services/internal/haproxy.cfg")); err != nil {
+		t.Errorf("expected the default config to be installed: %v", err)
+	}
+}
+
+func TestCreateServicesWithDefaultConfig(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	m := newManager(newDockerRuntime(docker))
+	if err := m.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.shutdown(true)
+
+	// the new services don't take *:80 from the default service, nor from each other
+	for _, name := range []string{"internal", "staging"} {
+		svc, err := m.createService(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForRunning(t, docker, svc.haproxyName(), "")
+		config, err := ioutil.ReadFile(svc.configPath())
+		if err != nil || !strings.Contains(string(config), "bind /usr/local/etc/haproxy/http-in.sock") || strings.Contains(string(config), "*:80") {
+			t.Errorf("expected the default config of %s to bind its socket, got %q %v", name, config, err)
+		}
+		if events := svc.events.list(name); len(events) != 0 {
+			t.Errorf("expected %s to start without errors, got %+v", name, events)
+		}
+	}
+	waitForRunning(t, docker, m.services[DefaultServiceName].haproxyName(), "")
+}
+
+func TestDeleteServiceRemovesWorkloads(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	m := newManager(newDockerRuntime(docker))
+	defer m.shutdown(true)
+
+	svc, err := m.createService("internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRunning(t, docker, svc.haproxyName(), "")
+
+	if err := m.deleteService("internal"); err != nil {
+		t.Fatal(err)
+	}
+	if existing, err := docker.ContainerInspect(context.Background(), svc.haproxyName()); err == nil && existing.State.Running {
+		t.Error("expected HAProxy of the deleted service to be stopped")
+	}
+	if _, err := os.Stat(svc.confDir()); !os.IsNotExist(err) {
+		t.Errorf("expected the config dir to be removed, got %v", err)
+	}
+	if err := m.deleteService("internal"); err != errServiceNotFound {
+		t.Errorf("expected errServiceNotFound, got %v", err)
+	}
+}
+
+func TestRestartedManagerAdoptsHAProxy(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	m := newManager(newDockerRuntime(docker))
+	if err := m.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	name := m.services[DefaultServiceName].haproxyName()
+	id := waitForRunning(t, docker, name, "")
+	m.shutdown(false)
+	defer m.services[DefaultServiceName].stopSupervisor()
+
+	rt := newDockerRuntime(docker)
+	restarted := newManager(rt)
+	if err := restarted.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.shutdown(true)
+	// the supervisor waits for the container it started or adopted
+	waitFor(t, "HAProxy to be supervised", func() bool {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		return len(rt.waiters) > 0
+	})
+	rt.mu.Lock()
+	_, adopted := rt.waiters[id]
+	rt.mu.Unlock()
+	if !adopted {
+		t.Errorf("expected the running bridge-mode container %s to be adopted rather than recreated", shortID(id))
+	}
+}
+
+func TestShutdownLeavesWorkloadsRunning(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	m := newManager(newDockerRuntime(docker))
+	if err := m.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	name := m.services[DefaultServiceName].haproxyName()
+	id := waitForRunning(t, docker, name, "")
+	shutdownManager(m)
+	// the supervisor of the first manager is left running, it is ended with the test so it doesn't outlive the config dir
+	defer m.services[DefaultServiceName].stopSupervisor()
+	if existing, err := docker.ContainerInspect(context.Background(), name); err != nil || !existing.State.Running || existing.ID != id {
+		t.Fatalf("expected HAProxy to be left running, got %v", err)
+	}
+
+	previous := StopOnExit
+	StopOnExit = true
+	defer func() { StopOnExit = previous }()
+	restarted := newManager(newDockerRuntime(docker))
+	if err := restarted.loadServices(); err != nil {
+		t.Fatal(err)
+	}
+	waitForRunning(t, docker, name, "")
+	shutdownManager(restarted)
+	// by its ID, as the supervisor of the first manager, which was left running, starts HAProxy again
+	if existing, err := docker.ContainerInspect(context.Background(), id); err == nil && existing.State.Running {
+		t.Error("expected the adopted HAProxy to be stopped with STOP_ON_EXIT")
+	}
+}
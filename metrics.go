@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsHandler serves the traffic stats of all services in the Prometheus text format
+type metricsHandler struct {
+	manager *manager
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeTrafficMetrics(w, h.manager, time.Now())
+}
+
+// trafficMetric is a metric family written by writeTrafficMetrics
+type trafficMetric struct {
+	name string
+	help string
+	// samples returns the label sets (after the service, backend, server and window labels) and values of a backend or server
+	samples func(c *trafficCounters) ([]string, []float64)
+}
+
+var trafficMetrics = []trafficMetric{
+	{
+		name: "haproxy_manager_requests",
+		help: "Requests logged during the window.",
+		samples: func(c *trafficCounters) ([]string, []float64) {
+			return []string{""}, []float64{float64(c.Requests)}
+		},
+	},
+	{
+		name: "haproxy_manager_latency_milliseconds",
+		help: "Estimated quantiles of the response time (tr) and total time (tt) of requests during the window.",
+		samples: func(c *trafficCounters) ([]string, []float64) {
+			labels := []string{}
+			values := []float64{}
+			for _, timer := range []struct {
+				name string
+				h    *latencyHistogram
+			}{{"tr", &c.Tr}, {"tt", &c.Tt}} {
+				for _, q := range []float64{0.5, 0.9, 0.99} {
+					labels = append(labels, fmt.Sprintf(`,timer="%s",quantile="%s"`, timer.name, strconv.FormatFloat(q, 'f', -1, 64)))
+					values = append(values, timer.h.quantile(q))
+				}
+			}
+			return labels, values
+		},
+	},
+	{
+		name: "haproxy_manager_responses",
+		help: "Responses by status code during the window.",
+		samples: func(c *trafficCounters) ([]string, []float64) {
+			labels := []string{}
+			values := []float64{}
+			statuses := []int{}
+			for status := range c.Statuses {
+				statuses = append(statuses, status)
+			}
+			sort.Ints(statuses)
+			for _, status := range statuses {
+				labels = append(labels, fmt.Sprintf(`,status="%d"`, status))
+				values = append(values, float64(c.Statuses[status]))
+			}
+			return labels, values
+		},
+	},
+	{
+		name: "haproxy_manager_terminations",
+		help: "Sessions by termination state (cause and state) during the window.",
+		samples: func(c *trafficCounters) ([]string, []float64) {
+			labels := []string{}
+			values := []float64{}
+			states := []string{}
+			for state := range c.Terminations {
+				states = append(states, state)
+			}
+			sort.Strings(states)
+			for _, state := range states {
+				labels = append(labels, fmt.Sprintf(`,state="%s"`, escapeLabel(state)))
+				values = append(values, float64(c.Terminations[state]))
+			}
+			return labels, values
+		},
+	},
+}
+
+func writeTrafficMetrics(w io.Writer, m *manager, now time.Time) {
+	type snapshot struct {
+		service  string
+		window   time.Duration
+		counters map[trafficKey]*trafficCounters
+	}
+	snapshots := []snapshot{}
+	for _, name := range m.serviceNames() {
+		svc, err := m.service(name)
+		if err != nil || svc.accessLog == nil {
+			continue
+		}
+		stats := svc.accessLog.stats
+		for _, window := range stats.windows {
+			snapshots = append(snapshots, snapshot{name, window, stats.snapshot(window, now)})
+		}
+	}
+
+	for _, metric := range trafficMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, s := range snapshots {
+			for _, key := range sortedTrafficKeys(s.counters) {
+				common := fmt.Sprintf(`service="%s",backend="%s",server="%s",window="%s"`,
+					escapeLabel(s.service), escapeLabel(key.Backend), escapeLabel(key.Server), s.window)
+				labels, values := metric.samples(s.counters[key])
+				for i := range labels {
+					fmt.Fprintf(w, "%s{%s%s} %s\n", metric.name, common, labels[i], strconv.FormatFloat(values[i], 'g', -1, 64))
+				}
+			}
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// startMetricsServer serves the metrics on MetricsAddr
+func startMetricsServer(m *manager) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &metricsHandler{manager: m})
+	if err := http.ListenAndServe(MetricsAddr, mux); err != nil {
+		log.Printf("failed to serve metrics: %v\n", err)
+	}
+}
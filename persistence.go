@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// The persistence modes of a backend's sticky sessions
+const (
+	// stickyCookieInsert has HAProxy set a cookie naming the server
+	stickyCookieInsert = "cookie_insert"
+	// stickyCookiePrefix has HAProxy prefix the application's own cookie with the server
+	stickyCookiePrefix = "cookie_prefix"
+	// stickySource keeps the server of each client address in a stick table
+	stickySource = "source"
+)
+
+// tableSizePattern is a stick table size, with an optional k, m or g suffix
+var tableSizePattern = regexp.MustCompile(`^[0-9]+[kmg]?$`)
+
+// parseSticky reads the sticky keys of a backend into its persistence lines, and whether its servers need a cookie:
+//
+//	mode       cookie_insert, cookie_prefix or source
+//	cookie     the cookie's name, SERVERID by default with cookie_insert
+//	secure     true to only send an inserted cookie over HTTPS
+//	httponly   true to hide an inserted cookie from scripts
+//	domain     the domain of an inserted cookie
+//	maxidle    how long an inserted cookie lasts without requests, e.g. 30m
+//	maxlife    how long an inserted cookie lasts at most, e.g. 8h
+//	expire     how long a client address is remembered without connections, 30m by default
+//	size       how many client addresses are remembered, 100k by default
+func parseSticky(prefix, mode string, keys map[string]string) ([]string, bool, error) {
+	allowed := map[string][]string{
+		stickyCookieInsert: {"mode", "cookie", "secure", "httponly", "domain", "maxidle", "maxlife"},
+		stickyCookiePrefix: {"mode", "cookie"},
+		stickySource:       {"mode", "expire", "size"},
+	}
+	sticky := keys["mode"]
+	settings, ok := allowed[sticky]
+	if !ok {
+		return nil, false, &invalidKeyError{prefix + "mode", fmt.Sprintf("unknown sticky mode %q, it is cookie_insert, cookie_prefix or source", sticky)}
+	}
+	for key, value := range keys {
+		if !containsString(settings, key) {
+			return nil, false, &invalidKeyError{prefix + key, "not a setting of the " + sticky + " mode"}
+		}
+		if strings.ContainsAny(value, " \t\r\n#;,") {
+			return nil, false, &invalidKeyError{prefix + key, fmt.Sprintf("%q can't contain spaces, # ; or ,", value)}
+		}
+	}
+	for _, key := range []string{"maxidle", "maxlife", "expire"} {
+		if value := keys[key]; value != "" && !haproxyTimePattern.MatchString(value) {
+			return nil, false, &invalidKeyError{prefix + key, fmt.Sprintf("%q isn't a time such as 30m", value)}
+		}
+	}
+	for _, key := range []string{"secure", "httponly"} {
+		if value := keys[key]; value != "" && value != "true" && value != "false" {
+			return nil, false, &invalidKeyError{prefix + key, "it is true or false"}
+		}
+	}
+
+	if sticky == stickySource {
+		size, expire := keys["size"], keys["expire"]
+		if size == "" {
+			size = "100k"
+		}
+		if !tableSizePattern.MatchString(size) {
+			return nil, false, &invalidKeyError{prefix + "size", fmt.Sprintf("%q isn't a size such as 100k", size)}
+		}
+		if expire == "" {
+			expire = "30m"
+		}
+		return []string{"stick-table type ip size " + size + " expire " + expire, "stick on src"}, false, nil
+	}
+
+	if mode != "http" {
+		return nil, false, &invalidKeyError{prefix + "mode", "cookies need http mode"}
+	}
+	cookie := keys["cookie"]
+	if cookie == "" && sticky == stickyCookiePrefix {
+		return nil, false, &invalidKeyError{prefix + "cookie", "cookie_prefix needs the name of the application's cookie"}
+	}
+	if cookie == "" {
+		cookie = "SERVERID"
+	}
+	if !headerNamePattern.MatchString(cookie) {
+		return nil, false, &invalidKeyError{prefix + "cookie", fmt.Sprintf("%q isn't a cookie name", cookie)}
+	}
+	if sticky == stickyCookiePrefix {
+		return []string{"cookie " + cookie + " prefix nocache"}, true, nil
+	}
+	line := "cookie " + cookie + " insert indirect nocache"
+	if keys["secure"] == "true" {
+		line += " secure"
+	}
+	if keys["httponly"] == "true" {
+		line += " httponly"
+	}
+	for _, key := range []string{"domain", "maxidle", "maxlife"} {
+		if value := keys[key]; value != "" {
+			line += " " + key + " " + value
+		}
+	}
+	return []string{line}, true, nil
+}
+
+// backendPersistence is the sticky sessions of a backend in the installed config, with the use of its stick table
+type backendPersistence struct {
+	Backend string
+	Mode    string
+	Cookie  string
+	Expire  string
+	// Table is nil without a stick table, or when HAProxy couldn't be asked about it
+	Table *stickTable
+}
+
+// parsePersistence reads the sticky sessions of the backends of the HAProxy config at path
+func parsePersistence(path string) ([]*backendPersistence, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	all := []*backendPersistence{}
+	var current *backendPersistence
+	backend := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "global", "defaults", "frontend", "listen", "backend", "userlist", "peers", "resolvers":
+			backend, current = "", nil
+			if fields[0] == "backend" && len(fields) > 1 {
+				backend = fields[1]
+			}
+			continue
+		}
+		if backend == "" || current != nil {
+			continue
+		}
+		switch {
+		case fields[0] == "cookie" && len(fields) > 2 && fields[2] == "insert":
+			current = &backendPersistence{Backend: backend, Mode: stickyCookieInsert, Cookie: fields[1]}
+		case fields[0] == "cookie" && len(fields) > 2 && fields[2] == "prefix":
+			current = &backendPersistence{Backend: backend, Mode: stickyCookiePrefix, Cookie: fields[1]}
+		case fields[0] == "stick-table":
+			current = &backendPersistence{Backend: backend, Mode: stickySource}
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "expire" {
+					current.Expire = fields[i+1]
+				}
+			}
+		default:
+			continue
+		}
+		all = append(all, current)
+	}
+	return all, scanner.Err()
+}
+
+// stickTable is a stick table as listed by HAProxy's show table
+type stickTable struct {
+	Name string
+	Type string
+	Size int64
+	Used int64
+}
+
+var stickTableHeader = regexp.MustCompile(`^# table: ([^,]+), type: ([^,]+), size:([0-9]+), used:([0-9]+)`)
+
+// parseStickTables reads the table headers of the output of show table
+func parseStickTables(output string) []stickTable {
+	tables := []stickTable{}
+	for _, line := range strings.Split(output, "\n") {
+		match := stickTableHeader.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(match[3], 10, 64)
+		used, _ := strconv.ParseInt(match[4], 10, 64)
+		tables = append(tables, stickTable{Name: match[1], Type: match[2], Size: size, Used: used})
+	}
+	return tables
+}
+
+// persistence returns the sticky sessions of the service's backends, with the use of their stick tables when
+// HAProxy answers on its admin socket
+func (svc *service) persistence() []*backendPersistence {
+	all, err := parsePersistence(svc.configPath())
+	if err != nil {
+		return nil
+	}
+	tables := map[string]stickTable{}
+	if output, err := svc.haproxyCommand("show table"); err == nil {
+		for _, table := range parseStickTables(output) {
+			tables[table.Name] = table
+		}
+	}
+	for _, p := range all {
+		if table, ok := tables[p.Backend]; ok {
+			p.Table = &table
+		}
+	}
+	return all
+}
+
+func persistenceToProto(all []*backendPersistence) []*pb.BackendPersistence {
+	out := []*pb.BackendPersistence{}
+	for _, p := range all {
+		persistence := &pb.BackendPersistence{
+			Backend: p.Backend,
+			Mode:    p.Mode,
+			Cookie:  p.Cookie,
+			Expire:  p.Expire,
+		}
+		if p.Table != nil {
+			persistence.TableSize = p.Table.Size
+			persistence.TableUsed = p.Table.Used
+		}
+		out = append(out, persistence)
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSticky(t *testing.T) {
+	tests := []struct {
+		mode    string
+		keys    map[string]string
+		lines   []string
+		cookies bool
+		invalid string
+	}{
+		{"http", map[string]string{"mode": "cookie_insert"}, []string{"cookie SERVERID insert indirect nocache"}, true, ""},
+		{"http", map[string]string{"mode": "cookie_insert", "cookie": "LB", "secure": "true", "httponly": "true", "domain": ".example.com", "maxidle": "30m", "maxlife": "8h"},
+			[]string{"cookie LB insert indirect nocache secure httponly domain .example.com maxidle 30m maxlife 8h"}, true, ""},
+		{"http", map[string]string{"mode": "cookie_prefix", "cookie": "JSESSIONID"}, []string{"cookie JSESSIONID prefix nocache"}, true, ""},
+		{"tcp", map[string]string{"mode": "source"}, []string{"stick-table type ip size 100k expire 30m", "stick on src"}, false, ""},
+		{"http", map[string]string{"mode": "source", "size": "1m", "expire": "2h"}, []string{"stick-table type ip size 1m expire 2h", "stick on src"}, false, ""},
+		{"http", map[string]string{"cookie": "LB"}, nil, false, "mode"},
+		{"http", map[string]string{"mode": "ip_hash"}, nil, false, "mode"},
+		{"tcp", map[string]string{"mode": "cookie_insert"}, nil, false, "mode"},
+		{"http", map[string]string{"mode": "cookie_prefix"}, nil, false, "cookie"},
+		{"http", map[string]string{"mode": "cookie_insert", "cookie": "a=b"}, nil, false, "cookie"},
+		{"http", map[string]string{"mode": "cookie_insert", "domain": "a b"}, nil, false, "domain"},
+		{"http", map[string]string{"mode": "cookie_insert", "maxidle": "soon"}, nil, false, "maxidle"},
+		{"http", map[string]string{"mode": "cookie_insert", "secure": "yes"}, nil, false, "secure"},
+		{"http", map[string]string{"mode": "cookie_insert", "expire": "30m"}, nil, false, "expire"},
+		{"http", map[string]string{"mode": "cookie_prefix", "domain": "example.com"}, nil, false, "domain"},
+		{"tcp", map[string]string{"mode": "source", "size": "lots"}, nil, false, "size"},
+	}
+	for _, test := range tests {
+		lines, cookies, err := parseSticky("b/sticky/", test.mode, test.keys)
+		if test.invalid != "" {
+			if invalid, ok := err.(*invalidKeyError); !ok || invalid.Key != "b/sticky/"+test.invalid {
+				t.Errorf("%v in %s mode: expected %s to be invalid, got %v", test.keys, test.mode, test.invalid, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(lines, test.lines) || cookies != test.cookies {
+			t.Errorf("%v in %s mode: expected %q %v, got %q %v %v", test.keys, test.mode, test.lines, test.cookies, lines, cookies, err)
+		}
+	}
+
+	kv := map[string]string{
+		"svc/backends/web/servers/w1":  "10.0.0.1:80",
+		"svc/backends/web/sticky/mode": "cookie_insert",
+	}
+	lb, err := loadLoadBalancer(kv, "svc/", func(catalogQuery) []catalogInstance { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range lb.Backends {
+		if backend.Name == "web" && !reflect.DeepEqual(backend.Servers[0].Options, []string{"check", "cookie w1"}) {
+			t.Errorf("expected the server to be named by its cookie, got %v", backend.Servers[0].Options)
+		}
+	}
+}
+
+func TestParsePersistence(t *testing.T) {
+	path := writeTempConfig(t, `global
+    stats socket /var/run/haproxy.sock mode 600 level admin
+
+frontend www
+    bind *:80
+    default_backend web
+
+backend web
+    mode http
+    cookie SERVERID insert indirect nocache httponly
+    server w1 10.0.0.1:80 check cookie w1
+
+backend db
+    mode tcp
+    stick-table type ip size 100k expire 30m
+    stick on src
+
+backend static
+    server s1 10.0.0.2:80 check
+`)
+	all, err := parsePersistence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*backendPersistence{
+		{Backend: "web", Mode: stickyCookieInsert, Cookie: "SERVERID"},
+		{Backend: "db", Mode: stickySource, Expire: "30m"},
+	}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("expected %+v, got %+v", expected, all)
+	}
+}
+
+// startFakeAdminSocket answers the commands sent to the service's admin socket with answer
+func startFakeAdminSocket(t *testing.T, svc *service, answer func(command string) string) func() {
+	listener, err := net.Listen("unix", svc.adminSocketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			command := make([]byte, 256)
+			n, _ := conn.Read(command)
+			conn.Write([]byte(answer(strings.TrimSpace(string(command[:n])))))
+			conn.Close()
+		}
+	}()
+	return func() { listener.Close() }
+}
+
+func TestServicePersistence(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	svc := newService(DefaultServiceName, newDockerRuntime(newFakeDocker()))
+	config := "global\n    maxconn 500\n\nbackend db\n    stick-table type ip size 100k expire 1h\n    stick on src\n"
+	if err := ioutil.WriteFile(svc.configPath(), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	all := svc.persistence()
+	if len(all) != 1 || all[0].Table != nil {
+		t.Fatalf("expected the persistence without its table while HAProxy is down, got %+v", all)
+	}
+
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		if command != "show table" {
+			return "Unknown command.\n"
+		}
+		return "# table: db, type: ip, size:102400, used:42\n\n"
+	})()
+	all = svc.persistence()
+	if len(all) != 1 || all[0].Table == nil || all[0].Table.Size != 102400 || all[0].Table.Used != 42 {
+		t.Fatalf("expected the use of the stick table, got %+v", all)
+	}
+	status := persistenceToProto(all)[0]
+	if status.Backend != "db" || status.Mode != stickySource || status.Expire != "1h" || status.TableUsed != 42 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if _, err := svc.haproxyCommand("show everything"); err == nil {
+		t.Error("expected an unknown command to fail")
+	}
+}
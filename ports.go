@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+)
+
+// bindAddr is a TCP listening address taken from a bind line in the HAProxy config
+type bindAddr struct {
+	IP   string
+	Port int
+}
+
+// parseBindAddrs reads the HAProxy config at path and returns every TCP address it binds to
+func parseBindAddrs(path string) ([]bindAddr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	addrs := []bindAddr{}
+	seen := map[bindAddr]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "bind" {
+			continue
+		}
+		for _, raw := range strings.Split(fields[1], ",") {
+			parsed, err := parseBindAddr(raw)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range parsed {
+				if !seen[addr] {
+					seen[addr] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return addrs, scanner.Err()
+}
+
+// parseBindAddr parses a single HAProxy bind address, such as *:80, 127.0.0.1:8080, [::]:443 or :8000-8005.
+// Addresses which aren't TCP ports (unix sockets, abstract namespaces, file descriptors) are ignored.
+func parseBindAddr(raw string) ([]bindAddr, error) {
+	if strings.HasPrefix(raw, "ipv4@") || strings.HasPrefix(raw, "ipv6@") {
+		raw = raw[5:]
+	} else if strings.Contains(raw, "@") || strings.HasPrefix(raw, "/") {
+		return nil, nil
+	}
+
+	i := strings.LastIndex(raw, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("bind address %q has no port", raw)
+	}
+	ip := strings.Trim(raw[:i], "[]")
+	if ip == "*" || ip == "" || ip == "::" {
+		ip = "0.0.0.0"
+	}
+
+	first, last, err := nat.ParsePortRange(raw[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("bind address %q: %v", raw, err)
+	}
+	addrs := []bindAddr{}
+	for port := first; port <= last; port++ {
+		addrs = append(addrs, bindAddr{IP: ip, Port: int(port)})
+	}
+	return addrs, nil
+}
+
+// portMappings computes the container ports to expose and publish for a set of bind addresses
+func portMappings(addrs []bindAddr) (nat.PortSet, nat.PortMap) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, addr := range addrs {
+		port := nat.Port(strconv.Itoa(addr.Port) + "/tcp")
+		exposed[port] = struct{}{}
+		bindings[port] = append(bindings[port], nat.PortBinding{HostIP: addr.IP, HostPort: strconv.Itoa(addr.Port)})
+	}
+	return exposed, bindings
+}
+
+// publishedPortConflicts returns the bind addresses that are already published by a container other than ownName
+func publishedPortConflicts(dockerCli dockerAPI, ownName string, addrs []bindAddr) ([]bindAddr, error) {
+	containers, err := dockerCli.ContainerList(context.Background(), dockerTypes.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []bindAddr{}
+	for _, c := range containers {
+		if containerHasName(c, ownName) {
+			continue
+		}
+		for _, p := range c.Ports {
+			if p.PublicPort == 0 || p.Type != "tcp" {
+				continue
+			}
+			for _, addr := range addrs {
+				if int(p.PublicPort) == addr.Port && ipsOverlap(p.IP, addr.IP) {
+					log.Printf("port %s:%d is already published by container %s\n", addr.IP, addr.Port, c.ID[:10])
+					conflicts = append(conflicts, addr)
+				}
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+func containerHasName(c dockerTypes.Container, name string) bool {
+	for _, n := range c.Names {
+		if strings.TrimPrefix(n, "/") == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ipsOverlap(a, b string) bool {
+	a, b = normalizeHostIP(a), normalizeHostIP(b)
+	return a == b || net.ParseIP(a).IsUnspecified() || net.ParseIP(b).IsUnspecified()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBindAddr(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected []bindAddr
+	}{
+		{"*:80", []bindAddr{{"0.0.0.0", 80}}},
+		{":443", []bindAddr{{"0.0.0.0", 443}}},
+		{"127.0.0.1:8080", []bindAddr{{"127.0.0.1", 8080}}},
+		{"ipv4@10.0.0.1:25", []bindAddr{{"10.0.0.1", 25}}},
+		{"[::]:80", []bindAddr{{"0.0.0.0", 80}}},
+		{"*:8000-8002", []bindAddr{{"0.0.0.0", 8000}, {"0.0.0.0", 8001}, {"0.0.0.0", 8002}}},
+		{"/var/run/haproxy.sock", nil},
+		{"abns@haproxy", nil},
+	}
+	for _, test := range tests {
+		addrs, err := parseBindAddr(test.raw)
+		if err != nil {
+			t.Errorf("%s: %v", test.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.raw, test.expected, addrs)
+		}
+	}
+
+	if _, err := parseBindAddr("localhost"); err == nil {
+		t.Error("expected an error for an address without a port")
+	}
+}
+
+func TestGlobalMaxconn(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	path := filepath.Join(ConfigDir, "/services/", DefaultServiceName, "/haproxy.cfg")
+	if maxconn := globalMaxconn(path); maxconn != 500 {
+		t.Errorf("expected maxconn 500, got %d", maxconn)
+	}
+
+	writeConfig(t, "global\n    daemon\n\nfrontend www\n    maxconn 100\n    bind *:80\n")
+	if maxconn := globalMaxconn(path); maxconn != defaultMaxconn {
+		t.Errorf("expected the default maxconn, got %d", maxconn)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// The responses to clients over a rate limit
+const (
+	// rateLimitDeny answers 429 Too Many Requests, or closes the connection in tcp mode
+	rateLimitDeny = "deny"
+	// rateLimitTarpit holds the request until the tarpit timeout before answering 429, which slows scrapers down
+	rateLimitTarpit = "tarpit"
+	// rateLimitSilentDrop closes the connection without telling the client, which keeps waiting for an answer
+	rateLimitSilentDrop = "silent_drop"
+)
+
+var (
+	// requestRatePattern is a request rate such as 100/10s
+	requestRatePattern = regexp.MustCompile(`^([0-9]+)/([0-9]+(ms|s|m|h|d)?)$`)
+	// rateLimitHeaderPattern is a key tracking the clients by a request header, such as hdr(X-Api-Key)
+	rateLimitHeaderPattern = regexp.MustCompile(`^hdr\((.+)\)$`)
+)
+
+// parseRateLimit reads the rate_limit keys of a frontend into its tracking and limiting lines:
+//
+//	requests      the most requests of a client in a period, e.g. 100/10s, in http mode
+//	connections   the most concurrent connections of a client
+//	key           what tells clients apart: src (the default), path or hdr(<name>) in http mode
+//	action        deny (the default), tarpit or silent_drop, tarpit in http mode
+//	expire        how long a client is tracked without requests, 10m by default
+//	size          how many clients are tracked, 100k by default
+//
+// The frontend's stick table tracks the clients, and is named after the frontend.
+func parseRateLimit(prefix, mode string, keys map[string]string) ([]string, error) {
+	for key, value := range keys {
+		if !containsString([]string{"requests", "connections", "key", "action", "expire", "size"}, key) {
+			return nil, &invalidKeyError{prefix + key, "not a rate limit setting"}
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, &invalidKeyError{prefix + key, "values can't span several lines"}
+		}
+	}
+
+	stores, conditions := []string{}, []string{}
+	if requests := keys["requests"]; requests != "" {
+		match := requestRatePattern.FindStringSubmatch(requests)
+		if match == nil || match[1] == "0" {
+			return nil, &invalidKeyError{prefix + "requests", fmt.Sprintf("%q isn't a rate such as 100/10s", requests)}
+		}
+		if mode != "http" {
+			return nil, &invalidKeyError{prefix + "requests", "requests are only counted in http mode"}
+		}
+		stores = append(stores, "http_req_rate("+match[2]+")")
+		conditions = append(conditions, "{ sc_http_req_rate(0) gt "+match[1]+" }")
+	}
+	if connections := keys["connections"]; connections != "" {
+		limit, err := strconv.Atoi(connections)
+		if err != nil || limit < 1 {
+			return nil, &invalidKeyError{prefix + "connections", fmt.Sprintf("%q isn't a number of connections", connections)}
+		}
+		stores = append(stores, "conn_cur")
+		conditions = append(conditions, "{ sc_conn_cur(0) gt "+strconv.Itoa(limit)+" }")
+	}
+	if len(conditions) == 0 {
+		return nil, &invalidKeyError{prefix, "a rate limit needs requests or connections"}
+	}
+
+	tableType, track := "ip", "tcp-request connection track-sc0 src"
+	key := keys["key"]
+	switch match := rateLimitHeaderPattern.FindStringSubmatch(key); {
+	case key == "" || key == "src":
+	case key == "path" && mode == "http":
+		tableType, track = "string len 128", "http-request track-sc0 path"
+	case match != nil && mode == "http" && headerNamePattern.MatchString(match[1]):
+		tableType, track = "string len 64", "http-request track-sc0 req.hdr("+match[1]+")"
+	case mode != "http":
+		return nil, &invalidKeyError{prefix + "key", "tcp frontends track clients by their src"}
+	default:
+		return nil, &invalidKeyError{prefix + "key", fmt.Sprintf("unknown key %q, it is src, path or hdr(<name>)", key)}
+	}
+
+	size, expire := keys["size"], keys["expire"]
+	if size == "" {
+		size = "100k"
+	}
+	if !tableSizePattern.MatchString(size) {
+		return nil, &invalidKeyError{prefix + "size", fmt.Sprintf("%q isn't a size such as 100k", size)}
+	}
+	if expire == "" {
+		expire = "10m"
+	}
+	if !haproxyTimePattern.MatchString(expire) {
+		return nil, &invalidKeyError{prefix + "expire", fmt.Sprintf("%q isn't a time such as 10m", expire)}
+	}
+
+	condition := strings.Join(conditions, " || ")
+	rule := ""
+	switch action := keys["action"]; {
+	case (action == "" || action == rateLimitDeny) && mode == "http":
+		rule = "http-request deny deny_status 429 if " + condition
+	case action == rateLimitTarpit && mode == "http":
+		rule = "http-request tarpit deny_status 429 if " + condition
+	case action == rateLimitSilentDrop && mode == "http":
+		rule = "http-request silent-drop if " + condition
+	case action == "" || action == rateLimitDeny:
+		rule = "tcp-request connection reject if " + condition
+	case action == rateLimitSilentDrop:
+		rule = "tcp-request connection silent-drop if " + condition
+	case action == rateLimitTarpit:
+		return nil, &invalidKeyError{prefix + "action", "tarpit needs http mode"}
+	default:
+		return nil, &invalidKeyError{prefix + "action", fmt.Sprintf("unknown action %q, it is deny, tarpit or silent_drop", action)}
+	}
+	return []string{
+		"stick-table type " + tableType + " size " + size + " expire " + expire + " store " + strings.Join(stores, ","),
+		track,
+		rule,
+	}, nil
+}
+
+// rateLimitedFrontends returns the frontends with a stick table in the HAProxy config at path
+func rateLimitedFrontends(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	frontends := []string{}
+	frontend := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "global", "defaults", "frontend", "listen", "backend", "userlist", "peers", "resolvers":
+			frontend = ""
+			if fields[0] == "frontend" && len(fields) > 1 {
+				frontend = fields[1]
+			}
+		case "stick-table":
+			if frontend != "" {
+				frontends = append(frontends, frontend)
+				frontend = ""
+			}
+		}
+	}
+	return frontends, scanner.Err()
+}
+
+// trackedCounter is an entry of a stick table, the counters of one client
+type trackedCounter struct {
+	Table string
+	Key   string
+	// Expire is in how many milliseconds the entry expires without activity
+	Expire int64
+	// Counters are the stored data by their names, such as conn_cur or http_req_rate(10000)
+	Counters map[string]int64
+}
+
+var tableEntryPattern = regexp.MustCompile(`^0x[0-9a-f]+: key=(\S+) use=[0-9]+ exp=([0-9]+)(.*)$`)
+
+// parseTableEntries reads the entries of the output of show table <name>
+func parseTableEntries(table, output string) []trackedCounter {
+	entries := []trackedCounter{}
+	for _, line := range strings.Split(output, "\n") {
+		match := tableEntryPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		expire, _ := strconv.ParseInt(match[2], 10, 64)
+		entry := trackedCounter{Table: table, Key: match[1], Expire: expire, Counters: map[string]int64{}}
+		for _, field := range strings.Fields(match[3]) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if value, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				entry.Counters[parts[0]] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// rateLimitCounters returns the clients tracked by the rate limits of the service's frontends, or of one frontend
+func (svc *service) rateLimitCounters(frontend string) ([]trackedCounter, error) {
+	frontends, err := rateLimitedFrontends(svc.configPath())
+	if err != nil {
+		return nil, err
+	}
+	counters := []trackedCounter{}
+	for _, name := range frontends {
+		if frontend != "" && name != frontend {
+			continue
+		}
+		output, err := svc.haproxyCommand("show table " + name)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, parseTableEntries(name, output)...)
+	}
+	return counters, nil
+}
+
+func trackedCountersToProto(counters []trackedCounter) []*pb.TrackedCounter {
+	out := []*pb.TrackedCounter{}
+	for _, counter := range counters {
+		tracked := &pb.TrackedCounter{
+			Frontend: counter.Table,
+			Key:      counter.Key,
+			ExpireMs: counter.Expire,
+			ConnCur:  counter.Counters["conn_cur"],
+		}
+		for name, value := range counter.Counters {
+			if strings.HasPrefix(name, "http_req_rate(") {
+				tracked.HttpReqRate = value
+			}
+		}
+		out = append(out, tracked)
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		mode    string
+		keys    map[string]string
+		lines   []string
+		invalid string
+	}{
+		{"http", map[string]string{"requests": "100/10s"}, []string{
+			"stick-table type ip size 100k expire 10m store http_req_rate(10s)",
+			"tcp-request connection track-sc0 src",
+			"http-request deny deny_status 429 if { sc_http_req_rate(0) gt 100 }",
+		}, ""},
+		{"http", map[string]string{"requests": "20/1m", "connections": "10", "action": "tarpit", "size": "1m", "expire": "1h"}, []string{
+			"stick-table type ip size 1m expire 1h store http_req_rate(1m),conn_cur",
+			"tcp-request connection track-sc0 src",
+			"http-request tarpit deny_status 429 if { sc_http_req_rate(0) gt 20 } || { sc_conn_cur(0) gt 10 }",
+		}, ""},
+		{"http", map[string]string{"requests": "1000/1h", "key": "hdr(X-Api-Key)", "action": "silent_drop"}, []string{
+			"stick-table type string len 64 size 100k expire 10m store http_req_rate(1h)",
+			"http-request track-sc0 req.hdr(X-Api-Key)",
+			"http-request silent-drop if { sc_http_req_rate(0) gt 1000 }",
+		}, ""},
+		{"http", map[string]string{"requests": "5/1s", "key": "path"}, []string{
+			"stick-table type string len 128 size 100k expire 10m store http_req_rate(1s)",
+			"http-request track-sc0 path",
+			"http-request deny deny_status 429 if { sc_http_req_rate(0) gt 5 }",
+		}, ""},
+		{"tcp", map[string]string{"connections": "50", "action": "silent_drop"}, []string{
+			"stick-table type ip size 100k expire 10m store conn_cur",
+			"tcp-request connection track-sc0 src",
+			"tcp-request connection silent-drop if { sc_conn_cur(0) gt 50 }",
+		}, ""},
+		{"tcp", map[string]string{"connections": "50"}, []string{
+			"stick-table type ip size 100k expire 10m store conn_cur",
+			"tcp-request connection track-sc0 src",
+			"tcp-request connection reject if { sc_conn_cur(0) gt 50 }",
+		}, ""},
+		{"http", map[string]string{"action": "deny"}, nil, ""},
+		{"http", map[string]string{"requests": "100"}, nil, "requests"},
+		{"http", map[string]string{"requests": "0/10s"}, nil, "requests"},
+		{"tcp", map[string]string{"requests": "100/10s"}, nil, "requests"},
+		{"http", map[string]string{"connections": "none"}, nil, "connections"},
+		{"http", map[string]string{"connections": "10", "key": "cookie"}, nil, "key"},
+		{"http", map[string]string{"connections": "10", "key": "hdr(X Bad)"}, nil, "key"},
+		{"tcp", map[string]string{"connections": "10", "key": "path"}, nil, "key"},
+		{"http", map[string]string{"connections": "10", "action": "block"}, nil, "action"},
+		{"tcp", map[string]string{"connections": "10", "action": "tarpit"}, nil, "action"},
+		{"http", map[string]string{"connections": "10", "size": "big"}, nil, "size"},
+		{"http", map[string]string{"connections": "10", "expire": "soon"}, nil, "expire"},
+		{"http", map[string]string{"connections": "10", "burst": "5"}, nil, "burst"},
+	}
+	for _, test := range tests {
+		lines, err := parseRateLimit("f/rate_limit/", test.mode, test.keys)
+		if test.lines == nil {
+			invalid, ok := err.(*invalidKeyError)
+			if !ok || invalid.Key != "f/rate_limit/"+test.invalid {
+				t.Errorf("%v in %s mode: expected %s to be invalid, got %v", test.keys, test.mode, test.invalid, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%v in %s mode: expected %q, got %q %v", test.keys, test.mode, test.lines, lines, err)
+		}
+	}
+}
+
+func TestParseTableEntries(t *testing.T) {
+	output := `# table: www, type: ip, size:102400, used:2
+0x55d2c7e7a1c0: key=10.0.0.1 use=1 exp=598716 conn_cur=1 http_req_rate(10000)=42
+0x55d2c7e7a2d0: key=10.0.0.2 use=0 exp=12 conn_cur=0 http_req_rate(10000)=0
+
+`
+	expected := []trackedCounter{
+		{Table: "www", Key: "10.0.0.1", Expire: 598716, Counters: map[string]int64{"conn_cur": 1, "http_req_rate(10000)": 42}},
+		{Table: "www", Key: "10.0.0.2", Expire: 12, Counters: map[string]int64{"conn_cur": 0, "http_req_rate(10000)": 0}},
+	}
+	if entries := parseTableEntries("www", output); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %+v, got %+v", expected, entries)
+	}
+}
+
+func TestGetRateLimitCounters(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	m := testManager(newDockerRuntime(newFakeDocker()))
+	s := &server{manager: m}
+	svc, err := m.service("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := `frontend www
+    bind *:80
+    stick-table type ip size 100k expire 10m store http_req_rate(10s),conn_cur
+    tcp-request connection track-sc0 src
+
+frontend api
+    bind *:8080
+
+backend web
+    stick-table type ip size 100k expire 30m
+`
+	if err := ioutil.WriteFile(svc.configPath(), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetRateLimitCounters(context.Background(), &pb.RateLimitCountersRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the counters to be unavailable while HAProxy is down, got %v", err)
+	}
+
+	commands := []string{}
+	defer startFakeAdminSocket(t, svc, func(command string) string {
+		commands = append(commands, command)
+		return "# table: www, type: ip, size:102400, used:1\n0x1: key=10.0.0.1 use=0 exp=5000 conn_cur=3 http_req_rate(10000)=250\n\n"
+	})()
+	counters, err := s.GetRateLimitCounters(context.Background(), &pb.RateLimitCountersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*pb.TrackedCounter{{Frontend: "www", Key: "10.0.0.1", ConnCur: 3, HttpReqRate: 250, ExpireMs: 5000}}
+	if !reflect.DeepEqual(counters.Counters, expected) {
+		t.Errorf("expected %+v, got %+v", expected, counters.Counters)
+	}
+	if !reflect.DeepEqual(commands, []string{"show table www"}) {
+		t.Errorf("expected only the table of the rate limited frontend to be shown, got %v", commands)
+	}
+
+	counters, err = s.GetRateLimitCounters(context.Background(), &pb.RateLimitCountersRequest{Frontend: "api"})
+	if err != nil || len(counters.Counters) != 0 {
+		t.Errorf("expected no counters for a frontend without rate limit, got %v %v", counters, err)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// kvPair is a key listed by the ls template function, Key is relative to the listed prefix
+type kvPair struct {
+	Key   string
+	Value string
+}
+
+// scratch is the scratch pad of a template, as in consul-template
+type scratch struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// Set stores a value, returning an empty string so it renders as nothing
+func (s *scratch) Set(key string, value interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return ""
+}
+
+func (s *scratch) Get(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// Key reports whether a value is set
+func (s *scratch) Key(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.values[key]
+	return ok
+}
+
+// The kinds of render errors, telling which step of rendering a config failed
+const (
+	// renderErrorTemplate is a template which doesn't parse or fails to execute
+	renderErrorTemplate = "template"
+	// renderErrorMissingKey is a template reading a key which doesn't exist with the key function
+	renderErrorMissingKey = "missing_key"
+	// renderErrorInvalidKey is a key which doesn't fit the schema of the frontends and backends
+	renderErrorInvalidKey = "invalid_key"
+	// renderErrorInvalidConfig is a rendered config which HAProxy rejects
+	renderErrorInvalidConfig = "invalid_config"
+	// renderErrorIO is a failure to read the template or write the config
+	renderErrorIO = "io"
+)
+
+// renderError is a failed render of a service's config. Output is the output of the config check, if it ran.
+type renderError struct {
+	Kind   string
+	Err    error
+	Output string
+	Time   time.Time
+}
+
+func newRenderError(kind string, err error) *renderError {
+	return &renderError{Kind: kind, Err: err, Time: time.Now()}
+}
+
+func (e *renderError) Error() string {
+	if e.Output == "" {
+		return e.Kind + ": " + e.Err.Error()
+	}
+	return e.Kind + ": " + e.Err.Error() + "\n" + e.Output
+}
+
+// renderWait is how long rendering waits for the inputs to settle, so that a burst of changes results in one reload
+type renderWait struct {
+	// Min is how long the inputs must stay unchanged, 0 renders on every change
+	Min time.Duration
+	// Max is the longest a render is delayed by changes which keep coming
+	Max time.Duration
+}
+
+// parseRenderWait reads RENDER_WAIT, "min" or "min:max" as in consul-template's -wait, max defaulting to 4 times min
+func parseRenderWait() (renderWait, error) {
+	if RenderWaitSetting == "" {
+		return renderWait{}, nil
+	}
+	parts := strings.Split(RenderWaitSetting, ":")
+	if len(parts) > 2 {
+		return renderWait{}, fmt.Errorf("invalid RENDER_WAIT: %q", RenderWaitSetting)
+	}
+	min, err := time.ParseDuration(parts[0])
+	if err != nil || min < 0 {
+		return renderWait{}, fmt.Errorf("invalid RENDER_WAIT: %q", RenderWaitSetting)
+	}
+	wait := renderWait{Min: min, Max: 4 * min}
+	if len(parts) == 2 {
+		if wait.Max, err = time.ParseDuration(parts[1]); err != nil || wait.Max < min {
+			return renderWait{}, fmt.Errorf("invalid RENDER_WAIT: %q, max must be at least min", RenderWaitSetting)
+		}
+	}
+	return wait, nil
+}
+
+// delay is how long to wait before rendering after a change at now, the first pending change being at first
+func (w renderWait) delay(first, now time.Time) time.Duration {
+	delay := w.Min
+	if deadline := first.Add(w.Max); now.Add(delay).After(deadline) {
+		delay = deadline.Sub(now)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// renderTemplate renders a template with consul-template's key, keyOrDefault, ls, env and scratch functions, reading
+// the keys from kv. The service function lists the healthy instances of a Consul service from catalog, the
+// containers function the labelled containers of a backend, and the loadBalancer function reads the frontends and
+// backends from the keys, with the error pages. It returns the lookups the template made, those missing from catalog are rendered without
+// instances.
+func renderTemplate(text string, kv map[string]string, catalog map[catalogQuery][]catalogInstance, pages *errorPages, env func(string) string) ([]byte, []catalogQuery, error) {
+	pad := &scratch{values: map[string]interface{}{}}
+	queries := []catalogQuery{}
+	lookup := func(query catalogQuery) []catalogInstance {
+		queries = append(queries, query)
+		return catalog[query]
+	}
+	// failedKind is the kind of error of a function which failed, if it isn't a template error
+	failedKind := ""
+	funcs := template.FuncMap{
+		"key": func(key string) (string, error) {
+			value, ok := kv[strings.TrimPrefix(key, "/")]
+			if !ok {
+				failedKind = renderErrorMissingKey
+				return "", fmt.Errorf("key %s doesn't exist", key)
+			}
+			return value, nil
+		},
+		"keyOrDefault": func(key string, def string) string {
+			if value, ok := kv[strings.TrimPrefix(key, "/")]; ok {
+				return value
+			}
+			return def
+		},
+		"ls": func(prefix string) []kvPair {
+			prefix = strings.TrimPrefix(prefix, "/")
+			if prefix != "" && !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			pairs := []kvPair{}
+			for key, value := range kv {
+				rest := strings.TrimPrefix(key, prefix)
+				// like consul-template, ls only lists the keys directly under the prefix
+				if !strings.HasPrefix(key, prefix) || rest == "" || strings.Contains(rest, "/") {
+					continue
+				}
+				pairs = append(pairs, kvPair{Key: rest, Value: value})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+			return pairs
+		},
+		// service takes the service name and optionally comma separated tags, such as (service "web" "prod,v2")
+		"service": func(name string, tags ...string) []catalogInstance {
+			return lookup(newCatalogQuery(name, tags...))
+		},
+		// containers lists the running containers labelled as servers of a backend
+		"containers": func(backend string) []catalogInstance {
+			return lookup(catalogQuery{Catalog: dockerCatalog, Service: backend})
+		},
+		// loadBalancer reads the frontends and backends defined under a prefix
+		"loadBalancer": func(prefix string) (*loadBalancer, error) {
+			lb, err := loadLoadBalancer(kv, strings.TrimPrefix(prefix, "/"), lookup)
+			if err != nil {
+				failedKind = renderErrorInvalidKey
+				return nil, err
+			}
+			lb.setDefaultBind(env("HAPROXY_DEFAULT_BIND"))
+			lb.setErrorPages(pages, env("HAPROXY_ERRORS_DIR"))
+			return lb, nil
+		},
+		"env": env,
+		"scratch": func() *scratch {
+			return pad
+		},
+	}
+
+	tmpl, err := template.New("haproxy.ctmpl").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, nil, newRenderError(renderErrorTemplate, err)
+	}
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, nil); err != nil {
+		if failedKind != "" {
+			return nil, nil, newRenderError(failedKind, err)
+		}
+		return nil, nil, newRenderError(renderErrorTemplate, err)
+	}
+	return out.Bytes(), queries, nil
+}
+
+// kvPrefix is the KV prefix holding the service's config
+func (svc *service) kvPrefix() string {
+	return "instances/" + InstanceID + "/services/" + svc.Name + "/"
+}
+
+// templateEnv is the environment of the template, the manager's environment with the service's settings on top
+func (svc *service) templateEnv(name string) string {
+	switch name {
+	case "CONFIG_DIR":
+		return ConfigDir
+	case "INSTANCE_ID":
+		return InstanceID
+	case "SERVICE_NAME":
+		return svc.Name
+	case "HAPROXY_LOG_ADDRESS":
+		return svc.logAddress()
+	case "HAPROXY_ADMIN_SOCKET":
+		return svc.haproxyPath(svc.adminSocketPath())
+	case "HAPROXY_ACL_DIR":
+		return svc.haproxyPath(svc.aclDir())
+	case "HAPROXY_ERRORS_DIR":
+		return svc.haproxyPath(svc.errorsDir())
+	case "HAPROXY_DEFAULT_BIND":
+		return svc.defaultBind()
+	}
+	return os.Getenv(name)
+}
+
+// render renders the service's template and applies the result. It returns the services the template looked up, and
+// whether the config was applied: nothing is applied while some of the services haven't been read from the catalog
+// yet, so servers aren't dropped at startup. reload has HAProxy reload even when the config is the same, as files it
+// reads on reload changed.
+func (svc *service) render(kv map[string]string, catalog map[catalogQuery][]catalogInstance, reload bool) ([]catalogQuery, bool, error) {
+	text, err := ioutil.ReadFile(svc.templatePath())
+	if err != nil {
+		return nil, false, newRenderError(renderErrorIO, err)
+	}
+	pages, err := svc.errorPages()
+	if err != nil {
+		return nil, false, newRenderError(renderErrorIO, err)
+	}
+	config, queries, err := renderTemplate(string(text), kv, catalog, pages, svc.templateEnv)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, query := range queries {
+		if _, ok := catalog[query]; !ok {
+			return queries, false, nil
+		}
+	}
+	lists, err := loadACLLists(kv, svc.kvPrefix())
+	if err != nil {
+		return queries, false, newRenderError(renderErrorInvalidKey, err)
+	}
+	policy, err := loadAbusePolicy(kv, svc.kvPrefix())
+	if err != nil {
+		return queries, false, newRenderError(renderErrorInvalidKey, err)
+	}
+	// the files of new lists are created first, as the config check reads them. The changes of the others, which the
+	// running HAProxy has loaded, wait for the config to be accepted.
+	acls, err := svc.stageACLs(lists)
+	if err != nil {
+		return queries, false, err
+	}
+	createdBannedList, err := svc.createBannedList()
+	if err != nil {
+		acls.discard()
+		return queries, false, err
+	}
+	install := func() (bool, error) {
+		if err := svc.writeBans(); err != nil {
+			return false, err
+		}
+		return acls.write()
+	}
+	if err := applyConfig(svc, config, reload, install); err != nil {
+		acls.discard()
+		if createdBannedList {
+			os.Remove(filepath.Join(svc.aclDir(), bannedListFile))
+		}
+		return queries, false, err
+	}
+	svc.removeStaleACLs(lists)
+	svc.setAbusePolicy(policy)
+	return queries, true, nil
+}
+
+// renderInput is new data for the renderer, either the keys of the service or the instances of a catalog query
+type renderInput struct {
+	kv        map[string]string
+	query     *catalogQuery
+	instances []catalogInstance
+}
+
+// followIndex repeats a blocking query until ctx is done, passing the data to changed whenever the index moves
+func followIndex(ctx context.Context, what string, fetch func(ctx context.Context, index uint64) (interface{}, uint64, error), changed func(data interface{})) {
+	retryDelay := time.Second
+	index := uint64(0)
+	for {
+		data, newIndex, err := fetch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("unable to read %s, retrying in %s: %v\n", what, retryDelay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+			if retryDelay *= 2; retryDelay > maxRestartDelay {
+				retryDelay = maxRestartDelay
+			}
+			continue
+		}
+		retryDelay = time.Second
+		if newIndex == index {
+			// the source stopped waiting without changes
+			continue
+		}
+		// the index going backwards means the source's data was reset, start over
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+		changed(data)
+	}
+}
+
+// watchKV renders the service's config whenever its keys change in the config source, or the instances of the
+// services its template looks up change in the Consul catalog, until quit is signalled
+func watchKV(svc *service, quit chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inputs := make(chan renderInput)
+	send := func(input renderInput) {
+		select {
+		case inputs <- input:
+		case <-ctx.Done():
+		}
+	}
+	source := Source
+	go followIndex(ctx, "the keys of "+svc.Name, func(ctx context.Context, index uint64) (interface{}, uint64, error) {
+		return source.list(ctx, svc.kvPrefix(), index)
+	}, func(data interface{}) {
+		send(renderInput{kv: data.(map[string]string)})
+	})
+
+	discovery := Discovery
+	consul, ok := source.(*consulClient)
+	if !ok {
+		consul = newConsulClient(ConsulSettings)
+	}
+	wait := RenderWait
+	catalog := map[catalogQuery][]catalogInstance{}
+	watching := map[catalogQuery]context.CancelFunc{}
+	var kv map[string]string
+	// renderAt fires once the pending changes have settled, firstChange is when the first of them came in
+	var renderAt <-chan time.Time
+	var firstChange time.Time
+	// reload is set when files the config refers to changed, until a render has HAProxy read them
+	reload := false
+	for {
+		select {
+		case <-quit:
+			return
+		case input := <-inputs:
+			if input.query == nil {
+				kv = input.kv
+			} else if _, ok := watching[*input.query]; ok {
+				catalog[*input.query] = input.instances
+			}
+			if kv == nil {
+				// nothing to render until the keys are read
+				continue
+			}
+			if wait.Min > 0 {
+				now := time.Now()
+				if renderAt == nil {
+					firstChange = now
+				}
+				renderAt = time.After(wait.delay(firstChange, now))
+				continue
+			}
+		case <-renderAt:
+		case <-svc.rerender:
+			// files the config refers to changed, such as the error pages
+			reload = true
+			if kv == nil {
+				continue
+			}
+		}
+		renderAt = nil
+
+		queries, applied, err := svc.render(kv, catalog, reload)
+		svc.recordRender(err)
+		if applied {
+			reload = false
+		}
+		if err != nil && queries == nil {
+			continue
+		}
+		used := map[catalogQuery]bool{}
+		for _, query := range queries {
+			used[query] = true
+			if _, ok := watching[query]; ok {
+				continue
+			}
+			query := query
+			queryCtx, stop := context.WithCancel(ctx)
+			watching[query] = stop
+			go followIndex(queryCtx, query.String(), func(ctx context.Context, index uint64) (interface{}, uint64, error) {
+				if query.Catalog != dockerCatalog {
+					return consul.healthyInstances(ctx, query, index)
+				}
+				if discovery == nil {
+					// without discovery there are never any containers
+					if index > 0 {
+						<-ctx.Done()
+						return nil, 0, ctx.Err()
+					}
+					return []catalogInstance{}, 1, nil
+				}
+				return discovery.list(ctx, query.Service, index)
+			}, func(data interface{}) {
+				send(renderInput{query: &query, instances: data.([]catalogInstance)})
+			})
+		}
+		for query, stop := range watching {
+			if !used[query] {
+				stop()
+				delete(watching, query)
+				delete(catalog, query)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	kv := map[string]string{
+		"svc/maxconn":          "500",
+		"svc/backends/web1":    "10.0.0.1:80",
+		"svc/backends/web2":    "10.0.0.2:80",
+		"svc/backends/old/web": "10.0.0.3:80",
+	}
+	env := func(name string) string {
+		if name == "SERVICE_NAME" {
+			return "svc"
+		}
+		return ""
+	}
+	tests := []struct {
+		template string
+		out      string
+		// errKind is the kind of the expected render error, if any
+		errKind string
+	}{
+		{`{{key "svc/maxconn"}}`, "500", ""},
+		{`{{key "/svc/maxconn"}}`, "500", ""},
+		{`{{key "svc/missing"}}`, "", renderErrorMissingKey},
+		{`{{keyOrDefault "svc/missing" "100"}}`, "100", ""},
+		{`{{range ls "svc/backends"}}{{.Key}}={{.Value}};{{end}}`, "web1=10.0.0.1:80;web2=10.0.0.2:80;", ""},
+		{`{{range ls "svc/nothing/"}}{{.Key}}{{end}}`, "", ""},
+		{`{{env "SERVICE_NAME"}}`, "svc", ""},
+		{`{{scratch.Set "p" (print (env "SERVICE_NAME") "/")}}{{key (print (scratch.Get "p") "maxconn")}}`, "500", ""},
+		{`{{if scratch.Key "p"}}set{{else}}unset{{end}}`, "unset", ""},
+		{`{{range (loadBalancer "svc/").Backends}}{{.Name}}:{{len .Servers}};{{end}}`, "backends:2;old:0;", ""},
+		{`{{key}`, "", renderErrorTemplate},
+		{`{{index 1 2}}`, "", renderErrorTemplate},
+	}
+	for _, test := range tests {
+		out, _, err := renderTemplate(test.template, kv, nil, nil, env)
+		if test.errKind != "" {
+			if renderErr, ok := err.(*renderError); !ok || renderErr.Kind != test.errKind {
+				t.Errorf("%s: expected a %s error, got %v", test.template, test.errKind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.template, err)
+			continue
+		}
+		if string(out) != test.out {
+			t.Errorf("%s: expected %q, got %q", test.template, test.out, out)
+		}
+	}
+}
+
+func TestParseRenderWait(t *testing.T) {
+	previous := RenderWaitSetting
+	defer func() { RenderWaitSetting = previous }()
+	tests := []struct {
+		setting string
+		wait    renderWait
+		err     bool
+	}{
+		{"", renderWait{}, false},
+		{"2s", renderWait{Min: 2 * time.Second, Max: 8 * time.Second}, false},
+		{"500ms:10s", renderWait{Min: 500 * time.Millisecond, Max: 10 * time.Second}, false},
+		{"10s:2s", renderWait{}, true},
+		{"-1s", renderWait{}, true},
+		{"2s:10s:1m", renderWait{}, true},
+		{"soon", renderWait{}, true},
+	}
+	for _, test := range tests {
+		RenderWaitSetting = test.setting
+		wait, err := parseRenderWait()
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected error %v, got %v", test.setting, test.err, err)
+			continue
+		}
+		if wait != test.wait {
+			t.Errorf("%q: expected %+v, got %+v", test.setting, test.wait, wait)
+		}
+	}
+
+	wait := renderWait{Min: 2 * time.Second, Max: 5 * time.Second}
+	first := time.Now()
+	if delay := wait.delay(first, first); delay != 2*time.Second {
+		t.Errorf("expected the min wait after the first change, got %s", delay)
+	}
+	if delay := wait.delay(first, first.Add(4*time.Second)); delay != time.Second {
+		t.Errorf("expected the wait to be cut at max, got %s", delay)
+	}
+	if delay := wait.delay(first, first.Add(6*time.Second)); delay != 0 {
+		t.Errorf("expected no wait past max, got %s", delay)
+	}
+}
+
+func TestRenderTemplateService(t *testing.T) {
+	catalog := map[catalogQuery][]catalogInstance{
+		{Service: "web", Tags: "prod,v2"}: {{Name: "n1.web-1", Address: "10.0.0.1", Port: 80, Weight: 5}},
+	}
+	out, queries, err := renderTemplate(`{{range service "web" "v2, prod"}}{{.Name}} {{.Address}}:{{.Port}} {{.Weight}}{{end}}{{service "api"}}{{containers "web"}}`, nil, catalog, nil, os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "n1.web-1 10.0.0.1:80 5[][]" {
+		t.Errorf("unexpected output: %q", out)
+	}
+	expected := []catalogQuery{{Service: "web", Tags: "prod,v2"}, {Service: "api"}, {Catalog: dockerCatalog, Service: "web"}}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("expected the queries %v, got %v", expected, queries)
+	}
+}
+
+func TestRenderShippedTemplate(t *testing.T) {
+	text, err := ioutil.ReadFile("haproxy.ctmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "instances/i-1/services/lb-haproxy/"
+	kv := map[string]string{
+		prefix + "maxconn":                 "2000",
+		prefix + "backends/web1":           "10.0.0.1:80",
+		prefix + "default_timeouts/client": "30s",
+	}
+	env := map[string]string{"INSTANCE_ID": "i-1", "SERVICE_NAME": "lb-haproxy", "HAPROXY_LOG_ADDRESS": "/log.sock", "HAPROXY_ADMIN_SOCKET": "/haproxy.sock", "HAPROXY_ACL_DIR": "/acl"}
+	out, _, err := renderTemplate(string(text), kv, nil, nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"maxconn 2000",
+		"log /log.sock local0",
+		"stats socket /haproxy.sock mode 600 level admin",
+		"timeout client 30s",
+		"timeout server 5000ms",
+		"bind 127.0.0.1:8080",
+		"server web1 10.0.0.1:80 check",
+	} {
+		if !strings.Contains(string(out), line) {
+			t.Errorf("expected the config to contain %q, got:\n%s", line, out)
+		}
+	}
+
+	kv[prefix+"backends_service"] = "web"
+	kv[prefix+"backends_service_tags"] = "prod"
+	catalog := map[catalogQuery][]catalogInstance{
+		{Service: "web", Tags: "prod"}: {{Name: "n1.web-1", Address: "10.0.0.2", Port: 8080, Weight: 20}},
+	}
+	out, _, err = renderTemplate(string(text), kv, catalog, nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "    server n1.web-1 10.0.0.2:8080 weight 20 check\n") || strings.Contains(string(out), "server web1") {
+		t.Errorf("expected the servers to come from the catalog, got:\n%s", out)
+	}
+
+	kv[prefix+"frontends/http/bind"] = "*:80,*:443"
+	kv[prefix+"frontends/http/default_backend"] = "site"
+	kv[prefix+"frontends/http/routes/api/host"] = "api.example.com"
+	kv[prefix+"frontends/http/routes/api/backend"] = "api"
+	kv[prefix+"frontends/http/rate_limit/requests"] = "100/10s"
+	kv[prefix+"acl/frontends/http/allow/office"] = "10.1.0.0/16"
+	kv[prefix+"acl/backends/api/allow/vpn"] = "10.8.0.0/24"
+	kv[prefix+"abuse/http_err_rate"] = "50/10s"
+	kv[prefix+"abuse/conn_rate"] = "100/10s"
+	kv[prefix+"backends/api/servers/api1"] = "10.0.1.1:8080"
+	kv[prefix+"backends/api/balance"] = "leastconn"
+	kv[prefix+"backends/api/http_check/path"] = "/health"
+	kv[prefix+"backends/api/http_check/expect_status"] = "200"
+	kv[prefix+"backends/api/servers/api2"] = `{"address": "10.0.1.2:8080", "weight": 10, "backup": true, "inter": "5s"}`
+	kv[prefix+"backends/site/servers/site1"] = "10.0.2.1:80"
+	kv[prefix+"backends/site/sticky/mode"] = "cookie_insert"
+	kv[prefix+"backends/site/sticky/httponly"] = "true"
+	out, _, err = renderTemplate(string(text), kv, catalog, nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{
+		"\nfrontend http\n    bind *:80\n    bind *:443\n    mode http\n    tcp-request connection reject if { src -f /acl/deny.acl }\n    tcp-request connection reject if { src -f /acl/banned.acl }\n    tcp-request connection reject if !{ src -f /acl/frontend.http.allow.acl }\n    tcp-request connection track-sc1 src table abuse\n    stick-table type ip size 100k expire 10m store http_req_rate(10s)\n    tcp-request connection track-sc0 src\n    http-request deny deny_status 429 if { sc_http_req_rate(0) gt 100 }\n    use_backend api if { req.hdr(host),field(1,:) -i api.example.com }\n    default_backend site\n",
+		"\nbackend api\n    mode http\n    balance leastconn\n    http-request deny if !{ src -f /acl/backend.api.allow.acl }\n    option httpchk GET /health\n    http-check expect status 200\n    server api1 10.0.1.1:8080 check\n    server api2 10.0.1.2:8080 weight 10 backup check inter 5s\n",
+		"\nbackend abuse\n    stick-table type ip size 100k expire 10m store http_err_rate(10s),conn_rate(10s)\n",
+		"\nbackend site\n    mode http\n    balance roundrobin\n    cookie SERVERID insert indirect nocache httponly\n    server site1 10.0.2.1:80 check cookie site1\n",
+	} {
+		if !strings.Contains(string(out), section) {
+			t.Errorf("expected the config to contain %q, got:\n%s", section, out)
+		}
+	}
+	if strings.Contains(string(out), "frontend www") {
+		t.Errorf("expected the frontends to replace www, got:\n%s", out)
+	}
+
+	kv[prefix+"frontends/tls/bind"] = "*:8443"
+	kv[prefix+"frontends/tls/mode"] = "tcp"
+	kv[prefix+"frontends/tls/default_backend"] = "tls-default"
+	kv[prefix+"frontends/tls/routes/shop/sni"] = "shop.example.com"
+	kv[prefix+"frontends/tls/routes/shop/backend"] = "shop"
+	kv[prefix+"backends/shop/tcp_check/1"] = "connect 8443"
+	out, _, err = renderTemplate(string(text), kv, catalog, nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{
+		"\nfrontend tls\n    bind *:8443\n    mode tcp\n    option tcplog\n    tcp-request connection reject if { src -f /acl/deny.acl }\n    tcp-request connection reject if { src -f /acl/banned.acl }\n    tcp-request connection track-sc1 src table abuse\n    tcp-request inspect-delay 5s\n    tcp-request content accept if { req.ssl_hello_type 1 }\n    use_backend shop if { req.ssl_sni -i shop.example.com }\n    default_backend tls-default\n",
+		"\nbackend shop\n    mode tcp\n    balance roundrobin\n    option tcp-check\n    tcp-check connect port 8443\n",
+	} {
+		if !strings.Contains(string(out), section) {
+			t.Errorf("expected the config to contain %q, got:\n%s", section, out)
+		}
+	}
+
+	kv[prefix+"backends/api/servers/api1"] = "nowhere"
+	_, _, err = renderTemplate(string(text), kv, catalog, nil, func(name string) string { return env[name] })
+	if renderErr, ok := err.(*renderError); !ok || renderErr.Kind != renderErrorInvalidKey {
+		t.Errorf("expected an invalid_key error, got %v", err)
+	}
+}
+
+func TestRenderDefaultBindOfServices(t *testing.T) {
+	text, err := ioutil.ReadFile("haproxy.ctmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := newDockerRuntime(newFakeDocker())
+	for name, bind := range map[string]string{DefaultServiceName: "*:80", "internal": "/usr/local/etc/haproxy/http-in.sock"} {
+		svc := newService(name, rt)
+		out, _, err := renderTemplate(string(text), nil, nil, nil, svc.templateEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), "\nfrontend www\n    bind "+bind+"\n") {
+			t.Errorf("expected the www frontend of %s to bind %s, got:\n%s", name, bind, out)
+		}
+	}
+}
+
+// TestShippedTemplateOrdersFrontendRules checks that every frontend has its tcp-request rules before its http-request
+// rules, as HAProxy warns about the others and runs them first anyway
+func TestShippedTemplateOrdersFrontendRules(t *testing.T) {
+	text, err := ioutil.ReadFile("haproxy.ctmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "instances/i-1/services/lb-haproxy/"
+	kv := map[string]string{
+		prefix + "frontends/www/bind":                   "*:80",
+		prefix + "frontends/www/rate_limit/requests":    "100/10s",
+		prefix + "frontends/api/bind":                   "*:8080",
+		prefix + "frontends/api/rate_limit/requests":    "100/10s",
+		prefix + "frontends/api/rate_limit/key":         "path",
+		prefix + "frontends/tls/bind":                   "*:8443",
+		prefix + "frontends/tls/mode":                   "tcp",
+		prefix + "frontends/tls/default_backend":        "shop",
+		prefix + "frontends/tls/rate_limit/connections": "10",
+		prefix + "frontends/tls/routes/shop/sni":        "shop.example.com",
+		prefix + "frontends/tls/routes/shop/backend":    "shop",
+		prefix + "acl/frontends/www/allow/office":       "10.1.0.0/16",
+		prefix + "acl/deny/scraper":                     "203.0.113.7",
+		prefix + "abuse/http_err_rate":                  "50/10s",
+		prefix + "backends/backends/servers/w1":         "10.0.0.1:80",
+		prefix + "backends/shop/servers/shop1":          "10.0.3.1:443",
+	}
+	env := map[string]string{"INSTANCE_ID": "i-1", "SERVICE_NAME": "lb-haproxy", "HAPROXY_ACL_DIR": "/acl", "HAPROXY_ERRORS_DIR": "/errors"}
+	pages := &errorPages{Maintenance: true}
+	out, _, err := renderTemplate(string(text), kv, nil, pages, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontends := 0
+	for _, section := range strings.Split(string(out), "\n\n") {
+		if !strings.HasPrefix(section, "frontend ") {
+			continue
+		}
+		frontends++
+		httpRule := ""
+		for _, line := range strings.Split(section, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "http-request ") && httpRule == "" {
+				httpRule = line
+			}
+			if strings.HasPrefix(line, "tcp-request ") && httpRule != "" {
+				t.Errorf("expected %q before %q:\n%s", line, httpRule, section)
+			}
+		}
+	}
+	if frontends != 3 {
+		t.Errorf("expected 3 frontends, got:\n%s", out)
+	}
+}
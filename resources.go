@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+const (
+	// defaultMaxconn is HAProxy's compiled in default when the global section doesn't set maxconn
+	defaultMaxconn = 2000
+	// nofileHeadroom is added to the file descriptors needed by connections, for listeners, health checks, logs and the stats socket
+	nofileHeadroom = 1024
+)
+
+// resourceLimits are the resource constraints applied to HAProxy
+type resourceLimits struct {
+	NanoCPUs int64
+	Memory   int64
+	NoFile   int64
+	Sysctls  map[string]string
+}
+
+// parseResourceLimits reads the configured limits from the HAPROXY_CPUS, HAPROXY_MEMORY, HAPROXY_NOFILE and HAPROXY_SYSCTLS settings
+func parseResourceLimits() (resourceLimits, error) {
+	limits := resourceLimits{}
+	if HAProxyCPUs != "" {
+		cpus, err := strconv.ParseFloat(HAProxyCPUs, 64)
+		if err != nil || cpus <= 0 {
+			return limits, fmt.Errorf("invalid HAPROXY_CPUS: %q", HAProxyCPUs)
+		}
+		limits.NanoCPUs = int64(cpus * 1e9)
+	}
+	if HAProxyMemory != "" {
+		memory, err := units.RAMInBytes(HAProxyMemory)
+		if err != nil {
+			return limits, fmt.Errorf("invalid HAPROXY_MEMORY: %v", err)
+		}
+		limits.Memory = memory
+	}
+	if HAProxyNoFile != "" {
+		nofile, err := strconv.ParseInt(HAProxyNoFile, 10, 64)
+		if err != nil || nofile <= 0 {
+			return limits, fmt.Errorf("invalid HAPROXY_NOFILE: %q", HAProxyNoFile)
+		}
+		limits.NoFile = nofile
+	}
+	if HAProxySysctls != "" {
+		limits.Sysctls = map[string]string{}
+		for _, kv := range strings.Split(HAProxySysctls, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return limits, fmt.Errorf("invalid HAPROXY_SYSCTLS entry: %q", kv)
+			}
+			limits.Sysctls[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return limits, nil
+}
+
+// globalMaxconn returns the maxconn set in the global section of the HAProxy config at path, or HAProxy's default
+func globalMaxconn(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return defaultMaxconn
+	}
+	defer f.Close()
+
+	inGlobal := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			inGlobal = fields[0] == "global"
+			continue
+		}
+		if inGlobal && fields[0] == "maxconn" && len(fields) > 1 {
+			if maxconn, err := strconv.ParseInt(fields[1], 10, 64); err == nil && maxconn > 0 {
+				return maxconn
+			}
+		}
+	}
+	return defaultMaxconn
+}
+
+// forMaxconn returns the limits with the nofile ulimit computed from maxconn, unless it is configured explicitly
+func (l resourceLimits) forMaxconn(maxconn int64) resourceLimits {
+	if l.NoFile == 0 {
+		l.NoFile = 2*maxconn + nofileHeadroom
+	}
+	return l
+}
+
+// applyResourceLimits sets the limits on a container's hostConfig
+func applyResourceLimits(hostConfig *container.HostConfig, limits resourceLimits) {
+	hostConfig.NanoCPUs = limits.NanoCPUs
+	hostConfig.Memory = limits.Memory
+	if limits.NoFile > 0 {
+		hostConfig.Ulimits = []*units.Ulimit{
+			{Name: "nofile", Soft: limits.NoFile, Hard: limits.NoFile},
+		}
+	}
+	hostConfig.Sysctls = limits.Sysctls
+}
+
+// containerLimits reads the limits a container is running with from its hostConfig
+func containerLimits(hostConfig *container.HostConfig) resourceLimits {
+	limits := resourceLimits{
+		NanoCPUs: hostConfig.NanoCPUs,
+		Memory:   hostConfig.Memory,
+		Sysctls:  hostConfig.Sysctls,
+	}
+	for _, ulimit := range hostConfig.Ulimits {
+		if ulimit.Name == "nofile" {
+			limits.NoFile = ulimit.Soft
+		}
+	}
+	return limits
+}
+
+func limitsToProto(limits resourceLimits, maxconn int64) *pb.ResourceLimits {
+	return &pb.ResourceLimits{
+		Cpus:        float64(limits.NanoCPUs) / 1e9,
+		MemoryBytes: limits.Memory,
+		Nofile:      limits.NoFile,
+		Sysctls:     limits.Sysctls,
+		Maxconn:     maxconn,
+	}
+}
+
+// containerUsage takes a single stats sample of a running container
+func containerUsage(dockerCli dockerAPI, containerID string) (*pb.ResourceUsage, error) {
+	res, err := dockerCli.ContainerStats(context.Background(), containerID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	stats := dockerTypes.StatsJSON{}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+
+	usage := &pb.ResourceUsage{
+		MemoryBytes:      stats.MemoryStats.Usage,
+		MemoryLimitBytes: stats.MemoryStats.Limit,
+		Pids:             stats.PidsStats.Current,
+	}
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CpuPercent = math.Round(cpuDelta/systemDelta*onlineCPUs*10000) / 100
+	}
+	return usage, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	dockerClient "github.com/docker/docker/client"
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// Runtime runs the workloads managed by the manager (HAProxy, and one-off config checks)
+type Runtime interface {
+	// Start makes sure a workload matching spec is running and returns its ID.
+	// A running workload with the same name is adopted if it matches the spec, otherwise it is replaced.
+	Start(spec workloadSpec) (string, error)
+	// Stop stops the workload with the given name, if it is running
+	Stop(name string) error
+	// Signal sends a signal, such as SIGHUP, to the workload with the given name
+	Signal(name string, signal string) error
+	// Wait blocks until the workload with the given ID has exited and returns why it exited
+	Wait(id string) (workloadExit, error)
+	// Inspect returns the state of the workload with the given name, or nil if there is no such workload
+	Inspect(name string) (*workloadState, error)
+	// Logs returns up to tail lines of recent output of the workload with the given name
+	Logs(name string, tail int) (string, error)
+	// Events returns the recent lifecycle events of the workload with the given name
+	Events(name string) []workloadEvent
+	// Check runs a one-off workload, such as a config check, to completion and returns its output.
+	// It returns an error if the workload exits with a non-zero status.
+	Check(spec workloadSpec) (string, error)
+}
+
+// checkLabel marks the containers of one-off workloads, which aren't supervised
+const checkLabel = "com.opencopilot.check"
+
+// workloadSpec is the desired state of a managed workload.
+// Image, Cmd and Binds describe it as a container, Command describes it as a native process.
+type workloadSpec struct {
+	Name        string
+	Image       string
+	Cmd         []string
+	Command     []string
+	Env         []string
+	Labels      map[string]string
+	Binds       []string
+	Ports       []bindAddr
+	HostNetwork bool
+	// Network is a Docker network the container joins, so it can reach the containers on it
+	Network     string
+	Limits      *resourceLimits
+	Healthcheck *healthcheck
+}
+
+// workloadState is the observed state of a managed workload
+type workloadState struct {
+	ID       string
+	Running  bool
+	ExitCode int64
+	Limits   resourceLimits
+	Usage    *pb.ResourceUsage
+	// Health is nil for workloads without a healthcheck
+	Health *workloadHealth
+}
+
+func newRuntime(name string) (Runtime, error) {
+	switch name {
+	case "", "docker":
+		dockerCli, err := dockerClient.NewClientWithOpts(dockerClient.WithVersion("1.37"))
+		if err != nil {
+			return nil, err
+		}
+		return newDockerRuntime(dockerCli), nil
+	case "process":
+		return newProcessRuntime(), nil
+	default:
+		return nil, fmt.Errorf("unknown runtime: %s", name)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// runtimeAPITimeout bounds a command sent to HAProxy's admin socket
+const runtimeAPITimeout = 5 * time.Second
+
+// haproxyCommand sends a command to the admin socket of the service's HAProxy, as set up by the template, and
+// returns the answer
+func (svc *service) haproxyCommand(command string) (string, error) {
+	conn, err := net.DialTimeout("unix", svc.adminSocketPath(), runtimeAPITimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(runtimeAPITimeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", err
+	}
+	// without the interactive mode, HAProxy closes the connection after answering
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	answer := string(out)
+	for _, failure := range []string{"Unknown command", "Permission denied"} {
+		if strings.HasPrefix(answer, failure) {
+			return "", fmt.Errorf("haproxy refused %q: %s", command, strings.TrimSpace(answer))
+		}
+	}
+	return answer, nil
+}
+
+// runtimeAPIRefusal is an answer of HAProxy rejecting a change sent to its admin socket
+type runtimeAPIRefusal struct {
+	Command string
+	Answer  string
+}
+
+func (e *runtimeAPIRefusal) Error() string {
+	return fmt.Sprintf("haproxy refused %q: %s", e.Command, e.Answer)
+}
+
+// notFound tells whether HAProxy refused to delete an entry it doesn't have
+func (e *runtimeAPIRefusal) notFound() bool {
+	return strings.HasPrefix(e.Answer, "Key not found")
+}
+
+// haproxyUpdate sends a command which HAProxy answers with an empty line when it applies it, such as add acl or del acl.
+// Any other answer, such as "Unknown ACL identifier", means the change was rejected and is returned as a
+// *runtimeAPIRefusal.
+func (svc *service) haproxyUpdate(command string) error {
+	answer, err := svc.haproxyCommand(command)
+	if err != nil {
+		return err
+	}
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return &runtimeAPIRefusal{Command: command, Answer: answer}
+	}
+	return nil
+}
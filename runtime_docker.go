@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// dockerAPI is the part of the Docker client used by the manager
+type dockerAPI interface {
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerInspect(ctx context.Context, containerID string) (dockerTypes.ContainerJSON, error)
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	ContainerList(ctx context.Context, options dockerTypes.ContainerListOptions) ([]dockerTypes.Container, error)
+	ContainerLogs(ctx context.Context, container string, options dockerTypes.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerRemove(ctx context.Context, containerID string, options dockerTypes.ContainerRemoveOptions) error
+	ContainerStart(ctx context.Context, containerID string, options dockerTypes.ContainerStartOptions) error
+	ContainerStats(ctx context.Context, containerID string, stream bool) (dockerTypes.ContainerStats, error)
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	Events(ctx context.Context, options dockerTypes.EventsOptions) (<-chan events.Message, <-chan error)
+	ImagePull(ctx context.Context, refStr string, options dockerTypes.ImagePullOptions) (io.ReadCloser, error)
+	NetworkCreate(ctx context.Context, name string, options dockerTypes.NetworkCreate) (dockerTypes.NetworkCreateResponse, error)
+	NetworkInspect(ctx context.Context, networkID string, options dockerTypes.NetworkInspectOptions) (dockerTypes.NetworkResource, error)
+}
+
+// waitRecheckInterval is how often a waiter checks that the container it waits for still exists
+const waitRecheckInterval = 5 * time.Second
+
+// dockerRuntime runs workloads as Docker containers.
+// Container exits are followed through the Docker events stream, which also tells OOM kills and external kills apart.
+type dockerRuntime struct {
+	cli    dockerAPI
+	events *eventLog
+
+	mu sync.Mutex
+	// dying collects the oom and kill events of a container until it dies
+	dying map[string]*workloadExit
+	// exits are the exits of containers that nobody was waiting for yet
+	exits   map[string]workloadExit
+	waiters map[string][]chan workloadExit
+	// ownKills are the containers being stopped or replaced by the manager, by name or ID
+	ownKills map[string]bool
+	// discovery is told about the starts and stops of labelled backend containers, when enabled
+	discovery *containerDiscovery
+}
+
+func newDockerRuntime(cli dockerAPI) *dockerRuntime {
+	r := &dockerRuntime{
+		cli:      cli,
+		events:   &eventLog{},
+		dying:    map[string]*workloadExit{},
+		exits:    map[string]workloadExit{},
+		waiters:  map[string][]chan workloadExit{},
+		ownKills: map[string]bool{},
+	}
+	messages, errs, cancel := r.subscribe()
+	go r.watchEvents(messages, errs, cancel)
+	return r
+}
+
+func (r *dockerRuntime) containerSpec(spec workloadSpec) (containerSpec, error) {
+	containerConfig := &container.Config{
+		Image:  spec.Image,
+		Cmd:    spec.Cmd,
+		Env:    spec.Env,
+		Labels: spec.Labels,
+	}
+
+	hostConfig := &container.HostConfig{
+		// RestartPolicy: container.RestartPolicy{Name: "always"},
+		AutoRemove: true,
+		Binds:      spec.Binds,
+	}
+
+	if spec.Limits != nil {
+		applyResourceLimits(hostConfig, *spec.Limits)
+	}
+
+	// without a healthcheck of our own, the image's healthcheck is disabled too
+	containerConfig.Healthcheck = &container.HealthConfig{Test: []string{"NONE"}}
+	if spec.Healthcheck != nil {
+		containerConfig.Healthcheck = &container.HealthConfig{
+			Test:     []string{"CMD-SHELL", spec.Healthcheck.Command},
+			Interval: spec.Healthcheck.Interval,
+			Timeout:  spec.Healthcheck.Timeout,
+			Retries:  spec.Healthcheck.Retries,
+		}
+	}
+
+	if spec.HostNetwork {
+		hostConfig.NetworkMode = "host"
+	} else if len(spec.Ports) > 0 {
+		if err := r.checkPorts(spec.Name, spec.Ports); err != nil {
+			return containerSpec{}, err
+		}
+		containerConfig.ExposedPorts, hostConfig.PortBindings = portMappings(spec.Ports)
+	}
+
+	cs := containerSpec{
+		Name:       spec.Name,
+		Config:     containerConfig,
+		HostConfig: hostConfig,
+	}
+	if spec.Network != "" && !spec.HostNetwork {
+		cs.NetworkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{spec.Network: {}},
+		}
+	}
+	return cs, nil
+}
+
+// checkPorts fails when any of the addresses is already published by another container, as the frontend bound to it
+// would be unreachable
+func (r *dockerRuntime) checkPorts(name string, addrs []bindAddr) error {
+	conflicts, err := publishedPortConflicts(r.cli, name, addrs)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	taken := []string{}
+	seen := map[bindAddr]bool{}
+	for _, addr := range conflicts {
+		if !seen[addr] {
+			seen[addr] = true
+			taken = append(taken, fmt.Sprintf("%s:%d", addr.IP, addr.Port))
+		}
+	}
+	return fmt.Errorf("host ports in use by another container: %s", strings.Join(taken, ", "))
+}
+
+func (r *dockerRuntime) Start(spec workloadSpec) (string, error) {
+	cs, err := r.containerSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	return ensureContainer(r.cli, cs, r.markOwnKill)
+}
+
+func (r *dockerRuntime) Stop(name string) error {
+	r.markOwnKill(name)
+	err := r.cli.ContainerStop(context.Background(), name, nil)
+	if err != nil && !dockerClient.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Check(spec workloadSpec) (string, error) {
+	ctx := context.Background()
+	cs, err := r.containerSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	cs.HostConfig.AutoRemove = false
+	cs.Config.Labels = map[string]string{checkLabel: "true"}
+
+	// a check left behind by a crashed manager is in the way
+	err = r.cli.ContainerRemove(ctx, spec.Name, dockerTypes.ContainerRemoveOptions{Force: true})
+	if err != nil && !dockerClient.IsErrNotFound(err) {
+		return "", err
+	}
+	res, err := r.cli.ContainerCreate(ctx, cs.Config, cs.HostConfig, nil, spec.Name)
+	if dockerClient.IsErrNotFound(err) {
+		// the image isn't there yet
+		if err := pullImage(r.cli, cs.Config.Image); err != nil {
+			return "", err
+		}
+		res, err = r.cli.ContainerCreate(ctx, cs.Config, cs.HostConfig, nil, spec.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.cli.ContainerRemove(ctx, res.ID, dockerTypes.ContainerRemoveOptions{Force: true})
+	if err := r.cli.ContainerStart(ctx, res.ID, dockerTypes.ContainerStartOptions{}); err != nil {
+		return "", err
+	}
+
+	var exitCode int64
+	results, errs := r.cli.ContainerWait(ctx, res.ID, container.WaitConditionNotRunning)
+	select {
+	case result := <-results:
+		exitCode = result.StatusCode
+	case err := <-errs:
+		return "", err
+	}
+	output, err := r.Logs(res.ID, 0)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return output, fmt.Errorf("%s exited with status %d", spec.Name, exitCode)
+	}
+	return output, nil
+}
+
+func (r *dockerRuntime) Signal(name string, signal string) error {
+	return r.cli.ContainerKill(context.Background(), name, signal)
+}
+
+func (r *dockerRuntime) Wait(id string) (workloadExit, error) {
+	ch := make(chan workloadExit, 1)
+	r.mu.Lock()
+	if exit, ok := r.exits[id]; ok {
+		delete(r.exits, id)
+		r.mu.Unlock()
+		return exit, nil
+	}
+	r.waiters[id] = append(r.waiters[id], ch)
+	r.mu.Unlock()
+
+	for {
+		select {
+		case exit := <-ch:
+			return exit, nil
+		case <-time.After(waitRecheckInterval):
+			// in case the die event was missed
+			if err := r.resolveIfGone(id); err != nil {
+				return workloadExit{}, err
+			}
+		}
+	}
+}
+
+func (r *dockerRuntime) Events(name string) []workloadEvent {
+	return r.events.list(name)
+}
+
+// markOwnKill records that the manager is about to stop the container with the given name or ID
+func (r *dockerRuntime) markOwnKill(nameOrID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ownKills[nameOrID] = true
+}
+
+// subscribe starts following the Docker container events, and the network events for the containers joining or
+// leaving the discovery network
+func (r *dockerRuntime) subscribe() (<-chan events.Message, <-chan error, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, errs := r.cli.Events(ctx, dockerTypes.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", events.ContainerEventType),
+			filters.Arg("type", events.NetworkEventType),
+		),
+	})
+	return messages, errs, cancel
+}
+
+// watchEvents handles the events of a subscription, resubscribing when the stream breaks
+func (r *dockerRuntime) watchEvents(messages <-chan events.Message, errs <-chan error, cancel context.CancelFunc) {
+	for {
+		err := r.consumeEvents(messages, errs)
+		cancel()
+		log.Printf("docker events stream ended: %v, reconnecting\n", err)
+		time.Sleep(time.Second)
+		messages, errs, cancel = r.subscribe()
+
+		// exits and backend containers may have been missed while disconnected
+		r.mu.Lock()
+		if r.discovery != nil {
+			r.discovery.notify()
+		}
+		ids := []string{}
+		for id := range r.waiters {
+			ids = append(ids, id)
+		}
+		r.mu.Unlock()
+		for _, id := range ids {
+			if err := r.resolveIfGone(id); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (r *dockerRuntime) consumeEvents(messages <-chan events.Message, errs <-chan error) error {
+	for {
+		select {
+		case msg := <-messages:
+			r.handleEvent(msg)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (r *dockerRuntime) handleEvent(msg events.Message) {
+	if msg.Type == events.NetworkEventType {
+		// a labelled container connected to the discovery network after it started only gets its address there now
+		if msg.Action == "connect" || msg.Action == "disconnect" {
+			r.mu.Lock()
+			if r.discovery != nil && msg.Actor.Attributes["name"] == r.discovery.network {
+				r.discovery.notify()
+			}
+			r.mu.Unlock()
+		}
+		return
+	}
+	if msg.Actor.Attributes[backendLabel] != "" && (msg.Action == "start" || msg.Action == "die") {
+		r.mu.Lock()
+		if r.discovery != nil {
+			r.discovery.notify()
+		}
+		r.mu.Unlock()
+	}
+	name := msg.Actor.Attributes["name"]
+	if !strings.HasPrefix(name, "com.opencopilot.") || msg.Actor.Attributes[checkLabel] != "" {
+		// not one of the supervised containers
+		return
+	}
+	ev := workloadEvent{
+		Time:   time.Unix(0, msg.TimeNano),
+		Name:   name,
+		ID:     msg.Actor.ID,
+		Action: msg.Action,
+	}
+	if msg.TimeNano == 0 {
+		ev.Time = time.Unix(msg.Time, 0)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dying := r.dying[msg.Actor.ID]
+	if dying == nil {
+		dying = &workloadExit{}
+		r.dying[msg.Actor.ID] = dying
+	}
+
+	switch {
+	case msg.Action == "oom":
+		dying.OOMKilled = true
+	case msg.Action == "kill":
+		ev.Signal = signalName(msg.Actor.Attributes["signal"])
+		if ev.Signal != "SIGHUP" {
+			dying.Signal = ev.Signal
+			dying.External = !r.ownKills[name] && !r.ownKills[msg.Actor.ID]
+		}
+	case msg.Action == "die":
+		ev.ExitCode, _ = strconv.ParseInt(msg.Actor.Attributes["exitCode"], 10, 64)
+		dying.Code = ev.ExitCode
+		delete(r.ownKills, name)
+		delete(r.ownKills, msg.Actor.ID)
+		r.exited(msg.Actor.ID, *dying)
+	case strings.HasPrefix(msg.Action, "health_status"):
+		ev.Action = "health_status"
+		ev.Health = strings.TrimSpace(strings.TrimPrefix(msg.Action, "health_status:"))
+	case msg.Action == "destroy":
+		delete(r.dying, msg.Actor.ID)
+		return
+	default:
+		return
+	}
+	if ev.Action != "die" || dying.OOMKilled || dying.External {
+		log.Printf("%s %s: %s %s\n", name, shortID(ev.ID), ev.Action, describeExit(*dying))
+	}
+	r.events.record(ev)
+}
+
+// exited hands the exit of a container to its waiters, or keeps it for a later Wait. The caller must hold the lock.
+func (r *dockerRuntime) exited(id string, exit workloadExit) {
+	delete(r.dying, id)
+	waiters := r.waiters[id]
+	delete(r.waiters, id)
+	if len(waiters) == 0 {
+		r.exits[id] = exit
+		return
+	}
+	for _, ch := range waiters {
+		ch <- exit
+	}
+}
+
+// resolveIfGone completes the waiters of a container which is no longer running, for when its die event was missed
+func (r *dockerRuntime) resolveIfGone(id string) error {
+	existing, err := r.cli.ContainerInspect(context.Background(), id)
+	exit := workloadExit{Code: -1}
+	if err != nil {
+		if !dockerClient.IsErrNotFound(err) {
+			return err
+		}
+	} else if existing.State != nil && existing.State.Running {
+		return nil
+	} else if existing.State != nil {
+		exit.Code = int64(existing.State.ExitCode)
+		exit.OOMKilled = existing.State.OOMKilled
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, waiting := r.waiters[id]; waiting {
+		r.exited(id, exit)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Inspect(name string) (*workloadState, error) {
+	existing, err := r.cli.ContainerInspect(context.Background(), name)
+	if err != nil {
+		if dockerClient.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &workloadState{
+		ID:     existing.ID,
+		Limits: containerLimits(existing.HostConfig),
+	}
+	if existing.State != nil {
+		state.Running = existing.State.Running
+		state.ExitCode = int64(existing.State.ExitCode)
+		state.Health = containerHealth(existing.State.Health)
+	}
+	if state.Running {
+		usage, err := containerUsage(r.cli, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		state.Usage = usage
+	}
+	return state, nil
+}
+
+func (r *dockerRuntime) Logs(name string, tail int) (string, error) {
+	tailOption := "all"
+	if tail > 0 {
+		tailOption = strconv.Itoa(tail)
+	}
+	reader, err := r.cli.ContainerLogs(context.Background(), name, dockerTypes.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tailOption,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return demuxLogs(reader)
+}
+
+// demuxLogs strips the stream headers Docker adds to the logs of containers without a TTY
+func demuxLogs(reader io.Reader) (string, error) {
+	out := strings.Builder{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return out.String(), nil
+			}
+			return out.String(), err
+		}
+		frame, err := ioutil.ReadAll(io.LimitReader(reader, int64(binary.BigEndian.Uint32(header[4:]))))
+		if err != nil {
+			return out.String(), err
+		}
+		out.Write(frame)
+	}
+}
+
+func containerHealth(health *dockerTypes.Health) *workloadHealth {
+	if health == nil {
+		return nil
+	}
+	out := &workloadHealth{
+		Status:        health.Status,
+		FailingStreak: health.FailingStreak,
+	}
+	for _, result := range health.Log {
+		out.Log = append(out.Log, healthProbe{
+			Start:    result.Start,
+			End:      result.End,
+			ExitCode: result.ExitCode,
+			Output:   result.Output,
+		})
+	}
+	return out
+}
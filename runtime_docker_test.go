@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+)
+
+// startAndWait starts HAProxy and waits for it in the background, returning a channel with its exit
+func startAndWait(t *testing.T, rt *dockerRuntime) (string, chan workloadExit) {
+	id, err := rt.Start(testHAProxySpec(t, newService(DefaultServiceName, rt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exits := make(chan workloadExit, 1)
+	go func() {
+		exit, err := rt.Wait(id)
+		if err != nil {
+			t.Error(err)
+		}
+		exits <- exit
+	}()
+	return id, exits
+}
+
+func TestWaitReportsOOMKill(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+
+	id, exits := startAndWait(t, rt)
+	if err := docker.oomKill(id); err != nil {
+		t.Fatal(err)
+	}
+	exit := <-exits
+	if !exit.OOMKilled || exit.Code != 137 {
+		t.Errorf("expected an OOM kill, got %+v", exit)
+	}
+}
+
+func TestWaitReportsExternalKill(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+
+	id, exits := startAndWait(t, rt)
+	if err := docker.ContainerRemove(context.Background(), id, dockerTypes.ContainerRemoveOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	exit := <-exits
+	if !exit.External || exit.Signal != "SIGKILL" {
+		t.Errorf("expected an external kill, got %+v", exit)
+	}
+}
+
+func TestWaitReportsOwnStop(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	docker := newFakeDocker()
+	rt := newDockerRuntime(docker)
+	svc := newService(DefaultServiceName, rt)
+
+	_, exits := startAndWait(t, rt)
+	if err := rt.Stop(testHAProxySpec(t, svc).Name); err != nil {
+		t.Fatal(err)
+	}
+	exit := <-exits
+	if exit.External || exit.Signal != "SIGTERM" || exit.Code != 143 {
+		t.Errorf("expected a stop by the manager, got %+v", exit)
+	}
+
+	events := rt.Events(testHAProxySpec(t, svc).Name)
+	if len(events) != 2 || events[0].Action != "kill" || events[1].Action != "die" || events[1].ExitCode != 143 {
+		t.Errorf("expected kill and die events, got %+v", events)
+	}
+}
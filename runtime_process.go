@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+)
+
+// processStopTimeout is how long a process gets to exit after SIGTERM before it is killed
+const processStopTimeout = 10 * time.Second
+
+// processRuntime runs workloads as supervised child processes of the manager, for hosts without a Docker daemon.
+// Pid files are kept so that a restarted manager can adopt processes left running by its predecessor.
+type processRuntime struct {
+	runDir string
+	events *eventLog
+
+	mu    sync.Mutex
+	procs map[string]*process
+}
+
+// process is a workload started or adopted by the processRuntime
+type process struct {
+	pid    int
+	argv   []string
+	limits resourceLimits
+	output *outputBuffer
+	done   chan struct{}
+	exit   workloadExit
+	// stopping is set when the manager is stopping the process
+	stopping bool
+	// health is nil for processes without a healthcheck
+	health *workloadHealth
+}
+
+func newProcessRuntime() *processRuntime {
+	return &processRuntime{
+		runDir: filepath.Join(ConfigDir, "/run/"),
+		events: &eventLog{},
+		procs:  map[string]*process{},
+	}
+}
+
+func (r *processRuntime) pidFile(name string) string {
+	return filepath.Join(r.runDir, name+".pid")
+}
+
+func (r *processRuntime) Start(spec workloadSpec) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p := r.procs[spec.Name]; p != nil && p.running() {
+		if sameArgv(p.argv, spec.Command) {
+			return strconv.Itoa(p.pid), nil
+		}
+		log.Printf("process %s has drifted (command), restarting\n", spec.Name)
+		r.mu.Unlock()
+		err := r.Stop(spec.Name)
+		r.mu.Lock()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if p := r.adopt(spec); p != nil {
+		r.procs[spec.Name] = p
+		r.startProbing(spec, p)
+		return strconv.Itoa(p.pid), nil
+	}
+
+	limits := resourceLimits{}
+	if spec.Limits != nil {
+		limits = *spec.Limits
+		if limits.NanoCPUs != 0 || limits.Memory != 0 || len(limits.Sysctls) != 0 {
+			log.Printf("CPU, memory and sysctl limits are not supported by the process runtime, ignoring them for %s\n", spec.Name)
+		}
+	}
+
+	p := &process{
+		argv:   spec.Command,
+		limits: limits,
+		output: newOutputBuffer(spec.Name),
+		done:   make(chan struct{}),
+	}
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	if limits.NoFile > 0 {
+		// the limit is set by a shell which then execs the command, so it applies to the process alone rather than to
+		// the manager and everything it starts later, and is in place before the process reads it
+		script := fmt.Sprintf(`ulimit -n %d || echo "unable to set the nofile limit of %s" >&2; exec "$0" "$@"`, limits.NoFile, spec.Name)
+		cmd = exec.Command("/bin/sh", append([]string{"-c", script}, spec.Command...)...)
+	}
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Stdout = p.output
+	cmd.Stderr = p.output
+	// run in its own process group so the process outlives the manager when it is left running
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := os.MkdirAll(r.runDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	p.pid = cmd.Process.Pid
+
+	if err := ioutil.WriteFile(r.pidFile(spec.Name), []byte(strconv.Itoa(p.pid)), 0644); err != nil {
+		// without its pid file the process could be neither stopped nor adopted by a restarted manager
+		syscall.Kill(-p.pid, syscall.SIGKILL)
+		cmd.Wait()
+		return "", err
+	}
+
+	go func() {
+		err := cmd.Wait()
+		r.mu.Lock()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status := exitErr.Sys().(syscall.WaitStatus)
+			p.exit.Code = int64(status.ExitStatus())
+			if status.Signaled() {
+				p.exit.Code = 128 + int64(status.Signal())
+				p.exit.Signal = signalName(strconv.Itoa(int(status.Signal())))
+				p.exit.External = !p.stopping
+			}
+		}
+		r.mu.Unlock()
+		os.Remove(r.pidFile(spec.Name))
+		r.events.record(workloadEvent{
+			Time:     time.Now(),
+			Name:     spec.Name,
+			ID:       strconv.Itoa(p.pid),
+			Action:   "die",
+			ExitCode: p.exit.Code,
+			Signal:   p.exit.Signal,
+		})
+		close(p.done)
+	}()
+
+	r.procs[spec.Name] = p
+	r.startProbing(spec, p)
+	return strconv.Itoa(p.pid), nil
+}
+
+// startProbing runs the healthcheck of a process while it is running, as Docker does for containers. The caller must hold the lock.
+func (r *processRuntime) startProbing(spec workloadSpec, p *process) {
+	hc := spec.Healthcheck
+	if hc == nil {
+		return
+	}
+	p.health = &workloadHealth{Status: "starting"}
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+			}
+			result := runProbe(hc)
+			r.mu.Lock()
+			changed := p.health.update(result, hc.Retries)
+			status := p.health.Status
+			r.mu.Unlock()
+			if changed {
+				r.events.record(workloadEvent{Time: time.Now(), Name: spec.Name, ID: strconv.Itoa(p.pid), Action: "health_status", Health: status})
+			}
+		}
+	}()
+}
+
+// adopt picks up a process left running by a previous manager, if its pid file points at a process running the same
+// command. An HAProxy master which reloaded has re-executed itself with the reload flags added, which are left out.
+func (r *processRuntime) adopt(spec workloadSpec) *process {
+	data, err := ioutil.ReadFile(r.pidFile(spec.Name))
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil
+	}
+	argv := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if !sameArgv(withoutReloadFlags(argv), spec.Command) {
+		return nil
+	}
+
+	log.Printf("adopting running process %s with pid %d\n", spec.Name, pid)
+	p := &process{
+		pid:    pid,
+		argv:   spec.Command,
+		output: newOutputBuffer(spec.Name),
+		done:   make(chan struct{}),
+		exit:   workloadExit{Code: -1},
+	}
+	if spec.Limits != nil {
+		p.limits = *spec.Limits
+	}
+	// an adopted process isn't our child, so its exit can only be noticed by polling
+	go func() {
+		for syscall.Kill(pid, 0) == nil {
+			time.Sleep(time.Second)
+		}
+		os.Remove(r.pidFile(spec.Name))
+		r.events.record(workloadEvent{Time: time.Now(), Name: spec.Name, ID: strconv.Itoa(pid), Action: "die", ExitCode: -1})
+		close(p.done)
+	}()
+	return p
+}
+
+func (r *processRuntime) lookup(name string) *process {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.procs[name]
+}
+
+func (r *processRuntime) Stop(name string) error {
+	p := r.lookup(name)
+	if p == nil || !p.running() {
+		return nil
+	}
+	r.mu.Lock()
+	p.stopping = true
+	r.mu.Unlock()
+	r.events.record(workloadEvent{Time: time.Now(), Name: name, ID: strconv.Itoa(p.pid), Action: "kill", Signal: "SIGTERM"})
+	if err := syscall.Kill(p.pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	select {
+	case <-p.done:
+	case <-time.After(processStopTimeout):
+		log.Printf("process %s didn't stop in time, killing it\n", name)
+		syscall.Kill(p.pid, syscall.SIGKILL)
+		<-p.done
+	}
+	return nil
+}
+
+func (r *processRuntime) Check(spec workloadSpec) (string, error) {
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func (r *processRuntime) Signal(name string, signal string) error {
+	p := r.lookup(name)
+	if p == nil || !p.running() {
+		return fmt.Errorf("process %s is not running", name)
+	}
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+	r.events.record(workloadEvent{Time: time.Now(), Name: name, ID: strconv.Itoa(p.pid), Action: "kill", Signal: signal})
+	return syscall.Kill(p.pid, sig)
+}
+
+func (r *processRuntime) Wait(id string) (workloadExit, error) {
+	r.mu.Lock()
+	var p *process
+	for _, candidate := range r.procs {
+		if strconv.Itoa(candidate.pid) == id {
+			p = candidate
+		}
+	}
+	r.mu.Unlock()
+	if p == nil {
+		return workloadExit{}, fmt.Errorf("no process with id %s", id)
+	}
+	<-p.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return p.exit, nil
+}
+
+func (r *processRuntime) Events(name string) []workloadEvent {
+	return r.events.list(name)
+}
+
+func (r *processRuntime) Inspect(name string) (*workloadState, error) {
+	p := r.lookup(name)
+	if p == nil {
+		return nil, nil
+	}
+	r.mu.Lock()
+	state := &workloadState{
+		ID:       strconv.Itoa(p.pid),
+		Running:  p.running(),
+		ExitCode: p.exit.Code,
+		Limits:   p.limits,
+	}
+	if p.health != nil {
+		health := *p.health
+		health.Log = append([]healthProbe{}, p.health.Log...)
+		state.Health = &health
+	}
+	r.mu.Unlock()
+	if state.Running {
+		state.Usage = processUsage(p.pid)
+	}
+	return state, nil
+}
+
+func (r *processRuntime) Logs(name string, tail int) (string, error) {
+	p := r.lookup(name)
+	if p == nil {
+		return "", fmt.Errorf("no process named %s", name)
+	}
+	return p.output.tail(tail), nil
+}
+
+func (p *process) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// processUsage reads the memory usage of a process from /proc
+func processUsage(pid int) *pb.ResourceUsage {
+	usage := &pb.ResourceUsage{Pids: 1}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return usage
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			usage.MemoryBytes = kb * 1024
+		}
+	}
+	return usage
+}
+
+func sameArgv(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutReloadFlags drops the flags an HAProxy master adds to its own command when it reloads: -sf or -st with the
+// pids of the old workers, and -x with the socket to take the listeners from
+func withoutReloadFlags(argv []string) []string {
+	stripped := []string{}
+	for i := 0; i < len(argv); i++ {
+		switch argv[i] {
+		case "-sf", "-st":
+			for i+1 < len(argv) {
+				if _, err := strconv.Atoi(argv[i+1]); err != nil {
+					break
+				}
+				i++
+			}
+		case "-x":
+			i++
+		default:
+			stripped = append(stripped, argv[i])
+		}
+	}
+	return stripped
+}
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal: %s", name)
+	}
+	return sig, nil
+}
+
+// outputBufferLines is how many lines of output are kept per process
+const outputBufferLines = 500
+
+// outputBuffer keeps the most recent lines written by a process and echoes them to the manager's log
+type outputBuffer struct {
+	name string
+
+	mu      sync.Mutex
+	partial []byte
+	lines   []string
+}
+
+func newOutputBuffer(name string) *outputBuffer {
+	return &outputBuffer{name: name}
+}
+
+func (b *outputBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partial = append(b.partial, data...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(b.partial[:i])
+		b.partial = b.partial[i+1:]
+		log.Printf("[%s] %s\n", b.name, line)
+		b.lines = append(b.lines, line)
+		if len(b.lines) > outputBufferLines {
+			b.lines = b.lines[len(b.lines)-outputBufferLines:]
+		}
+	}
+	return len(data), nil
+}
+
+func (b *outputBuffer) tail(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := b.lines
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startUnmanaged starts a process as a previous manager would have left it running, with its pid file
+func startUnmanaged(t *testing.T, r *processRuntime, name string, argv ...string) *exec.Cmd {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// reaped in the background, so the process is gone once it is killed
+	go cmd.Wait()
+	if err := os.MkdirAll(r.runDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(r.pidFile(name), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestProcessRuntimeAdoptsReloadedMaster(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	r := newProcessRuntime()
+	command := []string{"/bin/sh", "-c", "sleep 30; :"}
+	// a master which reloaded runs with the pids of the old workers and the socket it took the listeners from
+	previous := startUnmanaged(t, r, "haproxy", append(command, "-sf", "41", "42", "-x", "/run/haproxy.sock")...)
+	defer syscall.Kill(-previous.Process.Pid, syscall.SIGKILL)
+
+	id, err := r.Start(workloadSpec{Name: "haproxy", Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop("haproxy")
+	if id != strconv.Itoa(previous.Process.Pid) {
+		t.Errorf("expected the reloaded master %d to be adopted, got %s", previous.Process.Pid, id)
+	}
+}
+
+// waitForCommand waits for the process to run argv, after any wrapper it was started with exec'd it
+func waitForCommand(t *testing.T, pid string, argv []string) {
+	waitFor(t, "process "+pid+" to run "+strings.Join(argv, " "), func() bool {
+		cmdline, err := ioutil.ReadFile("/proc/" + pid + "/cmdline")
+		return err == nil && sameArgv(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), argv)
+	})
+}
+
+// openFilesLimit reads the soft and hard limits on open files of a process
+func openFilesLimit(t *testing.T, pid string) (string, string) {
+	limits, err := ioutil.ReadFile("/proc/" + pid + "/limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(limits), "\n") {
+		if strings.HasPrefix(line, "Max open files") {
+			fields := strings.Fields(line)
+			return fields[3], fields[4]
+		}
+	}
+	t.Fatalf("no open files limit in %s", limits)
+	return "", ""
+}
+
+// runningCommand tells whether any process runs argv
+func runningCommand(argv []string) bool {
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range cmdlines {
+		cmdline, err := ioutil.ReadFile(path)
+		if err == nil && sameArgv(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), argv) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProcessRuntimeStartStopAndWait(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	r := newProcessRuntime()
+	spec := workloadSpec{Name: "haproxy", Command: []string{"sleep", "30"}}
+
+	id, err := r.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCommand(t, id, spec.Command)
+	pid, err := ioutil.ReadFile(r.pidFile(spec.Name))
+	if err != nil || string(pid) != id {
+		t.Errorf("expected the pid file to hold %s, got %q %v", id, pid, err)
+	}
+	var manager syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &manager); err != nil {
+		t.Fatal(err)
+	}
+	if soft, _ := openFilesLimit(t, id); soft != strconv.FormatUint(manager.Cur, 10) {
+		t.Errorf("expected the process to have the manager's open files limit %d, got %s", manager.Cur, soft)
+	}
+	if again, err := r.Start(spec); err != nil || again != id {
+		t.Errorf("expected the running process to be kept, got %s %v", again, err)
+	}
+
+	exits := make(chan workloadExit, 1)
+	go func() {
+		exit, err := r.Wait(id)
+		if err != nil {
+			t.Error(err)
+		}
+		exits <- exit
+	}()
+	if err := r.Stop(spec.Name); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case exit := <-exits:
+		if exit.Code != 143 || exit.Signal != "SIGTERM" || exit.External {
+			t.Errorf("expected a stop by the manager, got %+v", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Wait to return once the process stopped")
+	}
+	if state, err := r.Inspect(spec.Name); err != nil || state.Running {
+		t.Errorf("expected the process to be stopped, got %+v %v", state, err)
+	}
+	if _, err := os.Stat(r.pidFile(spec.Name)); !os.IsNotExist(err) {
+		t.Errorf("expected the pid file to be removed, got %v", err)
+	}
+}
+
+func TestProcessRuntimeSetsOpenFilesLimitOfProcess(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	r := newProcessRuntime()
+	var before syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &before); err != nil {
+		t.Fatal(err)
+	}
+	spec := workloadSpec{Name: "haproxy", Command: []string{"sleep", "30"}, Limits: &resourceLimits{NoFile: 512}}
+
+	id, err := r.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(spec.Name)
+	// the wrapper setting the limit execs the command in the same process
+	waitForCommand(t, id, spec.Command)
+	if soft, hard := openFilesLimit(t, id); soft != "512" || hard != "512" {
+		t.Errorf("expected the process to be limited to 512 open files, got %s and %s", soft, hard)
+	}
+	var after syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("expected the manager's own limit %+v to be left alone, got %+v", before, after)
+	}
+}
+
+func TestProcessRuntimeReplacesStalePid(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	r := newProcessRuntime()
+	spec := workloadSpec{Name: "haproxy", Command: []string{"sleep", "30"}}
+	// the pid was taken by another process since the previous manager left
+	other := startUnmanaged(t, r, spec.Name, "sleep", "31")
+	defer syscall.Kill(-other.Process.Pid, syscall.SIGKILL)
+
+	id, err := r.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(spec.Name)
+	if id == strconv.Itoa(other.Process.Pid) {
+		t.Fatal("expected a process running another command not to be adopted")
+	}
+	if pid, err := ioutil.ReadFile(r.pidFile(spec.Name)); err != nil || string(pid) != id {
+		t.Errorf("expected the pid file to hold the new process %s, got %q %v", id, pid, err)
+	}
+}
+
+func TestProcessRuntimeKillsProcessWithoutPidFile(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	r := newProcessRuntime()
+	spec := workloadSpec{Name: "haproxy", Command: []string{"sleep", "3117"}}
+	// a directory in the way of the pid file
+	if err := os.MkdirAll(r.pidFile(spec.Name), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Start(spec); err == nil {
+		t.Fatal("expected the start to fail without a pid file")
+	}
+	if runningCommand(spec.Command) {
+		t.Error("expected the process to be killed when its pid file can't be written")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Secrets are the tokens and passwords the manager knows of, which are redacted from its logs
+var Secrets = &secretSet{}
+
+// secretSet keeps every secret added to it, so that logs stay redacted after a secret is rotated
+type secretSet struct {
+	mu      sync.RWMutex
+	secrets [][]byte
+}
+
+// add remembers secret, empty and already known secrets are ignored
+func (s *secretSet) add(secret string) {
+	if secret == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, known := range s.secrets {
+		if string(known) == secret {
+			return
+		}
+	}
+	s.secrets = append(s.secrets, []byte(secret))
+}
+
+// redact replaces the known secrets in text with [redacted]
+func (s *secretSet) redact(text []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, secret := range s.secrets {
+		text = bytes.Replace(text, secret, []byte("[redacted]"), -1)
+	}
+	return text
+}
+
+// redactingWriter redacts the secrets from each write, which the log package makes one per line
+type redactingWriter struct {
+	out     io.Writer
+	secrets *secretSet
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(w.secrets.redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync lets the writer back a zap logger
+func (w redactingWriter) Sync() error {
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	secrets := &secretSet{}
+	secrets.add("")
+	secrets.add("s3cret")
+	secrets.add("s3cret")
+	secrets.add("rotated")
+
+	out := &bytes.Buffer{}
+	logger := log.New(redactingWriter{out: out, secrets: secrets}, "", 0)
+	logger.Printf("token %s then %s, empty %q", "s3cret", "rotated", "")
+	if out.String() != "token [redacted] then [redacted], empty \"\"\n" {
+		t.Errorf("unexpected log: %q", out.String())
+	}
+	if len(secrets.secrets) != 2 {
+		t.Errorf("expected duplicate and empty secrets to be ignored, got %d", len(secrets.secrets))
+	}
+}
@@ -4,14 +4,19 @@ import (
 	"context"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"time"
 
 	pb "github.com/opencopilot/haproxy-manager/manager"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
-	dockerClient "github.com/docker/docker/client"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"github.com/grpc-ecosystem/go-grpc-middleware/recovery"
@@ -19,31 +24,214 @@ import (
 )
 
 type server struct {
-	dockerCli *dockerClient.Client
+	manager *manager
+}
+
+// serviceError maps the manager's errors to gRPC status errors
+func serviceError(err error) error {
+	switch err {
+	case errServiceNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case errInvalidServiceName:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errServiceExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errDefaultService:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
 }
 
 func (s *server) GetStatus(ctx context.Context, in *pb.ManagerStatusRequest) (*pb.ManagerStatus, error) {
-	// return the status of the manager - what should this contain?
-	return &pb.ManagerStatus{}, nil
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return serviceStatus(svc)
+}
+
+// serviceStatus describes the HAProxy workload of a service
+func serviceStatus(svc *service) (*pb.ManagerStatus, error) {
+	name := svc.haproxyName()
+	events := append(svc.rt.Events(name), svc.events.list(svc.Name)...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	status := &pb.ManagerStatus{
+		Service:     svc.Name,
+		Events:      eventsToProto(events),
+		RenderError: renderErrorToProto(svc.renderError()),
+		Persistence: persistenceToProto(svc.persistence()),
+	}
+	if pages, err := svc.errorPages(); err == nil {
+		status.Maintenance = pages.Maintenance
+	}
+	state, err := svc.rt.Inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return status, nil
+	}
+	status.ContainerId = state.ID
+	status.Limits = limitsToProto(state.Limits, globalMaxconn(svc.configPath()))
+	status.Usage = state.Usage
+	status.Health = healthToProto(state.Health)
+	return status, nil
 }
 
 func (s *server) Configure(ctx context.Context, in *pb.ConfigureRequest) (*pb.ManagerStatus, error) {
-	// execute the configuration change on the service (HAProxy)
-	// configureService(s.dockerCli)
-	return &pb.ManagerStatus{}, nil
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	api, ok := Source.(*apiSource)
+	if !ok {
+		return nil, status.Error(codes.FailedPrecondition, "keys can only be set through the API with CONFIG_SOURCE=api")
+	}
+	// the service's watcher renders the new keys
+	if err := api.set(svc.kvPrefix(), in.Keys); err != nil {
+		return nil, err
+	}
+	return serviceStatus(svc)
+}
+
+func (s *server) ListServices(ctx context.Context, in *pb.ListServicesRequest) (*pb.ServiceList, error) {
+	return &pb.ServiceList{Services: s.manager.serviceNames()}, nil
 }
 
-func startServer(dockerCli *dockerClient.Client) {
+func (s *server) CreateService(ctx context.Context, in *pb.CreateServiceRequest) (*pb.ManagerStatus, error) {
+	svc, err := s.manager.createService(in.Name)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return serviceStatus(svc)
+}
+
+func (s *server) DeleteService(ctx context.Context, in *pb.DeleteServiceRequest) (*pb.DeleteServiceResponse, error) {
+	if err := s.manager.deleteService(in.Name); err != nil {
+		return nil, serviceError(err)
+	}
+	return &pb.DeleteServiceResponse{}, nil
+}
+
+func (s *server) GetAccessLogs(ctx context.Context, in *pb.AccessLogRequest) (*pb.AccessLogs, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	if svc.accessLog == nil {
+		return nil, status.Error(codes.Unavailable, "the access log receiver of this service isn't running")
+	}
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = 100
+	}
+	return &pb.AccessLogs{Entries: accessLogToProto(svc.accessLog.entries(limit, in.Backend))}, nil
+}
+
+func (s *server) GetTrafficStats(ctx context.Context, in *pb.TrafficStatsRequest) (*pb.TrafficStats, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	if svc.accessLog == nil {
+		return nil, status.Error(codes.Unavailable, "the access log receiver of this service isn't running")
+	}
+	stats := svc.accessLog.stats
+	window, err := stats.window(in.Window)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return trafficToProto(window, stats.snapshot(window, time.Now())), nil
+}
+
+func (s *server) GetRateLimitCounters(ctx context.Context, in *pb.RateLimitCountersRequest) (*pb.RateLimitCounters, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	counters, err := svc.rateLimitCounters(in.Frontend)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to read the rate limits from HAProxy: %v", err)
+	}
+	return &pb.RateLimitCounters{Counters: trackedCountersToProto(counters)}, nil
+}
+
+func (s *server) ListBans(ctx context.Context, in *pb.ListBansRequest) (*pb.BanList, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return &pb.BanList{Bans: bansToProto(svc.listBans())}, nil
+}
+
+func (s *server) ListErrorPages(ctx context.Context, in *pb.ListErrorPagesRequest) (*pb.ErrorPages, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	return listErrorPages(svc)
+}
+
+func (s *server) SetErrorPage(ctx context.Context, in *pb.SetErrorPageRequest) (*pb.ErrorPages, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	if err := svc.setErrorPage(int(in.Status), in.Backend, in.ContentType, in.Body); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the config refers to the pages
+	svc.requestRender()
+	return listErrorPages(svc)
+}
+
+func (s *server) DeleteErrorPage(ctx context.Context, in *pb.DeleteErrorPageRequest) (*pb.ErrorPages, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	if err := svc.deleteErrorPage(int(in.Status), in.Backend); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "there is no %d page", in.Status)
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the config refers to the pages
+	svc.requestRender()
+	return listErrorPages(svc)
+}
+
+func (s *server) SetMaintenance(ctx context.Context, in *pb.SetMaintenanceRequest) (*pb.ErrorPages, error) {
+	svc, err := s.manager.service(in.Service)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	if err := svc.setMaintenance(in.Enabled, in.ContentType, in.Body); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the config refers to the pages
+	svc.requestRender()
+	return listErrorPages(svc)
+}
+
+func listErrorPages(svc *service) (*pb.ErrorPages, error) {
+	pages, err := svc.errorPages()
+	if err != nil {
+		return nil, err
+	}
+	return errorPagesToProto(pages), nil
+}
+
+func startServer(m *manager) {
 	lis, err := net.Listen("tcp", ":50052")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	logger, err := zap.NewProduction()
+	// the production config, logging to stderr through the redaction of secrets
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	core := zapcore.NewCore(encoder, redactingWriter{out: os.Stderr, secrets: Secrets}, zap.InfoLevel)
+	logger := zap.New(zapcore.NewSampler(core, time.Second, 100, 100), zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
 	defer logger.Sync()
-	if err != nil {
-		log.Fatalf("failed to setup logger: %v", err)
-	}
 
 	s := grpc.NewServer(
 		// grpc.Creds(creds),
@@ -60,7 +248,7 @@ func startServer(dockerCli *dockerClient.Client) {
 	)
 
 	pb.RegisterManagerServer(s, &server{
-		dockerCli: dockerCli,
+		manager: m,
 	})
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
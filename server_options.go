@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// haproxyTimePattern is a time in HAProxy's format, milliseconds unless a unit is given
+var haproxyTimePattern = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+
+// serverRecord is a server given as a JSON object instead of a host:port address, such as
+// {"address": "10.0.0.1:8080", "weight": 10, "backup": true}
+type serverRecord struct {
+	Address string `json:"address"`
+	serverOptions
+}
+
+// serverOptions are the settings of a server. Unset options are left to HAProxy's defaults.
+type serverOptions struct {
+	// Weight is from 0 to 256, a server with weight 0 gets no new traffic
+	Weight *int `json:"weight"`
+	// Backup servers only get traffic when no other server is up
+	Backup  bool `json:"backup"`
+	Maxconn *int `json:"maxconn"`
+	// Slowstart is how long a server takes to get its full weight after it comes up, e.g. 30s
+	Slowstart string `json:"slowstart"`
+	// Inter, Rise and Fall tune the health check: its interval, and how many checks it takes to go up or down
+	Inter string `json:"inter"`
+	Rise  *int   `json:"rise"`
+	Fall  *int   `json:"fall"`
+	// AgentPort enables an agent check on this port of the server
+	AgentPort *int `json:"agent_port"`
+	// SendProxy sends the PROXY protocol header on connections to the server
+	SendProxy bool `json:"send_proxy"`
+}
+
+// parseServerValue reads the value of a server key, either host:port or a serverRecord
+func parseServerValue(value string) (string, int, serverOptions, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "{") {
+		host, port, err := parseServerAddress(value)
+		return host, port, serverOptions{}, err
+	}
+
+	record := serverRecord{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&record); err != nil {
+		return "", 0, serverOptions{}, fmt.Errorf("invalid server record: %v", err)
+	}
+	host, port, err := parseServerAddress(record.Address)
+	if err != nil {
+		return "", 0, serverOptions{}, err
+	}
+	if err := record.serverOptions.validate(); err != nil {
+		return "", 0, serverOptions{}, err
+	}
+	return host, port, record.serverOptions, nil
+}
+
+func parseServerAddress(address string) (string, int, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 || host == "" || strings.ContainsAny(host, " \t\r\n#") {
+		return "", 0, fmt.Errorf("%q isn't a host:port address", address)
+	}
+	return host, portNumber, nil
+}
+
+func (o serverOptions) validate() error {
+	ranges := []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"weight", o.Weight, 0, 256},
+		{"maxconn", o.Maxconn, 0, 1 << 30},
+		{"rise", o.Rise, 1, 1 << 30},
+		{"fall", o.Fall, 1, 1 << 30},
+		{"agent_port", o.AgentPort, 1, 65535},
+	}
+	for _, r := range ranges {
+		if r.value != nil && (*r.value < r.min || *r.value > r.max) {
+			return fmt.Errorf("%s must be from %d to %d", r.name, r.min, r.max)
+		}
+	}
+	times := []struct {
+		name  string
+		value string
+	}{
+		{"slowstart", o.Slowstart},
+		{"inter", o.Inter},
+	}
+	for _, t := range times {
+		if t.value != "" && !haproxyTimePattern.MatchString(t.value) {
+			return fmt.Errorf("%s %q isn't a time such as 500ms or 30s", t.name, t.value)
+		}
+	}
+	return nil
+}
+
+// keywords returns the server keywords of the options, the health check included
+func (o serverOptions) keywords() []string {
+	keywords := []string{}
+	if o.Weight != nil {
+		keywords = append(keywords, "weight "+strconv.Itoa(*o.Weight))
+	}
+	if o.Maxconn != nil {
+		keywords = append(keywords, "maxconn "+strconv.Itoa(*o.Maxconn))
+	}
+	if o.Slowstart != "" {
+		keywords = append(keywords, "slowstart "+o.Slowstart)
+	}
+	if o.Backup {
+		keywords = append(keywords, "backup")
+	}
+	if o.SendProxy {
+		keywords = append(keywords, "send-proxy")
+	}
+	keywords = append(keywords, "check")
+	if o.Inter != "" {
+		keywords = append(keywords, "inter "+o.Inter)
+	}
+	if o.Rise != nil {
+		keywords = append(keywords, "rise "+strconv.Itoa(*o.Rise))
+	}
+	if o.Fall != nil {
+		keywords = append(keywords, "fall "+strconv.Itoa(*o.Fall))
+	}
+	if o.AgentPort != nil {
+		keywords = append(keywords, "agent-check agent-port "+strconv.Itoa(*o.AgentPort))
+	}
+	return keywords
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseServerValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		host     string
+		port     int
+		keywords []string
+	}{
+		{"10.0.0.1:80", "10.0.0.1", 80, []string{"check"}},
+		{" web.internal:8080\n", "web.internal", 8080, []string{"check"}},
+		{"[fd00::1]:443", "fd00::1", 443, []string{"check"}},
+		{`{"address": "10.0.0.1:80"}`, "10.0.0.1", 80, []string{"check"}},
+		{`{"address": "10.0.0.2:80", "weight": 0, "backup": true}`, "10.0.0.2", 80, []string{"weight 0", "backup", "check"}},
+		{
+			`{"address": "10.0.0.3:80", "weight": 25, "maxconn": 100, "slowstart": "30s", "inter": "2s", "rise": 3, "fall": 2, "agent_port": 5555, "send_proxy": true}`,
+			"10.0.0.3", 80,
+			[]string{"weight 25", "maxconn 100", "slowstart 30s", "send-proxy", "check", "inter 2s", "rise 3", "fall 2", "agent-check agent-port 5555"},
+		},
+	}
+	for _, test := range tests {
+		host, port, options, err := parseServerValue(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if host != test.host || port != test.port || !reflect.DeepEqual(options.keywords(), test.keywords) {
+			t.Errorf("%s: expected %s:%d %v, got %s:%d %v", test.value, test.host, test.port, test.keywords, host, port, options.keywords())
+		}
+	}
+}
+
+func TestParseServerValueErrors(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"10.0.0.1", "missing port"},
+		{"10.0.0.1:0", "isn't a host:port"},
+		{":80", "isn't a host:port"},
+		{`{"address": "10.0.0.1:80", "weight": 257}`, "weight must be from 0 to 256"},
+		{`{"address": "10.0.0.1:80", "weight": "heavy"}`, "invalid server record"},
+		{`{"address": "10.0.0.1:80", "maxconn": -1}`, "maxconn"},
+		{`{"address": "10.0.0.1:80", "rise": 0}`, "rise"},
+		{`{"address": "10.0.0.1:80", "fall": 0}`, "fall"},
+		{`{"address": "10.0.0.1:80", "agent_port": 70000}`, "agent_port"},
+		{`{"address": "10.0.0.1:80", "slowstart": "soon"}`, "slowstart"},
+		{`{"address": "10.0.0.1:80", "inter": "2s check"}`, "inter"},
+		{`{"address": "10.0.0.1:80", "standby": true}`, "unknown field"},
+		{`{"weight": 1}`, "missing port"},
+		{`{"address": "10.0.0.1:80"`, "invalid server record"},
+	}
+	for _, test := range tests {
+		if _, _, _, err := parseServerValue(test.value); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.value, test.err, err)
+		}
+	}
+}
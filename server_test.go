@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pb "github.com/opencopilot/haproxy-manager/manager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetStatusWithoutHAProxy(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	s := &server{manager: testManager(newDockerRuntime(newFakeDocker()))}
+
+	status, err := s.GetStatus(context.Background(), &pb.ManagerStatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ContainerId != "" || status.Limits != nil {
+		t.Errorf("expected an empty status, got %+v", status)
+	}
+}
+
+func TestGetStatusReportsLimitsAndUsage(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	rt := newDockerRuntime(newFakeDocker())
+	svc := newService(DefaultServiceName, rt)
+	s := &server{manager: testManager(rt)}
+
+	id, err := rt.Start(testHAProxySpec(t, svc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := s.GetStatus(context.Background(), &pb.ManagerStatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ContainerId != id {
+		t.Errorf("expected container ID %s, got %s", id, status.ContainerId)
+	}
+	if status.Limits.Maxconn != 500 || status.Limits.Nofile != 2*500+nofileHeadroom {
+		t.Errorf("unexpected limits: %+v", status.Limits)
+	}
+	if status.Usage == nil || status.Usage.MemoryBytes == 0 {
+		t.Errorf("expected usage to be reported, got %+v", status.Usage)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	s := &server{manager: testManager(newDockerRuntime(newFakeDocker()))}
+	previous := Source
+	defer func() { Source = previous }()
+
+	keys := map[string]string{"maxconn": "2000"}
+	if _, err := s.Configure(context.Background(), &pb.ConfigureRequest{Keys: keys}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition unless the API is the config source, got %v", err)
+	}
+
+	api, err := newAPISource(filepath.Join(ConfigDir, "/keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Source = api
+	if _, err := s.Configure(context.Background(), &pb.ConfigureRequest{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	kv, _, err := api.list(context.Background(), s.manager.services[DefaultServiceName].kvPrefix(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv["instances/"+InstanceID+"/services/"+DefaultServiceName+"/maxconn"] != "2000" {
+		t.Errorf("expected the keys to be set under the service's prefix, got %v", kv)
+	}
+	_, err = s.Configure(context.Background(), &pb.ConfigureRequest{Service: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown service, got %v", err)
+	}
+}
+
+func TestServiceRPCs(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	s := &server{manager: testManager(newDockerRuntime(newFakeDocker()))}
+	defer s.manager.shutdown(true)
+	ctx := context.Background()
+
+	created, err := s.CreateService(ctx, &pb.CreateServiceRequest{Name: "internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Service != "internal" {
+		t.Errorf("expected the status of the new service, got %+v", created)
+	}
+	if _, err := s.CreateService(ctx, &pb.CreateServiceRequest{Name: "internal"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+	if _, err := s.CreateService(ctx, &pb.CreateServiceRequest{Name: "Not Valid"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+
+	list, err := s.ListServices(ctx, &pb.ListServicesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.Services, []string{"internal", DefaultServiceName}) {
+		t.Errorf("unexpected services: %v", list.Services)
+	}
+
+	if _, err := s.DeleteService(ctx, &pb.DeleteServiceRequest{Name: DefaultServiceName}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+	if _, err := s.DeleteService(ctx, &pb.DeleteServiceRequest{Name: "internal"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetStatus(ctx, &pb.ManagerStatusRequest{Service: "internal"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound after deleting, got %v", err)
+	}
+}
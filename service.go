@@ -0,0 +1,290 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"path/filepath"
+)
+
+// serviceNamePattern restricts service names to what can be used in container names, paths and KV keys
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// service is a load balancer run by the manager: an HAProxy with its own config dir, KV prefix, workloads and ports
+type service struct {
+	Name string
+	rt   Runtime
+
+	stopEnsuringService chan struct{}
+	stopRendering       chan struct{}
+	stopBlocking        chan struct{}
+	// rerender asks the renderer to render again although the keys are the same
+	rerender chan struct{}
+
+	// accessLog is nil when the log receiver couldn't be started
+	accessLog *accessLog
+
+	// renderMu guards lastRenderError, which is nil after a successful render
+	renderMu        sync.Mutex
+	lastRenderError *renderError
+	// events are the service's own events: its render failures, bans and failures to start or stop HAProxy
+	events eventLog
+
+	// abuseMu guards abusePolicy, which is nil when abuse blocking is off, and bans by their addresses
+	abuseMu     sync.Mutex
+	abusePolicy *abusePolicy
+	bans        map[string]*abuseBan
+
+	// supervising, rendering and blocking track the goroutines started by start
+	supervising sync.WaitGroup
+	rendering   sync.WaitGroup
+	blocking    sync.WaitGroup
+}
+
+func newService(name string, rt Runtime) *service {
+	return &service{
+		Name:                name,
+		rt:                  rt,
+		stopEnsuringService: make(chan struct{}, 1),
+		stopRendering:       make(chan struct{}, 1),
+		stopBlocking:        make(chan struct{}, 1),
+		rerender:            make(chan struct{}, 1),
+		bans:                map[string]*abuseBan{},
+	}
+}
+
+// confDir is the directory holding the service's config, on the host
+func (svc *service) confDir() string {
+	return filepath.Join(ConfigDir, "/services/", svc.Name)
+}
+
+// candidateConfigPath is where a new config is checked before it replaces the config
+func (svc *service) candidateConfigPath() string {
+	return filepath.Join(svc.confDir(), "/haproxy.cfg.new")
+}
+
+func (svc *service) configPath() string {
+	return filepath.Join(svc.confDir(), "/haproxy.cfg")
+}
+
+func (svc *service) templatePath() string {
+	return filepath.Join(svc.confDir(), "/haproxy.ctmpl")
+}
+
+// logSocketPath is the unix socket HAProxy sends its logs to
+func (svc *service) logSocketPath() string {
+	return filepath.Join(svc.confDir(), "/log.sock")
+}
+
+// aclDir holds the ACL lists of the service
+func (svc *service) aclDir() string {
+	return filepath.Join(svc.confDir(), "/acl")
+}
+
+// adminSocketPath is HAProxy's admin socket, which the manager sends runtime API commands to
+func (svc *service) adminSocketPath() string {
+	return filepath.Join(svc.confDir(), "/haproxy.sock")
+}
+
+func (svc *service) accessLogPath() string {
+	return filepath.Join(svc.confDir(), "/access.log")
+}
+
+// haproxyPath translates a path in the service's config dir to the path HAProxy sees it at
+func (svc *service) haproxyPath(path string) string {
+	if _, native := svc.rt.(*processRuntime); native {
+		return path
+	}
+	return filepath.Join("/usr/local/etc/haproxy", strings.TrimPrefix(path, svc.confDir()))
+}
+
+// logAddress is where HAProxy sends its logs, empty when there is no log receiver
+func (svc *service) logAddress() string {
+	if svc.accessLog == nil {
+		return ""
+	}
+	return svc.accessLog.address(svc)
+}
+
+// label is set on all of the service's containers
+func (svc *service) label() string {
+	return "com.opencopilot.service." + svc.Name
+}
+
+func (svc *service) haproxyName() string {
+	return "com.opencopilot.service." + svc.Name
+}
+
+// checkName is the name of the workloads checking new configs
+func (svc *service) checkName() string {
+	return "com.opencopilot.check." + svc.Name
+}
+
+// consulTemplateName is the name of the consul-template workload, which rendered the config before the manager did
+func (svc *service) consulTemplateName() string {
+	return "com.opencopilot.consul-template." + svc.Name
+}
+
+// ensureConfigDirectory creates the service's config dir, with the default config if it has none, and installs the current template
+func (svc *service) ensureConfigDirectory() error {
+	log.Printf("ensuring the configuration path exists: %s", svc.confDir())
+	err := os.MkdirAll(svc.confDir(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(svc.configPath()); os.IsNotExist(err) { // if config doesn't exist, add the default
+		err := svc.writeDefaultConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(svc.templatePath()); err == nil { // if config template exists, remove it
+		err = os.Remove(svc.templatePath())
+		if err != nil {
+			return err
+		}
+	}
+
+	return copyFile("./haproxy.ctmpl", svc.templatePath())
+}
+
+// writeDefaultConfig installs the default config, which the other services get with their default bind rather than
+// the port of the default service
+func (svc *service) writeDefaultConfig() error {
+	if svc.Name == DefaultServiceName {
+		return copyFile("./haproxy.cfg", svc.configPath())
+	}
+	content, err := ioutil.ReadFile("./haproxy.cfg")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "bind" {
+			lines[i] = strings.Replace(line, fields[1], svc.defaultBind(), 1)
+		}
+	}
+	return ioutil.WriteFile(svc.configPath(), []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// defaultBind is where the service listens until it has frontends: *:80 for the default service, and a unix socket
+// in the config dir for the others, so that a new service doesn't take the port of another one
+func (svc *service) defaultBind() string {
+	if svc.Name == DefaultServiceName {
+		return defaultFrontendBind
+	}
+	return svc.haproxyPath(filepath.Join(svc.confDir(), "http-in.sock"))
+}
+
+// start runs the service's HAProxy supervisor, log receiver, config renderer and abuse blocker
+func (svc *service) start() {
+	accessLog, err := startAccessLog(svc)
+	if err != nil {
+		log.Printf("unable to receive the logs of %s: %v\n", svc.Name, err)
+	}
+	svc.accessLog = accessLog
+
+	// the config used to be rendered by a consul-template workload, which would compete with the renderer
+	if err := svc.rt.Stop(svc.consulTemplateName()); err != nil {
+		log.Printf("unable to stop consul-template for %s: %v\n", svc.Name, err)
+	}
+
+	svc.supervising.Add(1)
+	log.Printf("ensuring that HAProxy is running for %s...\n", svc.Name)
+	go func() {
+		ensureService(svc, svc.stopEnsuringService)
+		svc.supervising.Done()
+	}()
+
+	svc.rendering.Add(1)
+	log.Printf("watching the config of %s\n", svc.Name)
+	go func() {
+		watchKV(svc, svc.stopRendering)
+		svc.rendering.Done()
+	}()
+
+	svc.blocking.Add(1)
+	go func() {
+		blockAbusers(svc, svc.stopBlocking)
+		svc.blocking.Done()
+	}()
+}
+
+// stop ends the service's renderer, log receiver and supervisor, and HAProxy too unless it is to be left running
+func (svc *service) stop(stopWorkloads bool) {
+	svc.stopRendering <- struct{}{}
+	svc.rendering.Wait()
+	svc.stopBlocking <- struct{}{}
+	svc.blocking.Wait()
+
+	if svc.accessLog != nil {
+		defer svc.accessLog.close()
+	}
+
+	if stopWorkloads {
+		svc.stopSupervisor()
+	}
+}
+
+// stopSupervisor ends the service's supervisor and stops HAProxy
+func (svc *service) stopSupervisor() {
+	svc.stopEnsuringService <- struct{}{}
+
+	supervised := make(chan struct{})
+	go func() {
+		svc.supervising.Wait()
+		close(supervised)
+	}()
+	// the supervisor may be starting HAProxy as it is stopped, so keep stopping until the supervisor is done
+	for {
+		stopService(svc)
+		select {
+		case <-supervised:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// requestRender has the renderer render again, a render already requested covers this one too
+func (svc *service) requestRender() {
+	select {
+	case svc.rerender <- struct{}{}:
+	default:
+	}
+}
+
+// recordWorkloadError logs a failure to start, stop or replace the service's HAProxy, and records it as an event
+func (svc *service) recordWorkloadError(action string, err error) {
+	log.Printf("HAProxy for %s: %s: %v\n", svc.Name, action, err)
+	svc.events.record(workloadEvent{Time: time.Now(), Name: svc.Name, Action: action, Error: err.Error()})
+}
+
+// recordRender keeps the outcome of a render for the status, recording an event when it fails differently than before
+func (svc *service) recordRender(err error) {
+	renderErr, ok := err.(*renderError)
+	if err != nil && !ok {
+		renderErr = newRenderError(renderErrorIO, err)
+	}
+	svc.renderMu.Lock()
+	defer svc.renderMu.Unlock()
+	if renderErr != nil && (svc.lastRenderError == nil || svc.lastRenderError.Error() != renderErr.Error()) {
+		log.Printf("unable to render the config of %s: %v\n", svc.Name, renderErr)
+		svc.events.record(workloadEvent{Time: renderErr.Time, Name: svc.Name, Action: "render_error", RenderError: renderErr})
+	}
+	svc.lastRenderError = renderErr
+}
+
+// renderError returns the error of the last render, nil if it succeeded
+func (svc *service) renderError() *renderError {
+	svc.renderMu.Lock()
+	defer svc.renderMu.Unlock()
+	return svc.lastRenderError
+}
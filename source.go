@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sourceWait is how long a source waits for a change before it answers with the current index
+	sourceWait = 5 * time.Minute
+	// dirPollInterval is how often a directory source is read for changes
+	dirPollInterval = time.Second
+)
+
+// configSource provides the keys the service templates are rendered from. Keys are slash separated paths such as
+// instances/<INSTANCE_ID>/services/<name>/maxconn, whichever store they come from.
+type configSource interface {
+	// list returns all keys under prefix. With a non-zero index it blocks until the keys change past that index,
+	// or until the source gives up waiting and returns the same index. The returned index is to be passed to the next call.
+	list(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error)
+}
+
+// newConfigSource returns the source selected by CONFIG_SOURCE: "consul" (the default), "etcd", "dir" or "api"
+func newConfigSource(name string) (configSource, error) {
+	switch name {
+	case "", "consul":
+		return newConsulClient(ConsulSettings), nil
+	case "etcd":
+		return newEtcdKV(EtcdAddr), nil
+	case "dir":
+		return newDirSource(ConfigSourceDir), nil
+	case "api":
+		return newAPISource(filepath.Join(ConfigDir, "/keys.json"))
+	default:
+		return nil, fmt.Errorf("unknown config source: %s", name)
+	}
+}
+
+// dirSource reads keys from a directory tree, each file holding the value of the key named by its path
+type dirSource struct {
+	root string
+
+	mu    sync.Mutex
+	index uint64
+	// seen are the keys last listed under each prefix
+	seen map[string]map[string]string
+}
+
+func newDirSource(root string) *dirSource {
+	return &dirSource{root: root, seen: map[string]map[string]string{}}
+}
+
+// read returns the keys under prefix, dropping a trailing newline from the files as editors add one
+func (s *dirSource) read(prefix string) (map[string]string, error) {
+	kv := map[string]string{}
+	dir := filepath.Join(s.root, filepath.FromSlash(prefix))
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		kv[filepath.ToSlash(rel)] = strings.TrimSuffix(string(value), "\n")
+		return nil
+	})
+	return kv, err
+}
+
+// current reads the keys under prefix, moving the index forward if they differ from the last read
+func (s *dirSource) current(prefix string) (map[string]string, uint64, error) {
+	kv, err := s.read(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seen, ok := s.seen[prefix]; !ok || !reflect.DeepEqual(seen, kv) {
+		s.seen[prefix] = kv
+		s.index++
+	}
+	return kv, s.index, nil
+}
+
+func (s *dirSource) list(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error) {
+	deadline := time.Now().Add(sourceWait)
+	for {
+		kv, current, err := s.current(prefix)
+		if err != nil || index == 0 || current != index || time.Now().After(deadline) {
+			return kv, current, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(dirPollInterval):
+		}
+	}
+}
+
+// apiSource holds keys set through the Configure RPC, saved to a file so they survive restarts
+type apiSource struct {
+	path string
+
+	mu    sync.Mutex
+	index uint64
+	kv    map[string]string
+	// changed is closed and replaced whenever the keys change
+	changed chan struct{}
+}
+
+func newAPISource(path string) (*apiSource, error) {
+	s := &apiSource{path: path, index: 1, kv: map[string]string{}, changed: make(chan struct{})}
+	saved, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(saved, &s.kv); err != nil {
+		return nil, fmt.Errorf("invalid keys in %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// set replaces the keys under prefix with keys, which are relative to the prefix
+func (s *apiSource) set(prefix string, keys map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kv := map[string]string{}
+	for key, value := range s.kv {
+		if !strings.HasPrefix(key, prefix) {
+			kv[key] = value
+		}
+	}
+	for key, value := range keys {
+		kv[prefix+strings.TrimPrefix(key, "/")] = value
+	}
+	saved, err := json.MarshalIndent(kv, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".new", saved, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path+".new", s.path); err != nil {
+		return err
+	}
+
+	s.kv = kv
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *apiSource) list(ctx context.Context, prefix string, index uint64) (map[string]string, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index > 0 && s.index <= index {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return nil, 0, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	kv := map[string]string{}
+	for key, value := range s.kv {
+		if strings.HasPrefix(key, prefix) {
+			kv[key] = value
+		}
+	}
+	return kv, s.index, nil
+}
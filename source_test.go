@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewConfigSource(t *testing.T) {
+	defer setupConfigDir(t, testConfig)()
+	tests := []struct {
+		name   string
+		source configSource
+	}{
+		{"", &consulClient{}},
+		{"consul", &consulClient{}},
+		{"etcd", &etcdKV{}},
+		{"dir", &dirSource{}},
+		{"api", &apiSource{}},
+	}
+	for _, test := range tests {
+		source, err := newConfigSource(test.name)
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if reflect.TypeOf(source) != reflect.TypeOf(test.source) {
+			t.Errorf("%q: expected a %T, got %T", test.name, test.source, source)
+		}
+	}
+	if _, err := newConfigSource("zookeeper"); err == nil {
+		t.Error("expected an unknown source to be rejected")
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	root, err := ioutil.TempDir("", "haproxy-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(key, value string) {
+		path := filepath.Join(root, key)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("svc/maxconn", "500\n")
+	write("svc/backends/web1", "10.0.0.1:80")
+	write("svc/.maxconn.swp", "editor state")
+	write("other/maxconn", "100")
+
+	source := newDirSource(root)
+	kv, index, err := source.list(context.Background(), "svc/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"svc/maxconn": "500", "svc/backends/web1": "10.0.0.1:80"}
+	if !reflect.DeepEqual(kv, expected) {
+		t.Errorf("expected %v, got %v", expected, kv)
+	}
+	if kv, _, err := source.list(context.Background(), "missing/", 0); err != nil || len(kv) != 0 {
+		t.Errorf("expected a missing prefix to have no keys, got %v %v", kv, err)
+	}
+
+	changed := make(chan map[string]string)
+	go func() {
+		kv, _, _ := source.list(context.Background(), "svc/", index)
+		changed <- kv
+	}()
+	write("svc/maxconn", "2000\n")
+	select {
+	case kv := <-changed:
+		if kv["svc/maxconn"] != "2000" {
+			t.Errorf("expected the changed value, got %v", kv)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change wasn't noticed")
+	}
+}
+
+func TestAPISource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	source, err := newAPISource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.set("other/", map[string]string{"maxconn": "100"}); err != nil {
+		t.Fatal(err)
+	}
+	_, index, err := source.list(context.Background(), "svc/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan map[string]string)
+	go func() {
+		kv, _, _ := source.list(context.Background(), "svc/", index)
+		changed <- kv
+	}()
+	if err := source.set("svc/", map[string]string{"maxconn": "500", "/backends/web1": "10.0.0.1:80"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case kv := <-changed:
+		expected := map[string]string{"svc/maxconn": "500", "svc/backends/web1": "10.0.0.1:80"}
+		if !reflect.DeepEqual(kv, expected) {
+			t.Errorf("expected %v, got %v", expected, kv)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked list didn't return")
+	}
+
+	// the keys are kept across restarts, and setting a prefix replaces all its keys
+	if err := source.set("svc/", map[string]string{"maxconn": "600"}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := newAPISource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, _, _ := reloaded.list(context.Background(), "", 0)
+	expected := map[string]string{"svc/maxconn": "600", "other/maxconn": "100"}
+	if !reflect.DeepEqual(kv, expected) {
+		t.Errorf("expected %v after a restart, got %v", expected, kv)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := reloaded.list(ctx, "svc/", 100); err == nil {
+		t.Error("expected a cancelled list to fail")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// minHealthyRun is how long a workload has to run for its exit not to be counted as a failure to start
+	minHealthyRun = 10 * time.Second
+	// maxRestartDelay caps the back off between restarts of a workload that keeps failing to start
+	maxRestartDelay = 30 * time.Second
+)
+
+// describeExit explains the cause of a workload exit for the logs
+func describeExit(exit workloadExit) string {
+	switch {
+	case exit.OOMKilled:
+		return fmt.Sprintf("OOM killed (status %d)", exit.Code)
+	case exit.Unhealthy:
+		return fmt.Sprintf("stopped for failing its health checks (status %d)", exit.Code)
+	case exit.External:
+		return fmt.Sprintf("killed externally with %s (status %d)", exit.Signal, exit.Code)
+	case exit.Signal != "":
+		return fmt.Sprintf("stopped with %s (status %d)", exit.Signal, exit.Code)
+	default:
+		return fmt.Sprintf("exited with status %d", exit.Code)
+	}
+}
+
+// restartBackoff decides how long the supervisor of a workload waits before starting it again
+type restartBackoff struct {
+	failures int
+}
+
+// next returns the delay before the next start, given how the workload exited and how long it ran for.
+// Workloads that were OOM killed, removed externally, unhealthy or ran for a while are restarted immediately, workloads
+// that exit with an error right after starting (most likely a config error) are restarted with an increasing delay.
+func (b *restartBackoff) next(what string, exit workloadExit, ranFor time.Duration) time.Duration {
+	switch {
+	case exit.OOMKilled:
+		log.Printf("%s ran out of memory, consider raising its memory limit\n", what)
+		b.failures = 0
+		return 0
+	case exit.Unhealthy:
+		b.failures = 0
+		return 0
+	case exit.External:
+		log.Printf("%s was stopped outside of the manager, restarting it\n", what)
+		b.failures = 0
+		return 0
+	case exit.Code == 0 || ranFor >= minHealthyRun:
+		b.failures = 0
+		return 0
+	}
+
+	b.failures++
+	delay := time.Second << uint(b.failures-1)
+	if delay > maxRestartDelay || delay <= 0 {
+		delay = maxRestartDelay
+	}
+	log.Printf("%s failed %d time(s) in a row shortly after starting, retrying in %s\n", what, b.failures, delay)
+	return delay
+}
+
+// sleepOrQuit waits for delay, returning early with false when quit is signalled
+func sleepOrQuit(delay time.Duration, quit chan struct{}) bool {
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-quit:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
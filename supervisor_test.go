@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	backoff := &restartBackoff{}
+	failure := workloadExit{Code: 1}
+
+	delays := []time.Duration{}
+	for i := 0; i < 7; i++ {
+		delays = append(delays, backoff.next("HAProxy", failure, time.Second))
+	}
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, maxRestartDelay, maxRestartDelay}
+	for i := range expected {
+		if delays[i] != expected[i] {
+			t.Errorf("failure %d: expected a delay of %s, got %s", i+1, expected[i], delays[i])
+		}
+	}
+
+	if delay := backoff.next("HAProxy", workloadExit{Code: 137, OOMKilled: true}, time.Second); delay != 0 {
+		t.Errorf("expected an OOM killed workload to be restarted immediately, got %s", delay)
+	}
+	if delay := backoff.next("HAProxy", failure, time.Second); delay != time.Second {
+		t.Errorf("expected the back off to be reset, got %s", delay)
+	}
+	if delay := backoff.next("HAProxy", workloadExit{Code: 137, Signal: "SIGKILL", External: true}, time.Second); delay != 0 {
+		t.Errorf("expected an externally killed workload to be restarted immediately, got %s", delay)
+	}
+	if delay := backoff.next("HAProxy", workloadExit{Code: 143, Signal: "SIGTERM", Unhealthy: true}, time.Second); delay != 0 {
+		t.Errorf("expected an unhealthy workload to be restarted immediately, got %s", delay)
+	}
+	if delay := backoff.next("HAProxy", failure, time.Hour); delay != 0 {
+		t.Errorf("expected a workload which ran for a while to be restarted immediately, got %s", delay)
+	}
+}